@@ -9,6 +9,8 @@ import (
 	survey "github.com/AlecAivazis/survey/v2"
 	"github.com/pkg/errors"
 	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/env"
+	"github.com/protosio/cli/internal/output"
 	"github.com/urfave/cli/v2"
 )
 
@@ -27,14 +29,27 @@ var cmdCloud *cli.Command = &cli.Command{
 			Name:      "add",
 			ArgsUsage: "<name>",
 			Usage:     "Add a new cloud provider account",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "secret-backend",
+					Value: "db",
+					Usage: "Where the credentials are stored: " + strings.Join(env.SecretBackends, ", ") + ". Credentials already present in the backend are not asked for",
+				},
+				inputFlag("cloud.type", "Cloud provider `TYPE`: "+strings.Join(cloud.SupportedProviders(), ", ")),
+				credentialFlag,
+				fromFileFlag,
+			},
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
 					os.Exit(1)
 				}
-				_, err := addCloudProvider(name)
-				return err
+				in, err := newInputs(c)
+				if err != nil {
+					return err
+				}
+				return addCloudProvider(in, name, c.String("secret-backend"))
 			},
 		},
 		{
@@ -76,28 +91,60 @@ func listCloudProviders() error {
 		return err
 	}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 16, 16, 0, '\t', 0)
+	views := []cloudView{}
+	rows := [][]string{}
+	for _, cl := range clouds {
+		if showSecrets {
+			cl.Auth, err = envi.CloudAuth(cl)
+			if err != nil {
+				return err
+			}
+		}
+		view := newCloudView(cl)
+		views = append(views, view)
+		rows = append(rows, []string{view.Name, view.Type, view.SecretBackend})
+	}
+	return out.List(views, []output.Column{{Header: "Name"}, {Header: "Type"}, {Header: "Secret backend", Wide: true}}, rows)
+}
 
-	defer w.Flush()
+// getCloud retrieves a cloud provider from the DB, together with its credentials
+func getCloud(name string) (cloud.ProviderInfo, error) {
+	cloudInfo, err := envi.DB.GetCloud(name)
+	if err != nil {
+		return cloudInfo, err
+	}
+	cloudInfo.Auth, err = envi.CloudAuth(cloudInfo)
+	return cloudInfo, err
+}
 
-	fmt.Fprintf(w, " %s\t%s\t", "Name", "Type")
-	fmt.Fprintf(w, "\n %s\t%s\t", "----", "----")
-	for _, cl := range clouds {
-		fmt.Fprintf(w, "\n %s\t%s\t", cl.Name, cl.Type)
+func addCloudProvider(in *inputs, cloudName string, secretBackend string) error {
+	client, err := newCloudProvider(in, cloudName, secretBackend)
+	if err != nil {
+		return err
 	}
-	fmt.Fprint(w, "\n")
-	return nil
+	err = in.check()
+	if err != nil {
+		return err
+	}
+	return saveCloudProvider(client, secretBackend)
 }
 
-func addCloudProvider(cloudName string) (cloud.Provider, error) {
+// newCloudProvider creates a cloud provider client, using the cloud type and credentials provided as inputs or prompted
+// for. The client is initialised only if all the inputs are available, and it's nil if the cloud type is missing
+func newCloudProvider(in *inputs, cloudName string, secretBackend string) (cloud.Provider, error) {
+	_, err := env.NewSecretBackend(secretBackend)
+	if err != nil {
+		return nil, err
+	}
+
 	// select cloud provider
-	var cloudType string
-	cloudProviderSelect := surveySelect(cloud.SupportedProviders(), "Choose one of the following supported cloud providers:")
-	err := survey.AskOne(cloudProviderSelect, &cloudType)
+	cloudType, err := in.choose("cloud.type", cloud.SupportedProviders(), "Choose one of the following supported cloud providers:")
 	if err != nil {
 		return nil, err
 	}
+	if cloudType == "" {
+		return nil, nil
+	}
 
 	// create new cloud provider
 	client, err := cloud.NewProvider(cloudName, cloudType)
@@ -105,63 +152,106 @@ func addCloudProvider(cloudName string) (cloud.Provider, error) {
 		return nil, err
 	}
 
-	// get cloud provider credentials
-	cloudCredentials := map[string]interface{}{}
-	credFields := client.AuthFields()
-	credentialsQuestions := getCloudCredentialsQuestions(cloudType, credFields)
-
-	err = survey.Ask(credentialsQuestions, &cloudCredentials)
+	// get cloud provider credentials. Provided fields take precedence over the ones already present in the secret
+	// backend, which are reused
+	credentials, err := envi.LookupCloudAuth(cloud.ProviderInfo{Name: cloudName, SecretBackend: secretBackend}, client.AuthFields())
 	if err != nil {
 		return nil, err
 	}
+	for _, field := range client.AuthFields() {
+		if value, found := in.lookup(credentialsInput + field); found {
+			credentials[field] = value
+			continue
+		}
+		if _, found := credentials[field]; found {
+			log.Infof("Using credentials field '%s' from secret backend '%s'", field, secretBackend)
+			continue
+		}
+		credentials[field], err = in.get(credentialsInput+field, &survey.Input{Message: cloudType + " " + field + ":"})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(in.missing) > 0 {
+		return client, nil
+	}
 
 	// init cloud client
-	err = client.Init(transformCredentials(cloudCredentials))
+	err = client.Init(credentials)
 	if err != nil {
 		return nil, err
 	}
 
-	// save the cloud provider in the db
+	return client, nil
+}
+
+// saveCloudProvider saves the cloud provider in the db, and the credentials in the secret backend
+func saveCloudProvider(client cloud.Provider, secretBackend string) error {
 	cloudProviderInfo := client.GetInfo()
-	err = envi.DB.SaveCloud(cloudProviderInfo)
+	if secretBackend != "db" {
+		cloudProviderInfo.SecretBackend = secretBackend
+	}
+	err := envi.SaveCloud(cloudProviderInfo)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to save cloud provider info")
+		return errors.Wrap(err, "Failed to save cloud provider info")
 	}
-
-	return client, nil
+	return nil
 }
 
 func deleteCloudProvider(name string) error {
-	return envi.DB.DeleteCloud(name)
+	return envi.DeleteCloud(name)
 }
 
 func infoCloudProvider(name string) error {
-	cloud, err := envi.DB.GetCloud(name)
+	cloud, err := getCloud(name)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
 	}
+	view := cloudInfoView{cloudView: newCloudView(cloud), MachineTypes: map[string]machineView{}}
 	client := cloud.Client()
-	locations := client.SupportedLocations()
+	view.Locations = client.SupportedLocations()
 	err = client.Init(cloud.Auth)
 	if err != nil {
 		log.Error(errors.Wrapf(err, "Error reaching cloud provider '%s'(%s) API", name, cloud.Type.String()))
 	}
-	machineTypes, err := client.SupportedMachines(locations[0])
+	machineTypes, err := client.SupportedMachines(view.Locations[0])
 	if err != nil {
 		log.Error(errors.Wrapf(err, "Error reaching cloud provider '%s'(%s) API", name, cloud.Type.String()))
+		view.Status = "NOT OK"
+		view.Error = err.Error()
+	} else {
+		view.Status = "OK"
+	}
+	for id, spec := range machineTypes {
+		view.MachineTypes[id] = machineView(spec)
 	}
-	fmt.Printf("Name: %s\n", cloud.Name)
-	fmt.Printf("Type: %s\n", cloud.Type.String())
-	fmt.Printf("Supported locations: %s\n", strings.Join(locations, " | "))
+
+	if out.Format != output.Table && out.Format != output.Wide {
+		return out.Info(view, nil)
+	}
+	fmt.Printf("Name: %s\n", view.Name)
+	fmt.Printf("Type: %s\n", view.Type)
+	fmt.Printf("Secret backend: %s\n", view.SecretBackend)
+	if showSecrets {
+		for _, field := range sortedKeys(view.Credentials) {
+			fmt.Printf("Credentials %s: %s\n", field, view.Credentials[field])
+		}
+	}
+	fmt.Printf("Supported locations: %s\n", strings.Join(view.Locations, " | "))
 	fmt.Printf("Supported machine types: \n")
 	w := new(tabwriter.Writer)
 	w.Init(os.Stdout, 8, 8, 0, ' ', 0)
-	for instanceID, instanceSpec := range machineTypes {
-		fmt.Fprintf(w, "    %s\t -  Nr of CPUs: %d,\t Memory: %d MiB,\t Storage: %d GB\t\n", instanceID, instanceSpec.Cores, instanceSpec.Memory, instanceSpec.DefaultStorage)
+	for _, instanceID := range sortedMachineTypes(view.MachineTypes) {
+		instanceSpec := view.MachineTypes[instanceID]
+		fmt.Fprintf(w, "    %s\t -  Nr of CPUs: %d,\t Memory: %d MiB,\t Storage: %d GB\t", instanceID, instanceSpec.Cores, instanceSpec.Memory, instanceSpec.DefaultStorage)
+		if out.Format == output.Wide {
+			fmt.Fprintf(w, " Bandwidth: %d Mbit,\t Price: %.2f/month\t", instanceSpec.Bandwidth, instanceSpec.PriceMonthly)
+		}
+		fmt.Fprint(w, "\n")
 	}
 	w.Flush()
-	if err != nil {
-		fmt.Printf("Status: NOT OK (%s)\n", err.Error())
+	if view.Error != "" {
+		fmt.Printf("Status: NOT OK (%s)\n", view.Error)
 	} else {
 		fmt.Printf("Status: OK - API reachable\n")
 	}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+
+	survey "github.com/AlecAivazis/survey/v2"
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/db"
+	"github.com/protosio/cli/internal/user"
+	"github.com/urfave/cli/v2"
+)
+
+const dbPassphraseEnv = "PROTOS_DB_PASSPHRASE"
+
+var cmdDB *cli.Command = &cli.Command{
+	Name:  "db",
+	Usage: "Manage the local database",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "info",
+			Usage: "Prints the schema version of the local database and how its secrets are encrypted",
+			Action: func(c *cli.Context) error {
+				return infoDB()
+			},
+		},
+		{
+			Name:        "encrypt",
+			Usage:       "Encrypts the secrets in an existing plaintext database",
+			Description: "Encrypts the cloud credentials, instance keys and user password using a key derived from a passphrase, or a random key stored in the OS keyring",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "keyring",
+					Usage: "Store the encryption key in the OS keyring instead of using a passphrase",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if envi.DB.Encryption() != db.EncryptionNone {
+					return errors.New("Database is already encrypted. Use 'db rekey' to change the encryption key")
+				}
+				return rekeyDB(c.Bool("keyring"), false)
+			},
+		},
+		{
+			Name:  "rekey",
+			Usage: "Re-encrypts the secrets in the database using a new key",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "keyring",
+					Usage: "Store the new encryption key in the OS keyring instead of using a passphrase",
+				},
+				&cli.BoolFlag{
+					Name:  "decrypt",
+					Usage: "Store the secrets in plaintext",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Bool("keyring") && c.Bool("decrypt") {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return rekeyDB(c.Bool("keyring"), c.Bool("decrypt"))
+			},
+		},
+	},
+}
+
+// dbPassphrase returns the DB passphrase from the environment, or prompts for it
+func dbPassphrase(message string, confirm bool) (string, error) {
+	return askPassphrase(dbPassphraseEnv, message, confirm)
+}
+
+// askPassphrase returns a passphrase from the provided environment variable, or prompts for it. New passphrases are
+// asked twice
+func askPassphrase(envName string, message string, confirm bool) (string, error) {
+	passphrase := os.Getenv(envName)
+	if passphrase != "" {
+		return passphrase, nil
+	}
+
+	err := survey.AskOne(&survey.Password{Message: message}, &passphrase, survey.WithValidator(survey.Required))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read passphrase")
+	}
+	if confirm {
+		passphraseConfirm := ""
+		err = survey.AskOne(&survey.Password{Message: "Confirm passphrase:"}, &passphraseConfirm)
+		if err != nil {
+			return "", errors.Wrap(err, "Failed to read passphrase")
+		}
+		if passphrase != passphraseConfirm {
+			return "", errors.New("Passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+//
+// DB methods
+//
+
+func infoDB() error {
+	log.Infof("Database schema version: %d", db.SchemaVersion())
+	switch envi.DB.Encryption() {
+	case db.EncryptionPassphrase:
+		log.Info("Database secrets are encrypted using a passphrase")
+	case db.EncryptionKeyring:
+		log.Info("Database secrets are encrypted using a key stored in the OS keyring")
+	default:
+		log.Info("Database secrets are not encrypted. Run 'db encrypt' to encrypt them")
+	}
+	return nil
+}
+
+func rekeyDB(useKeyring bool, decrypt bool) error {
+	mode := db.EncryptionPassphrase
+	passphrase := ""
+	var err error
+	if decrypt {
+		mode = db.EncryptionNone
+	} else if useKeyring {
+		mode = db.EncryptionKeyring
+	} else {
+		passphrase, err = dbPassphrase("New database passphrase:", true)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = envi.DB.Rekey(mode, passphrase, &[]user.Info{})
+	if err != nil {
+		return err
+	}
+	return infoDB()
+}
@@ -10,8 +10,8 @@ import (
 	"github.com/protosio/cli/internal/ssh"
 	"github.com/protosio/cli/internal/user"
 	pclient "github.com/protosio/protos/pkg/client"
-	"github.com/protosio/protos/pkg/types"
 	"github.com/urfave/cli/v2"
+	gssh "golang.org/x/crypto/ssh"
 )
 
 var cmdDev *cli.Command = &cli.Command{
@@ -78,17 +78,17 @@ func devInit(instanceName string, keyFile string, ipString string) error {
 	}
 
 	// allocate network for dev instance
-	instances, err := envi.DB.GetAllInstances()
-	if err != nil {
-		return fmt.Errorf("Failed to allocate network for instance '%s': %w", "dev", err)
-	}
-	developmentNetwork, err := user.AllocateNetwork(instances)
+	developmentNetwork, err := allocateNetwork(usr.AllDevices())
 	if err != nil {
 		return fmt.Errorf("Failed to allocate network for instance '%s': %w", "dev", err)
 	}
 
 	log.Infof("Creating SSH tunnel to dev instance IP '%s'", ipString)
-	tunnel := ssh.NewTunnel(ip.String()+":22", "root", auth, "localhost:8080", log)
+	hostKeyCallback := ssh.PinnedHostKey(nil, func(key gssh.PublicKey) error {
+		instanceInfo.HostKey = key.Marshal()
+		return nil
+	})
+	tunnel := ssh.NewTunnel(ssh.ConnectionConfig{Host: ip.String(), User: "root", Auth: auth, HostKeyCallback: hostKeyCallback}, "localhost:8080", log)
 	localPort, err := tunnel.Start()
 	if err != nil {
 		return errors.Wrap(err, "Error while creating the SSH tunnel")
@@ -109,19 +109,13 @@ func devInit(instanceName string, keyFile string, ipString string) error {
 	// do the initialization
 	log.Infof("Initializing instance at '%s'", ipString)
 	protos := pclient.NewInitClient(fmt.Sprintf("127.0.0.1:%d", localPort), user.Username, user.Password)
-	key, err := ssh.NewKeyFromSeed(usr.Device.KeySeed)
+	usrDevs, err := userDevices(usr)
 	if err != nil {
-		panic(err)
-	}
-
-	usrDev := types.UserDevice{
-		Name:      usr.Device.Name,
-		PublicKey: key.PublicWG().String(),
-		Network:   usr.Device.Network,
+		return err
 	}
 
 	// Doing the instance initialization which returns the internal wireguard IP and the public key created using the wireguard library.
-	instanceIP, instancePublicKey, err := protos.InitInstance(user.Name, developmentNetwork.String(), user.Domain, []types.UserDevice{usrDev})
+	instanceIP, instancePublicKey, err := protos.InitInstance(user.Name, developmentNetwork.String(), user.Domain, usrDevs)
 	if err != nil {
 		return errors.Wrap(err, "Error while doing the instance initialization")
 	}
@@ -140,6 +134,7 @@ func devInit(instanceName string, keyFile string, ipString string) error {
 		return errors.Wrap(err, "Error while terminating the SSH tunnel")
 	}
 	log.Infof("Instance at '%s' is ready", ipString)
+	updateSSHConfig()
 
 	return nil
 }
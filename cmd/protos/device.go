@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/output"
+	"github.com/protosio/cli/internal/ssh"
+	"github.com/protosio/cli/internal/user"
+	"github.com/protosio/protos/pkg/types"
+	"github.com/skip2/go-qrcode"
+	"github.com/urfave/cli/v2"
+)
+
+var cmdDevice *cli.Command = &cli.Command{
+	Name:  "device",
+	Usage: "Manage the devices (laptops, phones, etc) which can connect to your instances using WireGuard",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List devices",
+			Action: func(c *cli.Context) error {
+				return listDevices()
+			},
+		},
+		{
+			Name:      "add",
+			ArgsUsage: "<name>",
+			Usage:     "Add a device, which can connect to the instances deployed afterwards",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "key",
+					Usage: "Import an existing WireGuard private `KEY` (base64, as generated by 'wg genkey'), instead of generating a new one",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return addDevice(name, c.String("key"))
+			},
+		},
+		{
+			Name:      "remove",
+			ArgsUsage: "<name>",
+			Usage:     "Remove a device, which is removed from the instances deployed afterwards",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return removeDevice(name)
+			},
+		},
+		{
+			Name:      "export",
+			ArgsUsage: "<name>",
+			Usage:     "Print the WireGuard config of a device, in the wg-quick format, so it can be used on devices that don't run protos-cli",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "qr",
+					Usage: "Print the config as a QR code, which can be scanned by the WireGuard mobile apps",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return exportDevice(name, c.Bool("qr"))
+			},
+		},
+		{
+			Name:  "push",
+			Usage: "Push the device list to all the instances. Not supported by the instance API yet, so it reports the instances using an outdated list",
+			Action: func(c *cli.Context) error {
+				return pushDevices()
+			},
+		},
+	},
+}
+
+// userDevices returns the devices of the user, in the format used by the Protos API
+func userDevices(usr user.Info) ([]types.UserDevice, error) {
+	devices := []types.UserDevice{}
+	for _, dev := range usr.AllDevices() {
+		key, err := ssh.NewKeyFromSeed(dev.KeySeed)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Device '%s' has an invalid key", dev.Name)
+		}
+		devices = append(devices, types.UserDevice{
+			Name:      dev.Name,
+			PublicKey: key.PublicWG().String(),
+			Network:   dev.Network,
+		})
+	}
+	return devices, nil
+}
+
+//
+// Device methods
+//
+
+func listDevices() error {
+	usr, err := user.Get(envi)
+	if err != nil {
+		return err
+	}
+
+	views := []deviceView{}
+	rows := [][]string{}
+	for i, dev := range usr.AllDevices() {
+		view, err := newDeviceView(dev, i == 0)
+		if err != nil {
+			return err
+		}
+		views = append(views, view)
+		local := ""
+		if view.Local {
+			local = "*"
+		}
+		rows = append(rows, []string{local, view.Name, view.Network, view.WireguardPublicKey})
+	}
+	return out.List(views, []output.Column{{Header: " "}, {Header: "Name"}, {Header: "Network"}, {Header: "Public key (wireguard)", Wide: true}}, rows)
+}
+
+func addDevice(name string, privateKey string) error {
+	usr, err := user.Get(envi)
+	if err != nil {
+		return err
+	}
+
+	var keySeed []byte
+	if privateKey != "" {
+		keySeed, err = base64.StdEncoding.DecodeString(privateKey)
+		if err != nil || len(keySeed) != 32 {
+			return errors.New("Invalid WireGuard private key. It should be 32 bytes, base64 encoded")
+		}
+	}
+
+	network, err := allocateNetwork(usr.AllDevices())
+	if err != nil {
+		return errors.Wrapf(err, "Failed to add device '%s'", name)
+	}
+	dev, err := usr.AddDevice(name, keySeed, network)
+	if err != nil {
+		return err
+	}
+	log.Infof("Device '%s' added, using network '%s'", dev.Name, dev.Network)
+
+	return pushDevices()
+}
+
+func removeDevice(name string) error {
+	usr, err := user.Get(envi)
+	if err != nil {
+		return err
+	}
+	err = usr.RemoveDevice(name)
+	if err != nil {
+		return err
+	}
+	log.Infof("Device '%s' removed", name)
+
+	return pushDevices()
+}
+
+func exportDevice(name string, qr bool) error {
+	usr, err := user.Get(envi)
+	if err != nil {
+		return err
+	}
+	dev, err := usr.GetDevice(name)
+	if err != nil {
+		return err
+	}
+	instances, err := envi.DB.GetAllInstances()
+	if err != nil {
+		return errors.Wrap(err, "Failed to retrieve instances")
+	}
+
+	primary, err := envi.DB.GetPrimaryInstance()
+	if err != nil {
+		return err
+	}
+
+	wgConfig, err := deviceWGConfig(dev, instances, primary)
+	if err != nil {
+		return err
+	}
+	if !qr {
+		fmt.Print(wgConfig)
+		return nil
+	}
+	code, err := qrcode.New(wgConfig, qrcode.Low)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create QR code for device '%s'", name)
+	}
+	fmt.Print(code.ToSmallString(false))
+	return nil
+}
+
+// deviceWGConfig returns the wg-quick config of a device, with one peer for each instance
+func deviceWGConfig(dev user.Device, allInstances []cloud.InstanceInfo, primaryName string) (string, error) {
+	var wgConfig bytes.Buffer
+	fmt.Fprintf(&wgConfig, "[Interface]\n")
+	fmt.Fprintf(&wgConfig, "PrivateKey = %s\n", base64.StdEncoding.EncodeToString(dev.KeySeed))
+	fmt.Fprintf(&wgConfig, "Address = %s\n", dev.Network)
+
+	for _, instance := range allInstances {
+		if len(instance.PublicKey) == 0 || instance.InternalIP == "" {
+			log.Warnf("Instance '%s' was not initialized, so it's not added as a peer", instance.Name)
+		}
+	}
+	instances := initializedInstances(allInstances)
+	if len(instances) == 0 {
+		return "", errors.New("There are no initialized instances that the device could connect to")
+	}
+
+	// same as the VPN, the primary instance is the first DNS server and the rest are used as fallback. wg-quick has no
+	// per domain DNS servers, so the instance subdomains are resolved by the primary instance as well
+	primary, err := primaryInstance(instances, primaryName)
+	if err != nil {
+		return "", err
+	}
+	dnsServers := []string{primary.InternalIP}
+	for _, instance := range instances {
+		if instance.Name != primary.Name {
+			dnsServers = append(dnsServers, instance.InternalIP)
+		}
+	}
+	fmt.Fprintf(&wgConfig, "DNS = %s\n", strings.Join(dnsServers, ", "))
+
+	for _, instance := range instances {
+		fmt.Fprintf(&wgConfig, "\n# %s\n[Peer]\nPublicKey = %s\nEndpoint = %s\nAllowedIPs = %s\nPersistentKeepalive = 25\n",
+			instance.Name, base64.StdEncoding.EncodeToString(instance.PublicKey), net.JoinHostPort(instance.PublicIP, "10999"), instance.Network)
+	}
+	return wgConfig.String(), nil
+}
+
+// errDevicePushUnsupported is returned while the Protos instance API has no call for updating the devices of an
+// initialized instance. Re-initializing a running instance could change its WireGuard key and address, which would
+// cut off every other device, so it's not used as a workaround
+var errDevicePushUnsupported = errors.New("The Protos instance API doesn't support updating the devices of a running instance yet")
+
+// pushDevices sends the device list to all the instances, which update their WireGuard peers accordingly. Until the
+// instance API supports it, it fails and names the instances which still use the previous device list
+func pushDevices() error {
+	instances, err := envi.DB.GetAllInstances()
+	if err != nil {
+		return errors.Wrap(err, "Failed to retrieve instances")
+	}
+	names := []string{}
+	for _, instance := range initializedInstances(instances) {
+		names = append(names, instance.Name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return errors.Wrapf(errDevicePushUnsupported, "The device list was saved locally, but instance(s) '%s' still use the previous one. Instances deployed from now on use the new list", strings.Join(names, "', '"))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/user"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDeviceWGConfig(t *testing.T) {
+	log = logrus.New()
+	dev := user.Device{Name: "phone", KeySeed: []byte("device-key"), Network: "10.100.3.2/24"}
+	instances := []cloud.InstanceInfo{
+		{Name: "one", PublicKey: []byte("one-key"), PublicIP: "192.0.2.1", InternalIP: "10.100.1.1", Network: "10.100.1.0/24"},
+		{Name: "pending", PublicIP: "192.0.2.3", Network: "10.100.4.0/24"},
+		{Name: "two", PublicKey: []byte("two-key"), PublicIP: "2001:db8::2", InternalIP: "10.100.2.1", Network: "10.100.2.0/24"},
+	}
+
+	wgConfig, err := deviceWGConfig(dev, instances, "two")
+	if err != nil {
+		t.Fatalf("Failed to generate WireGuard config: %s", err)
+	}
+	expected := []string{
+		"[Interface]",
+		"PrivateKey = " + base64.StdEncoding.EncodeToString(dev.KeySeed),
+		"Address = 10.100.3.2/24",
+		// the primary instance is the first DNS server
+		"DNS = 10.100.2.1, 10.100.1.1",
+		"",
+		"# one",
+		"[Peer]",
+		"PublicKey = " + base64.StdEncoding.EncodeToString([]byte("one-key")),
+		"Endpoint = 192.0.2.1:10999",
+		"AllowedIPs = 10.100.1.0/24",
+		"PersistentKeepalive = 25",
+		"",
+		"# two",
+		"[Peer]",
+		"PublicKey = " + base64.StdEncoding.EncodeToString([]byte("two-key")),
+		"Endpoint = [2001:db8::2]:10999",
+		"AllowedIPs = 10.100.2.0/24",
+		"PersistentKeepalive = 25",
+	}
+	lines := strings.Split(strings.TrimSuffix(wgConfig, "\n"), "\n")
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected WireGuard config:\n%s\nExpected:\n%s", wgConfig, strings.Join(expected, "\n"))
+	}
+
+	// without a primary instance, the first initialized instance is used
+	wgConfig, err = deviceWGConfig(dev, instances, "")
+	if err != nil {
+		t.Fatalf("Failed to generate WireGuard config: %s", err)
+	}
+	if !strings.Contains(wgConfig, "DNS = 10.100.1.1, 10.100.2.1\n") {
+		t.Fatalf("Expected the first instance to be the first DNS server:\n%s", wgConfig)
+	}
+
+	if _, err := deviceWGConfig(dev, instances[1:2], ""); err == nil {
+		t.Fatal("Expected an error when there are no initialized instances")
+	}
+}
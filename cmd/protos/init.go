@@ -3,114 +3,128 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"text/tabwriter"
 
 	survey "github.com/AlecAivazis/survey/v2"
 	"github.com/pkg/errors"
 	"github.com/protosio/cli/internal/cloud"
-	ssh "github.com/protosio/cli/internal/ssh"
 	"github.com/protosio/cli/internal/user"
 	"github.com/urfave/cli/v2"
 )
 
+var userInputFlags = []cli.Flag{
+	inputFlag("user.username", "`USERNAME` used to uniquely identify you"),
+	inputFlag("user.name", "Your `NAME`. Defaults to the username"),
+	inputFlag("user.password", "`PASSWORD` used to authenticate on the Protos instance and apps. Values passed on the command line are visible in the process list, so prefer the environment variable or --from-file"),
+	inputFlag("user.domain", "`DOMAIN` name used by the Protos instance"),
+	fromFileFlag,
+}
+
 var cmdInit *cli.Command = &cli.Command{
-	Name:  "init",
-	Usage: "Initializes Protos locally and deploys an instance in one of the supported clouds",
+	Name:        "init",
+	Usage:       "Initializes Protos locally and deploys an instance in one of the supported clouds",
+	Description: "Values which are not provided using flags, environment variables or --from-file are prompted for. When stdin is not a terminal, all the missing values are reported instead",
 	Subcommands: []*cli.Command{
 		{
 			Name:  "minimal",
 			Usage: "Initialize local database and user details",
+			Flags: userInputFlags,
 			Action: func(c *cli.Context) error {
-				return protosMinimalInit()
+				in, err := newInputs(c)
+				if err != nil {
+					return err
+				}
+				return protosMinimalInit(in)
 			},
 		},
 		{
 			Name:  "full",
 			Usage: "Initialize a protos instance. Created local db, user, adds a cloud provider and a Protos instance.",
+			Flags: append([]cli.Flag{
+				inputFlag("cloud.name", "`NAME` used to identify the cloud provider account internally"),
+				inputFlag("cloud.type", "Cloud provider `TYPE`: "+strings.Join(cloud.SupportedProviders(), ", ")),
+				credentialFlag,
+				inputFlag("instance.name", "`NAME` of the Protos instance"),
+				inputFlag("instance.location", "Cloud `LOCATION` to deploy the instance in"),
+				inputFlag("instance.type", "Cloud machine `TYPE` of the instance"),
+			}, userInputFlags...),
 			Action: func(c *cli.Context) error {
-				return protosFullInit()
+				in, err := newInputs(c)
+				if err != nil {
+					return err
+				}
+				return protosFullInit(in)
 			},
 		},
 	},
 }
 
-func protosUserinit() error {
-
+// getUserInputs returns the user details, prompting for the ones that were not provided
+func getUserInputs(in *inputs) (userDetails, error) {
+	ud := userDetails{}
 	usrInfo, err := user.Get(envi)
 	if err == nil {
-		return fmt.Errorf("User '%s' already initialized", usrInfo.Username)
+		return ud, fmt.Errorf("User '%s' already initialized", usrInfo.Username)
+	} else if err != user.ErrNoUser {
+		return ud, err
 	}
 
-	userNameQuestion := []*survey.Question{{
-		Name:     "username",
-		Prompt:   &survey.Input{Message: "A username to uniquely identify you.\nUSERNAME: "},
-		Validate: survey.Required,
-	}}
-	var username string
-	err = survey.Ask(userNameQuestion, &username)
+	ud.Username, err = in.get("user.username", &survey.Input{Message: "A username to uniquely identify you.\nUSERNAME: "})
 	if err != nil {
-		return err
+		return ud, err
 	}
 
-	nameQuestion := []*survey.Question{{
-		Name:     "name",
-		Prompt:   &survey.Input{Message: "Your name. This field is not mandatory and if left blank, your username will be used instead.\nNAME: "},
-		Validate: survey.Required,
-	}}
-	var name string
-	err = survey.Ask(nameQuestion, &name)
-	if err != nil {
-		return err
+	if _, found := in.lookup("user.name"); !found && !in.interactive {
+		ud.Name = ud.Username
+	} else {
+		ud.Name, err = in.get("user.name", &survey.Input{Message: "Your name. This field is not mandatory and if left blank, your username will be used instead.\nNAME: "})
+		if err != nil {
+			return ud, err
+		}
 	}
 
-	password := ""
-	passwordconfirm := " "
-
-	for password != passwordconfirm {
-		passwordQuestion := []*survey.Question{{
-			Name:     "password",
-			Prompt:   &survey.Password{Message: "Password used to authenticate on the Protos instance and apps that you deploy on it.\nPASSWORD: "},
-			Validate: survey.Required,
-		}}
-		err = survey.Ask(passwordQuestion, &password)
+	if _, found := in.lookup("user.password"); found || !in.interactive {
+		ud.Password, _ = in.get("user.password", nil)
+	}
+	for ud.Password == "" && in.interactive {
+		ud.Password, err = in.get("user.password", &survey.Password{Message: "Password used to authenticate on the Protos instance and apps that you deploy on it.\nPASSWORD: "})
 		if err != nil {
-			return err
+			return ud, err
 		}
-		passwordConfirmQuestion := []*survey.Question{{
-			Name:     "passwordconfirm",
-			Prompt:   &survey.Password{Message: "CONFIRM PASSWORD: "},
-			Validate: survey.Required,
-		}}
-		err = survey.Ask(passwordConfirmQuestion, &passwordconfirm)
+		err = survey.AskOne(&survey.Password{Message: "CONFIRM PASSWORD: "}, &ud.PasswordConfirm, survey.WithValidator(survey.Required))
 		if err != nil {
-			return err
+			return ud, err
 		}
-		if password != passwordconfirm {
+		if ud.Password != ud.PasswordConfirm {
 			envi.Log.Error("Passwords don't match")
+			ud.Password = ""
 		}
 	}
 
-	domainQuestion := []*survey.Question{{
-		Name:     "name",
-		Prompt:   &survey.Input{Message: "Fill in a domain name that you would like to use.\nIMPORTANT NOTE: ideally you own the domain or it is available for registration. If not, the domain will only be able to be used internally.\nDOMAIN: "},
-		Validate: survey.Required,
-	}}
-	var domain string
-	err = survey.Ask(domainQuestion, &domain)
+	ud.Domain, err = in.get("user.domain", &survey.Input{Message: "Fill in a domain name that you would like to use.\nIMPORTANT NOTE: ideally you own the domain or it is available for registration. If not, the domain will only be able to be used internally.\nDOMAIN: "})
 	if err != nil {
-		return err
+		return ud, err
 	}
 
-	_, err = user.New(envi, username, name, domain, password)
+	return ud, nil
+}
+
+func protosMinimalInit(in *inputs) error {
+	ud, err := getUserInputs(in)
+	if err != nil {
+		return err
+	}
+	err = in.check()
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func protosMinimalInit() error {
-	err := protosUserinit()
+	deviceNetwork, err := allocateNetwork(nil)
+	if err != nil {
+		return err
+	}
+	_, err = user.New(envi, ud.Username, ud.Name, ud.Domain, ud.Password, deviceNetwork)
 	if err != nil {
 		return err
 	}
@@ -118,89 +132,114 @@ func protosMinimalInit() error {
 	return nil
 }
 
-func protosFullInit() error {
+func protosFullInit(in *inputs) error {
 
 	//
-	// add user
+	// user details
 	//
 
-	err := protosUserinit()
+	ud, err := getUserInputs(in)
 	if err != nil {
 		return err
 	}
 
 	//
-	// add cloud provider
+	// cloud provider
 	//
 
 	// get a name to use internally for this specific cloud provider + credentials. This allows for adding multiple accounts of the same cloud
-	cloudNameQuestion := []*survey.Question{{
-		Name:     "name",
-		Prompt:   &survey.Input{Message: "In the following step you will add a cloud provider. Write a name used to identify this cloud provider account internally:"},
-		Validate: survey.Required,
-	}}
-	var cloudName string
-	err = survey.Ask(cloudNameQuestion, &cloudName)
+	cloudName, err := in.get("cloud.name", &survey.Input{Message: "In the following step you will add a cloud provider. Write a name used to identify this cloud provider account internally:"})
 	if err != nil {
 		return err
 	}
 
-	cloudProvider, err := addCloudProvider(cloudName)
+	cloudProvider, err := newCloudProvider(in, cloudName, "db")
 	if err != nil {
 		return err
 	}
 
 	//
-	// Protos instance creation steps
+	// Protos instance details
 	//
 
 	// select one of the supported locations by this particular cloud
 	var cloudLocation string
-	supportedLocations := cloudProvider.SupportedLocations()
-	cloudLocationQuestions := surveySelect(supportedLocations, fmt.Sprintf("Choose one of the following supported locations for '%s':", cloudProvider.GetInfo().Type))
-	err = survey.AskOne(cloudLocationQuestions, &cloudLocation)
+	if cloudProvider != nil {
+		supportedLocations := cloudProvider.SupportedLocations()
+		cloudLocation, err = in.choose("instance.location", supportedLocations, fmt.Sprintf("Choose one of the following supported locations for '%s':", cloudProvider.GetInfo().Type))
+	} else {
+		cloudLocation, err = in.get("instance.location", nil)
+	}
 	if err != nil {
 		return errors.Wrap(err, "Failed to initialize Protos")
 	}
 
 	// get a name to use internally for this instance. This name should be reflected accordingly in the cloud provider account
-	vmNameQuestion := []*survey.Question{{
-		Name:     "name",
-		Prompt:   &survey.Input{Message: "Write a name used to identify Protos instance that will be deployed next:"},
-		Validate: survey.Required,
-	}}
-	var vmName string
-	err = survey.Ask(vmNameQuestion, &vmName)
+	vmName, err := in.get("instance.name", &survey.Input{Message: "Write a name used to identify Protos instance that will be deployed next:"})
+	if err != nil {
+		return err
+	}
 
-	// get latest Protos release
-	releases, err := getProtosAvailableReleases()
+	// select one of the supported machine types. Provided machine types are validated when deploying
+	var machineType string
+	if _, found := in.lookup("instance.type"); found || !in.interactive {
+		machineType, err = in.get("instance.type", nil)
+	} else {
+		var supportedMachineTypes map[string]cloud.MachineSpec
+		supportedMachineTypes, err = cloudProvider.SupportedMachines(cloudLocation)
+		if err != nil {
+			return errors.Wrap(err, "Failed to initialize Protos")
+		}
+		supportedMachineTypeIDs := []string{}
+		for id := range supportedMachineTypes {
+			supportedMachineTypeIDs = append(supportedMachineTypeIDs, id)
+		}
+		machineTypesStr := createMachineTypesString(supportedMachineTypes)
+		machineType, err = in.choose("instance.type", supportedMachineTypeIDs, fmt.Sprintf("Choose one of the following supported machine types for '%s'.\n%s", cloudProvider.GetInfo().Type, machineTypesStr))
+	}
 	if err != nil {
 		return errors.Wrap(err, "Failed to initialize Protos")
 	}
-	latestRelease, err := releases.GetLatest()
+
+	err = in.check()
 	if err != nil {
-		return errors.Wrap(err, "Failed to initialize Protos")
+		return err
 	}
 
-	// select one of the supported locations by this particular cloud
-	var machineType string
-	supportedMachineTypes, err := cloudProvider.SupportedMachines(cloudLocation)
+	//
+	// add user and cloud provider
+	//
+
+	deviceNetwork, err := allocateNetwork(nil)
 	if err != nil {
-		return errors.Wrap(err, "Failed to initialize Protos")
+		return err
 	}
-	supportedMachineTypeIDs := []string{}
-	for id := range supportedMachineTypes {
-		supportedMachineTypeIDs = append(supportedMachineTypeIDs, id)
+	_, err = user.New(envi, ud.Username, ud.Name, ud.Domain, ud.Password, deviceNetwork)
+	if err != nil {
+		return err
 	}
-	machineTypesStr := createMachineTypesString(supportedMachineTypes)
-	machineTypeQuestion := surveySelect(supportedMachineTypeIDs, fmt.Sprintf("Choose one of the following supported machine types for '%s'.\n%s", cloudProvider.GetInfo().Type, machineTypesStr))
-	err = survey.AskOne(machineTypeQuestion, &machineType)
+
+	err = saveCloudProvider(cloudProvider, "db")
+	if err != nil {
+		return err
+	}
+
+	//
+	// Protos instance creation steps
+	//
+
+	// get latest Protos release
+	releases, err := getProtosAvailableReleases()
+	if err != nil {
+		return errors.Wrap(err, "Failed to initialize Protos")
+	}
+	latestRelease, err := releases.GetLatest()
 	if err != nil {
 		return errors.Wrap(err, "Failed to initialize Protos")
 	}
 
 	// deploy the vm
-	instanceInfo, err := deployInstance(vmName, cloudName, cloudLocation, latestRelease, machineType)
+	instanceInfo, err := deployInstance(vmName, cloudName, cloudLocation, latestRelease, machineType, cfg.GetInt("deploy.data-size"), false, "")
 	if err != nil {
 		return errors.Wrap(err, "Failed to initialize Protos")
 	}
@@ -209,13 +248,8 @@ func protosFullInit() error {
 	// Perform setup via SSH tunnel
 	//
 
-	key, err := ssh.NewKeyFromSeed(instanceInfo.KeySeed)
-	if err != nil {
-		return errors.Wrap(err, "Failed to initialize Protos")
-	}
-
 	// test SSH and create SSH tunnel used for initialisation
-	tempClient, err := ssh.NewConnection(instanceInfo.PublicIP, "root", key.SSHAuth(), 10)
+	tempClient, err := newInstanceConnection(instanceInfo, 10)
 	if err != nil {
 		return errors.Wrap(err, "Failed to connect to Protos instance via SSH")
 	}
@@ -223,7 +257,7 @@ func protosFullInit() error {
 	log.Info("Instance is ready and accepting SSH connections. Perform instance setup using the web based dashboard")
 
 	// create tunnel to reach the instance dashboard
-	tunnelInstance(instanceInfo.Name)
+	tunnelInstance(instanceInfo.Name, cfg.GetInt("tunnel.port"))
 	log.Infof("Protos instance '%s' - '%s' deployed successfully", vmName, instanceInfo.PublicIP)
 
 	return nil
@@ -273,17 +307,6 @@ func surveySelect(options []string, message string) *survey.Select {
 	}
 }
 
-func getCloudCredentialsQuestions(providerName string, fields []string) []*survey.Question {
-	qs := []*survey.Question{}
-	for _, field := range fields {
-		qs = append(qs, &survey.Question{
-			Name:     field,
-			Prompt:   &survey.Input{Message: providerName + " " + field + ":"},
-			Validate: survey.Required})
-	}
-	return qs
-}
-
 func createMachineTypesString(machineTypes map[string]cloud.MachineSpec) string {
 	var machineTypesStr bytes.Buffer
 	w := new(tabwriter.Writer)
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	survey "github.com/AlecAivazis/survey/v2"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// Values prompted for by 'init' and 'cloud add' can also be provided using flags, environment variables or a YAML (or
+// JSON) file passed using --from-file, in this order of precedence. Inputs have dot separated names, which map to nested
+// maps in the file and to PROTOS_<NAME> environment variables, e.g. cloud.type is read from PROTOS_CLOUD_TYPE:
+//
+//   user:
+//     username: jdoe
+//   cloud:
+//     type: scaleway
+//     credentials:
+//       ACCESS_KEY: xxx
+//
+// When stdin is not a terminal, missing inputs are collected and reported together instead of being prompted for.
+
+// inputFlags maps the inputs to the flags used to provide them
+var inputFlags = map[string]string{
+	"user.username":     "username",
+	"user.name":         "name",
+	"user.password":     "password",
+	"user.domain":       "domain",
+	"cloud.name":        "cloud-name",
+	"cloud.type":        "cloud-type",
+	"instance.name":     "instance-name",
+	"instance.location": "location",
+	"instance.type":     "type",
+}
+
+const credentialsInput = "cloud.credentials."
+
+var fromFileFlag = &cli.StringFlag{
+	Name:  "from-file",
+	Usage: "Read the values which are otherwise prompted for from a YAML or JSON `FILE`",
+}
+
+var credentialFlag = &cli.StringSliceFlag{
+	Name:  "credential",
+	Usage: "Cloud credentials field, as `FIELD=VALUE`. Can be repeated (env: PROTOS_CLOUD_CREDENTIALS_<FIELD>)",
+}
+
+// inputFlag returns the flag used to provide an input
+func inputFlag(name string, usage string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:  inputFlags[name],
+		Usage: fmt.Sprintf("%s (env: %s)", usage, inputEnvName(name)),
+	}
+}
+
+// stdinIsTerminal returns true if stdin is a terminal, in which case missing inputs can be prompted for
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func inputEnvName(name string) string {
+	return "PROTOS_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+type inputs struct {
+	flags       map[string]string
+	file        map[string]string
+	interactive bool
+	missing     []string
+}
+
+// newInputs collects the inputs provided using the flags of a command, and the file passed using --from-file
+func newInputs(c *cli.Context) (*inputs, error) {
+	in := &inputs{
+		flags:       map[string]string{},
+		file:        map[string]string{},
+		interactive: stdinIsTerminal(),
+	}
+	for name, flag := range inputFlags {
+		if value := c.String(flag); value != "" {
+			in.flags[name] = value
+		}
+	}
+	for _, credential := range c.StringSlice("credential") {
+		parts := strings.SplitN(credential, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("Invalid credential '%s'. Use the FIELD=VALUE format", credential)
+		}
+		in.flags[credentialsInput+parts[0]] = parts[1]
+	}
+
+	path := c.String("from-file")
+	if path == "" {
+		return in, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read inputs file '%s'", path)
+	}
+	raw := map[interface{}]interface{}{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse inputs file '%s'", path)
+	}
+	flattenInputs("", raw, in.file)
+	for name := range in.file {
+		if _, found := inputFlags[name]; !found && !strings.HasPrefix(name, credentialsInput) {
+			return nil, errors.Errorf("Unknown input '%s' in inputs file '%s'", name, path)
+		}
+	}
+	return in, nil
+}
+
+func flattenInputs(prefix string, in map[interface{}]interface{}, out map[string]string) {
+	for k, v := range in {
+		name := fmt.Sprintf("%v", k)
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if nested, ok := v.(map[interface{}]interface{}); ok {
+			flattenInputs(name, nested, out)
+		} else if v != nil {
+			out[name] = fmt.Sprintf("%v", v)
+		}
+	}
+}
+
+// lookup returns the value of an input, if it was provided
+func (in *inputs) lookup(name string) (string, bool) {
+	if value, found := in.flags[name]; found {
+		return value, true
+	}
+	if value := os.Getenv(inputEnvName(name)); value != "" {
+		return value, true
+	}
+	value, found := in.file[name]
+	return value, found && value != ""
+}
+
+// describe returns a description of an input, used when reporting missing inputs
+func (in *inputs) describe(name string) string {
+	if strings.HasPrefix(name, credentialsInput) {
+		field := strings.TrimPrefix(name, credentialsInput)
+		return fmt.Sprintf("%s (--credential %s=<value> or %s)", name, field, inputEnvName(name))
+	}
+	return fmt.Sprintf("%s (--%s or %s)", name, inputFlags[name], inputEnvName(name))
+}
+
+// get returns the value of an input. If the input was not provided, it is prompted for, or recorded as missing when
+// not running interactively
+func (in *inputs) get(name string, prompt survey.Prompt, opts ...survey.AskOpt) (string, error) {
+	if value, found := in.lookup(name); found {
+		return value, nil
+	}
+	if !in.interactive {
+		in.missing = append(in.missing, in.describe(name))
+		return "", nil
+	}
+	var value string
+	opts = append(opts, survey.WithValidator(survey.Required))
+	err := survey.AskOne(prompt, &value, opts...)
+	return value, err
+}
+
+// choose is like get, but the value has to be one of the provided options
+func (in *inputs) choose(name string, options []string, message string) (string, error) {
+	value, found := in.lookup(name)
+	if !found {
+		return in.get(name, surveySelect(options, message))
+	}
+	for _, option := range options {
+		if value == option {
+			return value, nil
+		}
+	}
+	return "", errors.Errorf("Invalid value '%s' for %s. Supported values: %s", value, name, strings.Join(options, ", "))
+}
+
+// check returns an error listing all the missing inputs
+func (in *inputs) check() error {
+	if len(in.missing) == 0 {
+		return nil
+	}
+	return errors.Errorf("Stdin is not a terminal and the following inputs were not provided:\n  %s", strings.Join(in.missing, "\n  "))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+// testInputs parses the provided command line using the input flags, writes file (if not empty) to a temporary
+// location passed using --from-file, and returns the collected inputs
+func testInputs(t *testing.T, args []string, file string) (*inputs, error) {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	// the slice flag keeps its values after parsing, so every test uses a new one
+	flags := []cli.Flag{fromFileFlag, &cli.StringSliceFlag{Name: credentialFlag.Name}}
+	for name := range inputFlags {
+		flags = append(flags, inputFlag(name, "test"))
+	}
+	for _, f := range flags {
+		if err := f.Apply(set); err != nil {
+			t.Fatalf("Failed to apply flag %s: %s", f.Names()[0], err)
+		}
+	}
+
+	if file != "" {
+		dir, err := ioutil.TempDir("", "protos-inputs")
+		if err != nil {
+			t.Fatalf("Failed to create temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "inputs.yaml")
+		if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatalf("Failed to write inputs file: %s", err)
+		}
+		args = append(args, "--from-file", path)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatalf("Failed to parse arguments %v: %s", args, err)
+	}
+
+	in, err := newInputs(cli.NewContext(cli.NewApp(), set, nil))
+	if in != nil {
+		in.interactive = false
+	}
+	return in, err
+}
+
+// setEnv sets an environment variable and returns a function which restores its previous value
+func setEnv(name string, value string) func() {
+	previous, found := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if found {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestInputsPrecedence(t *testing.T) {
+	file := "user:\n  username: from-file\n  name: from-file\n  domain: from-file\n"
+	defer setEnv("PROTOS_USER_USERNAME", "from-env")()
+	defer setEnv("PROTOS_USER_NAME", "from-env")()
+
+	in, err := testInputs(t, []string{"--username", "from-flag"}, file)
+	if err != nil {
+		t.Fatalf("Failed to collect inputs: %s", err)
+	}
+	tests := []struct {
+		name     string
+		expected string
+		found    bool
+	}{
+		{"user.username", "from-flag", true},
+		{"user.name", "from-env", true},
+		{"user.domain", "from-file", true},
+		{"user.password", "", false},
+	}
+	for _, tt := range tests {
+		value, found := in.lookup(tt.name)
+		if value != tt.expected || found != tt.found {
+			t.Errorf("lookup(%q) = %q, %t. Expected %q, %t", tt.name, value, found, tt.expected, tt.found)
+		}
+	}
+}
+
+func TestInputsFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		file     string
+		expected map[string]string
+		err      string
+	}{
+		{
+			name:     "nested YAML",
+			file:     "cloud:\n  type: scaleway\n  credentials:\n    ACCESS_KEY: key\n    SECRET_KEY: secret\n",
+			expected: map[string]string{"cloud.type": "scaleway", "cloud.credentials.ACCESS_KEY": "key", "cloud.credentials.SECRET_KEY": "secret"},
+		},
+		{
+			name:     "JSON",
+			file:     `{"instance": {"name": "one", "location": "fr-par-1"}}`,
+			expected: map[string]string{"instance.name": "one", "instance.location": "fr-par-1"},
+		},
+		{
+			name:     "credential flags",
+			args:     []string{"--credential", "ACCESS_KEY=key", "--credential", "SECRET_KEY=a=b"},
+			expected: map[string]string{"cloud.credentials.ACCESS_KEY": "key", "cloud.credentials.SECRET_KEY": "a=b"},
+		},
+		{
+			name: "unknown input",
+			file: "user:\n  username: jdoe\n  email: jdoe@example.com\n",
+			err:  "Unknown input 'user.email'",
+		},
+		{
+			name: "unknown section",
+			file: "instance:\n  name: one\nnetwork:\n  pool: 10.0.0.0/16\n",
+			err:  "Unknown input 'network.pool'",
+		},
+		{
+			name: "invalid credential flag",
+			args: []string{"--credential", "ACCESS_KEY"},
+			err:  "Invalid credential 'ACCESS_KEY'",
+		},
+		{
+			name: "invalid file",
+			file: "user: [",
+			err:  "Failed to parse inputs file",
+		},
+	}
+	for _, tt := range tests {
+		in, err := testInputs(t, tt.args, tt.file)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error containing %q, got: %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to collect inputs: %s", tt.name, err)
+			continue
+		}
+		for name, expected := range tt.expected {
+			if value, found := in.lookup(name); !found || value != expected {
+				t.Errorf("%s: lookup(%q) = %q, %t. Expected %q", tt.name, name, value, found, expected)
+			}
+		}
+	}
+}
+
+func TestInputsMissing(t *testing.T) {
+	in, err := testInputs(t, []string{"--username", "jdoe", "--cloud-type", "nope"}, "")
+	if err != nil {
+		t.Fatalf("Failed to collect inputs: %s", err)
+	}
+
+	// missing inputs are collected instead of prompted for, and reported together
+	for _, name := range []string{"user.username", "user.domain", "cloud.credentials.ACCESS_KEY"} {
+		if _, err := in.get(name, nil); err != nil {
+			t.Fatalf("Failed to get input %s: %s", name, err)
+		}
+	}
+	err = in.check()
+	if err == nil {
+		t.Fatal("Expected an error for the missing inputs")
+	}
+	for _, expected := range []string{"user.domain (--domain or PROTOS_USER_DOMAIN)", "cloud.credentials.ACCESS_KEY (--credential ACCESS_KEY=<value> or PROTOS_CLOUD_CREDENTIALS_ACCESS_KEY)"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected the error to list %q, got: %s", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "user.username") {
+		t.Errorf("The provided input user.username was reported as missing: %s", err)
+	}
+
+	// provided values have to be one of the options
+	if _, err := in.choose("cloud.type", []string{"scaleway"}, "Cloud type"); err == nil {
+		t.Error("Expected an error for an unsupported cloud type")
+	}
+}
@@ -1,26 +1,30 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
-	"text/tabwriter"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/output"
 	"github.com/protosio/cli/internal/release"
 	ssh "github.com/protosio/cli/internal/ssh"
 	"github.com/protosio/cli/internal/user"
 	pclient "github.com/protosio/protos/pkg/client"
-	"github.com/protosio/protos/pkg/types"
 	"github.com/urfave/cli/v2"
+	gssh "golang.org/x/crypto/ssh"
 )
 
 var machineType string
 var devImg string
+var sshAgentKey string
 
 var cmdInstance *cli.Command = &cli.Command{
 	Name:  "instance",
@@ -53,19 +57,17 @@ var cmdInstance *cli.Command = &cli.Command{
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:        "cloud",
-					Usage:       "Specify which `CLOUD` to deploy the instance on",
-					Required:    true,
+					Usage:       "Specify which `CLOUD` to deploy the instance on (config: deploy.cloud)",
 					Destination: &cloudName,
 				},
 				&cli.StringFlag{
 					Name:        "location",
-					Usage:       "Specify one of the supported `LOCATION`s to deploy the instance in (cloud specific)",
-					Required:    true,
+					Usage:       "Specify one of the supported `LOCATION`s to deploy the instance in, cloud specific (config: deploy.location)",
 					Destination: &cloudLocation,
 				},
 				&cli.StringFlag{
 					Name:        "version",
-					Usage:       "Specify Protos `VERSION` to deploy",
+					Usage:       "Specify Protos `VERSION` to deploy (config: deploy.version)",
 					Required:    false,
 					Destination: &protosVersion,
 				},
@@ -77,10 +79,22 @@ var cmdInstance *cli.Command = &cli.Command{
 				},
 				&cli.StringFlag{
 					Name:        "type",
-					Usage:       "Specify cloud machine type `TYPE` to deploy. Get it from 'cloud info' subcommand",
-					Required:    true,
+					Usage:       "Specify cloud machine type `TYPE` to deploy. Get it from 'cloud info' subcommand (config: deploy.type)",
 					Destination: &machineType,
 				},
+				&cli.IntFlag{
+					Name:  "data-size",
+					Usage: "Size of the data volume in `GB` (config: deploy.data-size)",
+				},
+				&cli.BoolFlag{
+					Name:  "ssh-agent",
+					Usage: "Use a key held by ssh-agent (SSH_AUTH_SOCK) for the instance, instead of generating a new key",
+				},
+				&cli.StringFlag{
+					Name:        "ssh-agent-key",
+					Usage:       "Select the ssh-agent `KEY` by fingerprint or comment. Implies --ssh-agent",
+					Destination: &sshAgentKey,
+				},
 			},
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
@@ -88,6 +102,23 @@ var cmdInstance *cli.Command = &cli.Command{
 					cli.ShowSubcommandHelp(c)
 					os.Exit(1)
 				}
+				useAgent := c.Bool("ssh-agent") || sshAgentKey != ""
+
+				// flags take precedence over the config
+				dataSize := c.Int("data-size")
+				if !c.IsSet("data-size") {
+					dataSize = cfg.GetInt("deploy.data-size")
+				}
+				for flag, setting := range map[string]string{"cloud": "deploy.cloud", "location": "deploy.location", "type": "deploy.type"} {
+					if c.String(flag) == "" && cfg.Get(setting) == "" {
+						return errors.Errorf("Required flag '--%s' not set. Provide it, or set a default using 'protos config set %s <value>'", flag, setting)
+					}
+				}
+				cloudName = flagOrConfig(cloudName, "deploy.cloud")
+				cloudLocation = flagOrConfig(cloudLocation, "deploy.location")
+				machineType = flagOrConfig(machineType, "deploy.type")
+				protosVersion = flagOrConfig(protosVersion, "deploy.version")
+
 				releases, err := getProtosAvailableReleases()
 				if err != nil {
 					return err
@@ -107,7 +138,7 @@ var cmdInstance *cli.Command = &cli.Command{
 					}
 				}
 
-				_, err = deployInstance(name, cloudName, cloudLocation, rls, machineType)
+				_, err = deployInstance(name, cloudName, cloudLocation, rls, machineType, dataSize, useAgent, sshAgentKey)
 				return err
 			},
 		},
@@ -160,13 +191,23 @@ var cmdInstance *cli.Command = &cli.Command{
 			Name:      "tunnel",
 			ArgsUsage: "<name>",
 			Usage:     "Creates SSH encrypted tunnel to instance dashboard",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "port",
+					Usage: "Local `PORT` for the tunnel. A random port is used if 0 (config: tunnel.port)",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
 					os.Exit(1)
 				}
-				return tunnelInstance(name)
+				port := c.Int("port")
+				if !c.IsSet("port") {
+					port = cfg.GetInt("tunnel.port")
+				}
+				return tunnelInstance(name, port)
 			},
 		},
 		{
@@ -182,6 +223,192 @@ var cmdInstance *cli.Command = &cli.Command{
 				return keyInstance(name)
 			},
 		},
+		{
+			Name:      "set-primary",
+			ArgsUsage: "<name>",
+			Usage:     "Makes an instance the primary one, which serves DNS for your domain over the VPN. The other instances are used as fallback",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return setPrimaryInstance(name)
+			},
+		},
+		{
+			Name:      "rotate-key",
+			ArgsUsage: "<name>",
+			Usage:     "Replaces the SSH key of an instance with a newly generated one, also on the jump hosts which authenticate using the instance key",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return rotateKeyInstance(name)
+			},
+		},
+		{
+			Name:  "hostkey",
+			Usage: "Manage the SSH host keys pinned for instances",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "reset",
+					ArgsUsage: "<name>",
+					Usage:     "Forgets the pinned SSH host keys of an instance and its jump hosts. The next connection trusts the keys presented",
+					Action: func(c *cli.Context) error {
+						name := c.Args().Get(0)
+						if name == "" {
+							cli.ShowSubcommandHelp(c)
+							os.Exit(1)
+						}
+						return resetHostKeyInstance(name)
+					},
+				},
+			},
+		},
+		{
+			Name:      "set-ssh",
+			ArgsUsage: "<name>",
+			Usage:     "Configures how to connect to an instance over SSH. Only the provided settings are changed",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "user",
+					Usage: "SSH `USER` used to log in",
+				},
+				&cli.IntFlag{
+					Name:  "port",
+					Usage: "SSH `PORT` of the instance",
+				},
+				&cli.IntFlag{
+					Name:  "timeout",
+					Usage: "Connection timeout in `SECONDS`",
+				},
+				&cli.StringSliceFlag{
+					Name:  "jump",
+					Usage: "Connect via the jump host `[user@]host[:port]`. Can be repeated to create a chain. Use \"none\" to remove the jump hosts",
+				},
+				&cli.StringFlag{
+					Name:  "jump-identity",
+					Usage: "Private key `FILE` used for the jump hosts. The instance key is used if not provided",
+				},
+				&cli.StringFlag{
+					Name:  "proxy-command",
+					Usage: "`COMMAND` used as transport for the SSH connection, like OpenSSH's ProxyCommand. %h, %p and %r are replaced with the host, port and user",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return setSSHInstance(c, name)
+			},
+		},
+		{
+			Name:      "forward",
+			ArgsUsage: "<name>",
+			Usage:     "Forward ports between the local machine and an instance over SSH",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "L",
+					Usage: "Forward a local port to a `[local:]port:host:port` reachable from the instance. Can be repeated",
+				},
+				&cli.StringSliceFlag{
+					Name:  "R",
+					Usage: "Forward a port on the instance to a `[remote:]port:host:port` reachable from the local machine. Can be repeated",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" || (len(c.StringSlice("L")) == 0 && len(c.StringSlice("R")) == 0) {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return forwardInstance(name, c.StringSlice("L"), c.StringSlice("R"))
+			},
+		},
+		{
+			Name:      "proxy",
+			ArgsUsage: "<name>",
+			Usage:     "Run a local SOCKS5 proxy which routes all connections through an instance",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "port",
+					Value: 1080,
+					Usage: "Local `PORT` to listen on",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return proxyInstance(name, c.Int("port"))
+			},
+		},
+		{
+			Name:      "logs",
+			ArgsUsage: "<name>",
+			Usage:     "Stream the Protos daemon logs from an instance",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "follow",
+					Aliases: []string{"f"},
+					Usage:   "Keep streaming new log entries until interrupted",
+				},
+				&cli.StringFlag{
+					Name:  "since",
+					Usage: "Only show entries newer than `TIME` (e.g. '1 hour ago', '2020-04-01 10:00'). Requires journalctl on the instance",
+				},
+				&cli.IntFlag{
+					Name:    "lines",
+					Aliases: []string{"n"},
+					Value:   100,
+					Usage:   "Number of past log `LINES` to show",
+				},
+				&cli.BoolFlag{
+					Name:  "system",
+					Usage: "Show the system logs instead of only the Protos daemon logs",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return logsInstance(name, c.Bool("follow"), c.String("since"), c.Int("lines"), c.Bool("system"))
+			},
+		},
+		{
+			Name:      "cp",
+			ArgsUsage: "<src> <dst>",
+			Usage:     "Copy files between the local machine and an instance. Instance paths are written as <name>:<path>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "recursive",
+					Aliases: []string{"r"},
+					Usage:   "Copy directories recursively",
+				},
+				&cli.BoolFlag{
+					Name:  "no-verify",
+					Usage: "Skip the checksum verification of the copied files",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				src := c.Args().Get(0)
+				dst := c.Args().Get(1)
+				if src == "" || dst == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return copyInstance(src, dst, c.Bool("recursive"), !c.Bool("no-verify"))
+			},
+		},
 	},
 }
 
@@ -195,18 +422,31 @@ func listInstances() error {
 		return err
 	}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 0, 2, ' ', 0)
-
-	defer w.Flush()
+	primary, err := currentPrimaryInstance(instances)
+	if err != nil {
+		return err
+	}
 
-	fmt.Fprintf(w, " %s\t%s\t%s\t%s\t%s\t%s\t", "Name", "IP", "Cloud", "VM ID", "Location", "Status")
-	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t", "----", "--", "-----", "-----", "--------", "------")
+	views := []instanceView{}
+	rows := [][]string{}
 	for _, instance := range instances {
-		fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t", instance.Name, instance.PublicIP, instance.CloudName, instance.VMID, instance.Location, "n/a")
+		view, err := newInstanceView(instance)
+		if err != nil {
+			return err
+		}
+		view.Primary = view.Name == primary
+		views = append(views, view)
+		marker := ""
+		if view.Primary {
+			marker = "*"
+		}
+		rows = append(rows, []string{marker, view.Name, view.PublicIP, view.CloudName, view.VMID, view.Location, "n/a", view.InternalIP, view.Network, view.ProtosVersion})
 	}
-	fmt.Fprint(w, "\n")
-	return nil
+	columns := []output.Column{
+		{Header: " "}, {Header: "Name"}, {Header: "IP"}, {Header: "Cloud"}, {Header: "VM ID"}, {Header: "Location"}, {Header: "Status"},
+		{Header: "Internal IP", Wide: true}, {Header: "Network", Wide: true}, {Header: "Version", Wide: true},
+	}
+	return out.List(views, columns, rows)
 }
 
 func infoInstance(instanceName string) error {
@@ -214,29 +454,102 @@ func infoInstance(instanceName string) error {
 	if err != nil {
 		return fmt.Errorf("Could not retrieve instance '%s': %w", instanceName, err)
 	}
+	view, err := newInstanceView(instance)
+	if err != nil {
+		return err
+	}
+	instances, err := envi.DB.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	primary, err := currentPrimaryInstance(instances)
+	if err != nil {
+		return err
+	}
+	view.Primary = view.Name == primary
+
+	fields := []output.Field{
+		{Name: "Name", Value: view.Name},
+		{Name: "Primary", Value: strconv.FormatBool(view.Primary)},
+		{Name: "VM ID", Value: view.VMID},
+		{Name: "Public Key (wireguard)", Value: view.WireguardPublicKey},
+		{Name: "Public IP", Value: view.PublicIP},
+		{Name: "Internal IP", Value: view.InternalIP},
+	}
+	if view.SSH.AgentKey != "" {
+		fields = append(fields, output.Field{Name: "SSH key", Value: "ssh-agent " + view.SSH.AgentKey})
+	}
+	fields = append(fields, output.Field{Name: "SSH address", Value: view.SSH.Address})
+	if instance.SSH.User != "" {
+		fields = append(fields, output.Field{Name: "SSH user", Value: view.SSH.User})
+	}
+	for _, jumpHost := range view.SSH.JumpHosts {
+		fields = append(fields, output.Field{Name: "SSH jump host", Value: jumpHost})
+	}
+	if view.SSH.ProxyCommand != "" {
+		fields = append(fields, output.Field{Name: "SSH proxy command", Value: view.SSH.ProxyCommand})
+	}
+	if view.SSH.HostKey != "" {
+		fields = append(fields, output.Field{Name: "SSH host key", Value: view.SSH.HostKey})
+	} else {
+		fields = append(fields, output.Field{Name: "SSH host key", Value: "not pinned"})
+	}
+	fields = append(fields,
+		output.Field{Name: "Network", Value: view.Network},
+		output.Field{Name: "Cloud type", Value: view.CloudType},
+		output.Field{Name: "Cloud name", Value: view.CloudName},
+		output.Field{Name: "Location", Value: view.Location},
+		output.Field{Name: "Protosd version", Value: view.ProtosVersion},
+	)
+	for _, volume := range view.Volumes {
+		fields = append(fields, output.Field{Name: "Volume", Value: fmt.Sprintf("%s (%s), %d MB", volume.Name, volume.ID, volume.Size), Wide: true})
+	}
+	return out.Info(view, fields)
+}
+
+// currentPrimaryInstance returns the name of the instance which serves DNS for the user domain, or an empty string if
+// there are no initialized instances
+func currentPrimaryInstance(instances []cloud.InstanceInfo) (string, error) {
+	name, err := envi.DB.GetPrimaryInstance()
+	if err != nil {
+		return "", err
+	}
+	initialized := initializedInstances(instances)
+	if len(initialized) == 0 {
+		return "", nil
+	}
+	primary, err := primaryInstance(initialized, name)
+	if err != nil {
+		return "", err
+	}
+	return primary.Name, nil
+}
 
-	encodedPublicKey := base64.StdEncoding.EncodeToString(instance.PublicKey)
-	fmt.Printf("Name: %s\n", instance.Name)
-	fmt.Printf("VM ID: %s\n", instance.VMID)
-	fmt.Printf("Public Key (wireguard): %s\n", encodedPublicKey)
-	fmt.Printf("Public IP: %s\n", instance.PublicIP)
-	fmt.Printf("Internal IP: %s\n", instance.InternalIP)
-	fmt.Printf("Network: %s\n", instance.Network)
-	fmt.Printf("Cloud type: %s\n", instance.CloudType)
-	fmt.Printf("Cloud name: %s\n", instance.CloudName)
-	fmt.Printf("Location: %s\n", instance.Location)
-	fmt.Printf("Protosd version: %s\n", instance.ProtosVersion)
+func setPrimaryInstance(name string) error {
+	instance, err := envi.DB.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	if len(initializedInstances([]cloud.InstanceInfo{instance})) == 0 {
+		return errors.Errorf("Instance '%s' is not initialized, so it can't serve DNS", name)
+	}
+	err = envi.DB.SetPrimaryInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to make instance '%s' the primary instance", name)
+	}
+	log.Infof("Instance '%s' is now the primary instance", name)
+	notifyVPNDaemon()
 	return nil
 }
 
-func deployInstance(instanceName string, cloudName string, cloudLocation string, release release.Release, machineType string) (cloud.InstanceInfo, error) {
+func deployInstance(instanceName string, cloudName string, cloudLocation string, release release.Release, machineType string, dataSize int, useAgent bool, agentKeySelector string) (cloud.InstanceInfo, error) {
 	usr, err := user.Get(envi)
 	if err != nil {
 		return cloud.InstanceInfo{}, err
 	}
 
 	// init cloud
-	provider, err := envi.DB.GetCloud(cloudName)
+	provider, err := getCloud(cloudName)
 	if err != nil {
 		return cloud.InstanceInfo{}, errors.Wrapf(err, "Could not retrieve cloud '%s'", cloudName)
 	}
@@ -246,6 +559,12 @@ func deployInstance(instanceName string, cloudName string, cloudLocation string,
 		return cloud.InstanceInfo{}, errors.Wrapf(err, "Failed to connect to cloud provider '%s'(%s) API", cloudName, provider.Type.String())
 	}
 
+	// allocate network. It's reserved once the instance is saved
+	network, err := allocateNetwork(usr.AllDevices())
+	if err != nil {
+		return cloud.InstanceInfo{}, errors.Wrapf(err, "Failed to allocate network for instance '%s'", instanceName)
+	}
+
 	// validate machine type
 	supportedMachineTypes, err := client.SupportedMachines(cloudLocation)
 	if err != nil {
@@ -282,16 +601,31 @@ func deployInstance(instanceName string, cloudName string, cloudLocation string,
 		}
 	}
 
-	// create SSH key used for instance
-	log.Info("Generating SSH key for the new VM instance")
-	instanceSSHKey, err := ssh.GenerateKey()
-	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to deploy Protos instance")
+	// create SSH key used for instance, or use the public half of an ssh-agent key
+	var keySeed []byte
+	var agentKey []byte
+	var authorizedKey string
+	if useAgent {
+		pubKey, err := ssh.FindAgentKey(agentKeySelector)
+		if err != nil {
+			return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to deploy Protos instance")
+		}
+		log.Infof("Using ssh-agent key %s for the new VM instance", gssh.FingerprintSHA256(pubKey))
+		agentKey = pubKey.Marshal()
+		authorizedKey = string(gssh.MarshalAuthorizedKey(pubKey))
+	} else {
+		log.Info("Generating SSH key for the new VM instance")
+		instanceSSHKey, err := ssh.GenerateKey()
+		if err != nil {
+			return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to deploy Protos instance")
+		}
+		keySeed = instanceSSHKey.Seed()
+		authorizedKey = instanceSSHKey.AuthorizedKey()
 	}
 
 	// deploy a protos instance
 	log.Infof("Deploying instance '%s' of type '%s', using Protos version '%s' (image id '%s')", instanceName, machineType, release.Version, imageID)
-	vmID, err := client.NewInstance(instanceName, imageID, instanceSSHKey.AuthorizedKey(), machineType, cloudLocation)
+	vmID, err := client.NewInstance(instanceName, imageID, authorizedKey, machineType, cloudLocation)
 	if err != nil {
 		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to deploy Protos instance")
 	}
@@ -303,18 +637,9 @@ func deployInstance(instanceName string, cloudName string, cloudLocation string,
 		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to get Protos instance info")
 	}
 
-	// allocate network
-	instances, err := envi.DB.GetAllInstances()
-	if err != nil {
-		return cloud.InstanceInfo{}, fmt.Errorf("Failed to allocate network for instance '%s': %w", instanceInfo.Name, err)
-	}
-	network, err := user.AllocateNetwork(instances)
-	if err != nil {
-		return cloud.InstanceInfo{}, fmt.Errorf("Failed to allocate network for instance '%s': %w", instanceInfo.Name, err)
-	}
-
 	// save instance information
-	instanceInfo.KeySeed = instanceSSHKey.Seed()
+	instanceInfo.KeySeed = keySeed
+	instanceInfo.AgentKey = agentKey
 	instanceInfo.ProtosVersion = release.Version
 	instanceInfo.Network = network.String()
 	err = envi.DB.SaveInstance(instanceInfo)
@@ -324,7 +649,7 @@ func deployInstance(instanceName string, cloudName string, cloudLocation string,
 
 	// create protos data volume
 	log.Infof("Creating data volume for Protos instance '%s'", instanceName)
-	volumeID, err := client.NewVolume(instanceName, 30000, cloudLocation)
+	volumeID, err := client.NewVolume(instanceName, dataSize*1000, cloudLocation)
 	if err != nil {
 		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to create data volume")
 	}
@@ -342,11 +667,13 @@ func deployInstance(instanceName string, cloudName string, cloudLocation string,
 		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to start Protos instance")
 	}
 
-	// get instance info again
-	instanceInfo, err = client.GetInstanceInfo(vmID, cloudLocation)
+	// get instance info again, now that the IP and volumes are available
+	refreshedInfo, err := client.GetInstanceInfo(vmID, cloudLocation)
 	if err != nil {
 		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to get Protos instance info")
 	}
+	instanceInfo.PublicIP = refreshedInfo.PublicIP
+	instanceInfo.Volumes = refreshedInfo.Volumes
 	// second save of the instance information
 	err = envi.DB.SaveInstance(instanceInfo)
 	if err != nil {
@@ -363,15 +690,23 @@ func deployInstance(instanceName string, cloudName string, cloudLocation string,
 	time.Sleep(5 * time.Second)
 
 	log.Infof("Creating SSH tunnel to instance '%s'", instanceName)
-	tunnel := ssh.NewTunnel(instanceInfo.PublicIP+":22", "root", instanceSSHKey.SSHAuth(), "localhost:8080", log)
+	sshConfig, err := instanceSSHConfig(&instanceInfo)
+	if err != nil {
+		return cloud.InstanceInfo{}, err
+	}
+	if hostKeys := captureHostKeys(client, instanceInfo, release.CloudImages[string(provider.Type)]); len(hostKeys) > 0 {
+		sshConfig.HostKeyCallback = ssh.CapturedHostKey(hostKeys, pinInstanceHostKey(&instanceInfo))
+	}
+	tunnel := ssh.NewTunnel(sshConfig, "localhost:8080", log)
 	localPort, err := tunnel.Start()
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrap(err, "Error while creating the SSH tunnel")
+		return cloud.InstanceInfo{}, errors.Wrap(hostKeyError(instanceName, err), "Error while creating the SSH tunnel")
 	}
 
 	// wait for the API to be up
 	err = cloud.WaitForHTTP(fmt.Sprintf("http://127.0.0.1:%d/ui/", localPort), 20)
 	if err != nil {
+		dumpInstanceLogs(instanceInfo)
 		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to deploy instance")
 	}
 	log.Infof("Tunnel to '%s' ready", instanceName)
@@ -379,17 +714,11 @@ func deployInstance(instanceName string, cloudName string, cloudLocation string,
 	// do the initialization
 	log.Infof("Initializing instance '%s'", instanceName)
 	protos := pclient.NewInitClient(fmt.Sprintf("127.0.0.1:%d", localPort), usr.Username, usr.Password)
-	userDeviceKey, err := ssh.NewKeyFromSeed(usr.Device.KeySeed)
+	usrDevs, err := userDevices(usr)
 	if err != nil {
-		panic(err)
-	}
-	keyEncoded := base64.StdEncoding.EncodeToString(userDeviceKey.Public())
-	usrDev := types.UserDevice{
-		Name:      usr.Device.Name,
-		PublicKey: keyEncoded,
-		Network:   usr.Device.Network,
+		return cloud.InstanceInfo{}, err
 	}
-	ip, pubKey, err := protos.InitInstance(usr.Name, instanceInfo.Network, usr.Domain, []types.UserDevice{usrDev})
+	ip, pubKey, err := protos.InitInstance(usr.Name, instanceInfo.Network, usr.Domain, usrDevs)
 	if err != nil {
 		return cloud.InstanceInfo{}, errors.Wrap(err, "Error while doing the instance initialization")
 	}
@@ -408,6 +737,8 @@ func deployInstance(instanceName string, cloudName string, cloudLocation string,
 		return cloud.InstanceInfo{}, errors.Wrap(err, "Error while terminating the SSH tunnel")
 	}
 	log.Infof("Instance '%s' is ready", instanceName)
+	updateSSHConfig()
+	notifyVPNDaemon()
 
 	return instanceInfo, nil
 }
@@ -420,7 +751,7 @@ func deleteInstance(name string, localOnly bool) error {
 
 	// if local only, ignore any cloud resources
 	if !localOnly {
-		cloudInfo, err := envi.DB.GetCloud(instance.CloudName)
+		cloudInfo, err := getCloud(instance.CloudName)
 		if err != nil {
 			return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
 		}
@@ -452,7 +783,19 @@ func deleteInstance(name string, localOnly bool) error {
 			}
 		}
 	}
-	return envi.DB.DeleteInstance(name)
+	err = envi.DB.DeleteInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete instance '%s'", name)
+	}
+	if primary, err := envi.DB.GetPrimaryInstance(); err == nil && primary == name {
+		err = envi.DB.SetPrimaryInstance("")
+		if err != nil {
+			log.Warnf("Failed to clear the primary instance: %s", err.Error())
+		}
+	}
+	updateSSHConfig()
+	notifyVPNDaemon()
+	return nil
 }
 
 func startInstance(name string) error {
@@ -460,7 +803,7 @@ func startInstance(name string) error {
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
 	}
-	cloudInfo, err := envi.DB.GetCloud(instance.CloudName)
+	cloudInfo, err := getCloud(instance.CloudName)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
 	}
@@ -483,7 +826,7 @@ func stopInstance(name string) error {
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
 	}
-	cloudInfo, err := envi.DB.GetCloud(instance.CloudName)
+	cloudInfo, err := getCloud(instance.CloudName)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
 	}
@@ -501,25 +844,25 @@ func stopInstance(name string) error {
 	return nil
 }
 
-func tunnelInstance(name string) error {
+func tunnelInstance(name string, port int) error {
 	instanceInfo, err := envi.DB.GetInstance(name)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
 	}
-	if len(instanceInfo.KeySeed) == 0 {
-		return errors.Errorf("Instance '%s' is missing its SSH key", name)
-	}
-	key, err := ssh.NewKeyFromSeed(instanceInfo.KeySeed)
+	sshConfig, err := instanceSSHConfig(&instanceInfo)
 	if err != nil {
-		return errors.Wrapf(err, "Instance '%s' has an invalid SSH key", name)
+		return err
 	}
 
-	log.Infof("Creating SSH tunnel to instance '%s', using ip '%s'", instanceInfo.Name, instanceInfo.PublicIP)
-	tunnel := ssh.NewTunnel(instanceInfo.PublicIP+":22", "root", key.SSHAuth(), "localhost:8080", log)
+	log.Infof("Creating SSH tunnel to instance '%s', using address '%s'", instanceInfo.Name, sshConfig.Address())
+	forwards := []ssh.Forward{{Type: ssh.LocalForward, ListenAddr: fmt.Sprintf("localhost:%d", port), TargetAddr: "localhost:8080"}}
+	tunnel := ssh.NewForwardTunnel(sshConfig, forwards, log)
 	localPort, err := tunnel.Start()
 	if err != nil {
-		return errors.Wrap(err, "Error while creating the SSH tunnel")
+		return errors.Wrap(hostKeyError(name, err), "Error while creating the SSH tunnel")
 	}
+	// the host key is pinned by now, so the DB is not needed anymore
+	releaseDB()
 
 	quit := make(chan interface{}, 1)
 	sigs := make(chan os.Signal, 1)
@@ -529,7 +872,10 @@ func tunnelInstance(name string) error {
 	log.Infof("SSH tunnel ready. Use 'http://localhost:%d/' to access the instance dashboard. Once finished, press CTRL+C to terminate the SSH tunnel", localPort)
 
 	// waiting for a SIGTERM or SIGINT
-	<-quit
+	err = waitForTunnel(tunnel, quit)
+	if err != nil {
+		return errors.Wrap(hostKeyError(name, err), "SSH tunnel terminated")
+	}
 
 	log.Info("CTRL+C received. Terminating the SSH tunnel")
 	err = tunnel.Close()
@@ -540,11 +886,143 @@ func tunnelInstance(name string) error {
 	return nil
 }
 
+// waitForTunnel reports the health of the tunnel until the quit channel receives a message. If the tunnel gives up
+// reconnecting, the error which caused it is returned
+func waitForTunnel(tunnel *ssh.Tunnel, quit chan interface{}) error {
+	previous := ssh.TunnelConnecting
+	for {
+		select {
+		case <-quit:
+			return nil
+		case state := <-tunnel.StateChanges():
+			switch state {
+			case ssh.TunnelClosed:
+				return tunnel.Err()
+			case ssh.TunnelReconnecting:
+				log.Warn("SSH tunnel is down. New connections will fail until it reconnects")
+			case ssh.TunnelConnected:
+				if previous == ssh.TunnelReconnecting {
+					log.Info("SSH tunnel is up again")
+				}
+			}
+			previous = state
+		}
+	}
+}
+
+func forwardInstance(name string, localForwards []string, remoteForwards []string) error {
+	instanceInfo, err := envi.DB.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	sshConfig, err := instanceSSHConfig(&instanceInfo)
+	if err != nil {
+		return err
+	}
+
+	forwards := []ssh.Forward{}
+	for _, spec := range localForwards {
+		fwd, err := ssh.ParseForward(spec, ssh.LocalForward)
+		if err != nil {
+			return err
+		}
+		forwards = append(forwards, fwd)
+	}
+	for _, spec := range remoteForwards {
+		fwd, err := ssh.ParseForward(spec, ssh.RemoteForward)
+		if err != nil {
+			return err
+		}
+		forwards = append(forwards, fwd)
+	}
+
+	log.Infof("Creating SSH tunnel to instance '%s', using address '%s'", instanceInfo.Name, sshConfig.Address())
+	tunnel := ssh.NewForwardTunnel(sshConfig, forwards, log)
+	_, err = tunnel.Start()
+	if err != nil {
+		return errors.Wrap(hostKeyError(name, err), "Error while creating the SSH tunnel")
+	}
+	// the host key is pinned by now, so the DB is not needed anymore
+	releaseDB()
+	for _, fwd := range tunnel.Forwards() {
+		log.Infof("Forwarding %s", fwd.String())
+	}
+
+	quit := make(chan interface{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go catchSignals(sigs, quit)
+
+	log.Info("SSH tunnel ready. Once finished, press CTRL+C to terminate the SSH tunnel")
+
+	// waiting for a SIGTERM or SIGINT
+	err = waitForTunnel(tunnel, quit)
+	if err != nil {
+		return errors.Wrap(hostKeyError(name, err), "SSH tunnel terminated")
+	}
+
+	log.Info("CTRL+C received. Terminating the SSH tunnel")
+	err = tunnel.Close()
+	if err != nil {
+		return errors.Wrap(err, "Error while terminating the SSH tunnel")
+	}
+	log.Info("SSH tunnel terminated successfully")
+	return nil
+}
+
+func proxyInstance(name string, port int) error {
+	usr, err := user.Get(envi)
+	if err != nil {
+		return err
+	}
+	instanceInfo, err := envi.DB.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	sshClient, err := newInstanceConnection(instanceInfo, 3)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	// names under the user domain are resolved by the DNS server running on the instance
+	dnsServer := ""
+	if instanceInfo.InternalIP != "" {
+		dnsServer = net.JoinHostPort(instanceInfo.InternalIP, "53")
+	}
+	proxy := ssh.NewSOCKSProxy(sshClient, usr.Domain, dnsServer, log)
+	addr, err := proxy.Start(fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return errors.Wrap(err, "Error while starting the SOCKS proxy")
+	}
+	releaseDB()
+
+	quit := make(chan interface{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go catchSignals(sigs, quit)
+
+	log.Infof("SOCKS5 proxy ready. Configure your browser to use 'socks5h://%s' (SOCKS5 with remote DNS). Once finished, press CTRL+C to terminate the proxy", addr)
+
+	// waiting for a SIGTERM or SIGINT
+	<-quit
+
+	log.Info("CTRL+C received. Terminating the SOCKS proxy")
+	err = proxy.Close()
+	if err != nil {
+		return errors.Wrap(err, "Error while terminating the SOCKS proxy")
+	}
+	return nil
+}
+
 func keyInstance(name string) error {
 	instanceInfo, err := envi.DB.GetInstance(name)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
 	}
+	if len(instanceInfo.AgentKey) > 0 {
+		return errors.Errorf("Instance '%s' uses an ssh-agent key, which can't be exported", name)
+	}
 	if len(instanceInfo.KeySeed) == 0 {
 		return errors.Errorf("Instance '%s' is missing its SSH key", name)
 	}
@@ -555,3 +1033,526 @@ func keyInstance(name string) error {
 	fmt.Print(key.EncodePrivateKeytoPEM())
 	return nil
 }
+
+// keyRotationHost is a host on which the SSH key of an instance is rotated: the instance itself, and the jump hosts
+// which authenticate using the instance key
+type keyRotationHost struct {
+	name   string
+	config ssh.ConnectionConfig
+	client *gssh.Client
+}
+
+// keyRotationHosts returns the hosts on which the key of an instance is authorized, in the order they are connected to,
+// using the provided connection config of the instance
+func keyRotationHosts(instanceInfo cloud.InstanceInfo, sshConfig ssh.ConnectionConfig) []*keyRotationHost {
+	hosts := []*keyRotationHost{}
+	for i, jumpHost := range instanceInfo.SSH.JumpHosts {
+		if jumpHost.IdentityFile != "" {
+			continue
+		}
+		jumpConfig := sshConfig.JumpHosts[i]
+		jumpConfig.JumpHosts = sshConfig.JumpHosts[:i]
+		jumpConfig.ProxyCommand = sshConfig.ProxyCommand
+		hosts = append(hosts, &keyRotationHost{name: fmt.Sprintf("jump host '%s'", jumpHost.Host), config: jumpConfig})
+	}
+	return append(hosts, &keyRotationHost{name: fmt.Sprintf("instance '%s'", instanceInfo.Name), config: sshConfig})
+}
+
+func authorizeKeyCommand(authorizedKey string) string {
+	return fmt.Sprintf("mkdir -p ~/.ssh && chmod 700 ~/.ssh && echo %s >> ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys", ssh.ShellQuote(authorizedKey))
+}
+
+func revokeKeyCommand(key ssh.Key) string {
+	keyFields := strings.Fields(key.AuthorizedKey())
+	return fmt.Sprintf("grep -v -F %s ~/.ssh/authorized_keys > ~/.ssh/authorized_keys.new && mv ~/.ssh/authorized_keys.new ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys", ssh.ShellQuote(keyFields[1]))
+}
+
+// revokeKey removes a key from the hosts, logging the failures. It returns the names of the hosts where it failed
+func revokeKey(hosts []*keyRotationHost, key ssh.Key) []string {
+	failed := []string{}
+	for _, host := range hosts {
+		out, err := ssh.ExecuteCommand(revokeKeyCommand(key), host.client)
+		if err != nil {
+			log.Errorf("Failed to remove SSH key from %s: %s %s", host.name, err.Error(), out)
+			failed = append(failed, host.name)
+		}
+	}
+	return failed
+}
+
+func rotateKeyInstance(name string) error {
+	instanceInfo, err := envi.DB.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	if len(instanceInfo.AgentKey) > 0 {
+		return errors.Errorf("Instance '%s' uses an ssh-agent key. Its rotation should be done in the agent", name)
+	}
+	oldKey, err := ssh.NewKeyFromSeed(instanceInfo.KeySeed)
+	if err != nil {
+		return errors.Wrapf(err, "Instance '%s' has an invalid SSH key", name)
+	}
+	sshConfig, err := instanceSSHConfig(&instanceInfo)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Generating new SSH key for instance '%s'", name)
+	newKey, err := ssh.GenerateKey()
+	if err != nil {
+		return errors.Wrap(err, "Failed to rotate SSH key")
+	}
+	newAuthorizedKey := strings.TrimSuffix(newKey.AuthorizedKey(), "\n") + " root@protos.io"
+
+	// install the new key next to the old one, on the jump hosts which use the instance key and on the instance. If
+	// anything fails before the new key is saved, it is removed again, so the old key stays the only one in use
+	hosts := keyRotationHosts(instanceInfo, sshConfig)
+	installed := []*keyRotationHost{}
+	rollback := func() {
+		if failed := revokeKey(installed, newKey); len(failed) > 0 {
+			log.Warnf("The new SSH key is still authorized on %s", strings.Join(failed, ", "))
+		}
+	}
+	defer func() {
+		for _, host := range hosts {
+			if host.client != nil {
+				host.client.Close()
+			}
+		}
+	}()
+	for _, host := range hosts {
+		host.client, err = ssh.NewConnection(host.config, 3)
+		if err != nil {
+			rollback()
+			return errors.Wrapf(hostKeyError(name, err), "Failed to connect to %s", host.name)
+		}
+		out, err := ssh.ExecuteCommand(authorizeKeyCommand(newAuthorizedKey), host.client)
+		if err != nil {
+			log.Errorf("Failed to install new SSH key: %s", out)
+			rollback()
+			return errors.Wrapf(err, "Failed to install new SSH key on %s", host.name)
+		}
+		installed = append(installed, host)
+		log.Infof("New SSH key installed on %s", host.name)
+	}
+
+	// verify that the new key works for the whole chain before touching the old one
+	newConfig := sshConfig
+	newConfig.Auth = newKey.SSHAuth()
+	newConfig.JumpHosts = append([]ssh.ConnectionConfig{}, sshConfig.JumpHosts...)
+	for i, jumpHost := range instanceInfo.SSH.JumpHosts {
+		if jumpHost.IdentityFile == "" {
+			newConfig.JumpHosts[i].Auth = newConfig.Auth
+		}
+	}
+	newClient, err := ssh.Dial(newConfig)
+	if err != nil {
+		rollback()
+		return errors.Wrapf(err, "Failed to log in to instance '%s' with the new SSH key. The old key is still in use", name)
+	}
+	newClient.Close()
+	log.Info("Login with the new SSH key verified")
+
+	// from this point on the new key is the only one guaranteed to work, so it is saved right away
+	instanceInfo.KeySeed = newKey.Seed()
+	err = envi.DB.SaveInstance(instanceInfo)
+	if err != nil {
+		rollback()
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+
+	// remove the old key, using the existing connections
+	if failed := revokeKey(hosts, oldKey); len(failed) > 0 {
+		return errors.Errorf("The new SSH key is in use, but the old one could not be removed from %s", strings.Join(failed, ", "))
+	}
+	log.Info("Old SSH key removed")
+
+	// update the key stored by the cloud provider
+	if instanceInfo.CloudType != cloud.Hyperkit {
+		provider, err := getCloud(instanceInfo.CloudName)
+		if err != nil {
+			return errors.Wrapf(err, "Could not retrieve cloud '%s'", instanceInfo.CloudName)
+		}
+		client := provider.Client()
+		err = client.Init(provider.Auth)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to connect to cloud provider '%s'(%s) API", instanceInfo.CloudName, provider.Type.String())
+		}
+		err = client.UpdateInstanceKey(instanceInfo.Name, newKey.AuthorizedKey())
+		if err != nil {
+			return errors.Wrapf(err, "Failed to update the SSH key of instance '%s' on cloud '%s'", name, instanceInfo.CloudName)
+		}
+	}
+
+	updateSSHConfig()
+	log.Infof("SSH key for instance '%s' rotated successfully", name)
+	return nil
+}
+
+// instanceSSHAuth returns the SSH authentication method for an instance, based on its stored key or its ssh-agent key
+func instanceSSHAuth(instanceInfo cloud.InstanceInfo) (gssh.AuthMethod, error) {
+	if len(instanceInfo.AgentKey) > 0 {
+		return ssh.NewAgentAuth(instanceInfo.AgentKey), nil
+	}
+	if len(instanceInfo.KeySeed) == 0 {
+		return nil, errors.Errorf("Instance '%s' is missing its SSH key", instanceInfo.Name)
+	}
+	key, err := ssh.NewKeyFromSeed(instanceInfo.KeySeed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Instance '%s' has an invalid SSH key", instanceInfo.Name)
+	}
+	return key.SSHAuth(), nil
+}
+
+// instanceSSHConfig returns the SSH connection config for an instance, based on its stored key and SSH settings
+func instanceSSHConfig(instanceInfo *cloud.InstanceInfo) (ssh.ConnectionConfig, error) {
+	auth, err := instanceSSHAuth(*instanceInfo)
+	if err != nil {
+		return ssh.ConnectionConfig{}, err
+	}
+	sshConfig := ssh.ConnectionConfig{
+		Host:            instanceInfo.PublicIP,
+		Port:            instanceInfo.SSH.Port,
+		User:            instanceInfo.SSH.User,
+		Auth:            auth,
+		HostKeyCallback: instanceHostKeyCallback(instanceInfo),
+		Timeout:         time.Duration(instanceInfo.SSH.Timeout) * time.Second,
+		ProxyCommand:    instanceInfo.SSH.ProxyCommand,
+	}
+
+	for i, jumpHost := range instanceInfo.SSH.JumpHosts {
+		jumpAuth := auth
+		if jumpHost.IdentityFile != "" {
+			jumpAuth, err = ssh.NewAuthFromKeyFile(jumpHost.IdentityFile)
+			if err != nil {
+				return ssh.ConnectionConfig{}, errors.Wrapf(err, "Failed to load identity file for jump host '%s'", jumpHost.Host)
+			}
+		}
+		sshConfig.JumpHosts = append(sshConfig.JumpHosts, ssh.ConnectionConfig{
+			Host:            jumpHost.Host,
+			Port:            jumpHost.Port,
+			User:            jumpHost.User,
+			Auth:            jumpAuth,
+			HostKeyCallback: jumpHostKeyCallback(instanceInfo, i),
+			Timeout:         sshConfig.Timeout,
+		})
+	}
+	return sshConfig, nil
+}
+
+// newInstanceConnection opens an SSH connection to an instance using its stored key
+func newInstanceConnection(instanceInfo cloud.InstanceInfo, maxRetries int) (*gssh.Client, error) {
+	sshConfig, err := instanceSSHConfig(&instanceInfo)
+	if err != nil {
+		return nil, err
+	}
+	sshClient, err := ssh.NewConnection(sshConfig, maxRetries)
+	if err != nil {
+		return nil, errors.Wrapf(hostKeyError(instanceInfo.Name, err), "Failed to connect to instance '%s'", instanceInfo.Name)
+	}
+	return sshClient, nil
+}
+
+// instanceHostKeyCallback verifies the SSH host key of an instance against the one pinned in the DB. If no key is
+// pinned yet, the first key presented by the instance is trusted and saved, both in the DB and in the provided instance
+func instanceHostKeyCallback(instanceInfo *cloud.InstanceInfo) gssh.HostKeyCallback {
+	return ssh.PinnedHostKey(instanceInfo.HostKey, pinInstanceHostKey(instanceInfo))
+}
+
+// pinInstanceHostKey returns a function which saves the host key of an instance, both in the DB and in the provided
+// instance
+func pinInstanceHostKey(instanceInfo *cloud.InstanceInfo) func(key gssh.PublicKey) error {
+	return func(key gssh.PublicKey) error {
+		log.Infof("Pinning SSH host key %s for instance '%s'", gssh.FingerprintSHA256(key), instanceInfo.Name)
+		instanceInfo.HostKey = key.Marshal()
+		err := envi.DB.SaveInstance(*instanceInfo)
+		if err != nil {
+			return err
+		}
+		updateSSHConfig()
+		return nil
+	}
+}
+
+// captureHostKeys retrieves the SSH host keys of a new instance using the cloud API, for the clouds that expose them
+// and the images that publish them. The instance publishes them at boot, so they are polled for a while. If they are
+// not available, nil is returned and the first key presented by the instance is trusted
+func captureHostKeys(client cloud.Provider, instanceInfo cloud.InstanceInfo, image release.CloudImage) []gssh.PublicKey {
+	if !image.Supports(release.CapabilitySSHHostKeys) {
+		log.Debugf("The image of instance '%s' doesn't publish its SSH host keys. Trusting the first key it presents", instanceInfo.Name)
+		return nil
+	}
+	provider, ok := client.(cloud.HostKeyProvider)
+	if !ok {
+		log.Debugf("Cloud '%s' doesn't expose the SSH host keys of instances. Trusting the first key presented by '%s'", instanceInfo.CloudName, instanceInfo.Name)
+		return nil
+	}
+	for i := 0; i < 6; i++ {
+		keys, err := provider.GetHostKeys(instanceInfo.VMID, instanceInfo.Location)
+		if err == nil {
+			log.Infof("Retrieved %d SSH host key(s) for instance '%s' from the cloud API", len(keys), instanceInfo.Name)
+			return keys
+		}
+		if err != cloud.ErrNoHostKeys {
+			log.Warnf("Failed to retrieve the SSH host keys of instance '%s': %s", instanceInfo.Name, err.Error())
+			break
+		}
+		time.Sleep(5 * time.Second)
+	}
+	log.Warnf("Instance '%s' did not publish its SSH host keys. Trusting the first key it presents", instanceInfo.Name)
+	return nil
+}
+
+// jumpHostKeyCallback verifies the SSH host key of one of the jump hosts of an instance, pinning it on first use
+func jumpHostKeyCallback(instanceInfo *cloud.InstanceInfo, index int) gssh.HostKeyCallback {
+	jumpHost := &instanceInfo.SSH.JumpHosts[index]
+	return ssh.PinnedHostKey(jumpHost.HostKey, func(key gssh.PublicKey) error {
+		log.Infof("Pinning SSH host key %s for jump host '%s' of instance '%s'", gssh.FingerprintSHA256(key), jumpHost.Host, instanceInfo.Name)
+		jumpHost.HostKey = key.Marshal()
+		return envi.DB.SaveInstance(*instanceInfo)
+	})
+}
+
+// hostKeyError adds instructions for resetting the pinned host key to host key mismatch errors
+func hostKeyError(name string, err error) error {
+	if _, ok := errors.Cause(err).(*ssh.HostKeyMismatchError); ok {
+		return errors.Errorf("%s. If instance '%s' was rebuilt on purpose, run 'protos instance hostkey reset %s' and try again", err.Error(), name, name)
+	}
+	return err
+}
+
+// parseJumpHost parses a jump host in the '[user@]host[:port]' format
+func parseJumpHost(spec string) (cloud.SSHJumpHost, error) {
+	jumpHost := cloud.SSHJumpHost{}
+	if idx := strings.LastIndex(spec, "@"); idx >= 0 {
+		jumpHost.User = spec[:idx]
+		spec = spec[idx+1:]
+	}
+	host, port, err := net.SplitHostPort(spec)
+	if err != nil {
+		// no port provided
+		jumpHost.Host = strings.Trim(spec, "[]")
+	} else {
+		jumpHost.Host = host
+		jumpHost.Port, err = strconv.Atoi(port)
+		if err != nil || jumpHost.Port <= 0 || jumpHost.Port > 65535 {
+			return jumpHost, errors.Errorf("Invalid port in jump host '%s'", spec)
+		}
+	}
+	if jumpHost.Host == "" {
+		return jumpHost, errors.Errorf("Invalid jump host '%s'. Expected format is '[user@]host[:port]'", spec)
+	}
+	return jumpHost, nil
+}
+
+func setSSHInstance(c *cli.Context, name string) error {
+	instanceInfo, err := envi.DB.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+
+	if c.IsSet("user") {
+		instanceInfo.SSH.User = c.String("user")
+	}
+	if c.IsSet("port") {
+		if c.Int("port") < 0 || c.Int("port") > 65535 {
+			return errors.Errorf("Invalid SSH port %d", c.Int("port"))
+		}
+		instanceInfo.SSH.Port = c.Int("port")
+	}
+	if c.IsSet("timeout") {
+		instanceInfo.SSH.Timeout = c.Int("timeout")
+	}
+	if c.IsSet("proxy-command") {
+		instanceInfo.SSH.ProxyCommand = c.String("proxy-command")
+	}
+	if c.IsSet("jump") {
+		// the jump host chain is replaced, together with the pinned host keys
+		instanceInfo.SSH.JumpHosts = []cloud.SSHJumpHost{}
+		for _, spec := range c.StringSlice("jump") {
+			if spec == "none" {
+				continue
+			}
+			jumpHost, err := parseJumpHost(spec)
+			if err != nil {
+				return err
+			}
+			instanceInfo.SSH.JumpHosts = append(instanceInfo.SSH.JumpHosts, jumpHost)
+		}
+	}
+	if c.IsSet("jump-identity") {
+		for i := range instanceInfo.SSH.JumpHosts {
+			instanceInfo.SSH.JumpHosts[i].IdentityFile = c.String("jump-identity")
+		}
+	}
+
+	err = envi.DB.SaveInstance(instanceInfo)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	updateSSHConfig()
+	log.Infof("SSH settings for instance '%s' updated", name)
+	return nil
+}
+
+func resetHostKeyInstance(name string) error {
+	instanceInfo, err := envi.DB.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	instanceInfo.HostKey = nil
+	for i := range instanceInfo.SSH.JumpHosts {
+		instanceInfo.SSH.JumpHosts[i].HostKey = nil
+	}
+	err = envi.DB.SaveInstance(instanceInfo)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	updateSSHConfig()
+	log.Infof("SSH host keys for instance '%s' removed. The keys presented on the next connection will be trusted", name)
+	return nil
+}
+
+// parseCopyPath splits a cp argument into an instance name and a path. Local paths return an empty instance name
+func parseCopyPath(arg string) (string, string) {
+	idx := strings.Index(arg, ":")
+	if idx <= 0 || strings.Contains(arg[:idx], "/") {
+		return "", arg
+	}
+	return arg[:idx], arg[idx+1:]
+}
+
+func printCopyProgress(file string, transferred int64, size int64) {
+	percent := int64(100)
+	if size > 0 {
+		percent = transferred * 100 / size
+	}
+	fmt.Fprintf(os.Stderr, "\r %s  %d / %d bytes  %3d%%", file, transferred, size, percent)
+	if transferred == size {
+		fmt.Fprint(os.Stderr, "\n")
+	}
+}
+
+func copyInstance(src string, dst string, recursive bool, verify bool) error {
+	srcInstance, srcPath := parseCopyPath(src)
+	dstInstance, dstPath := parseCopyPath(dst)
+	if srcInstance != "" && dstInstance != "" {
+		return errors.New("Copying directly between two instances is not supported")
+	} else if srcInstance == "" && dstInstance == "" {
+		return errors.New("One of the source or destination should be an instance path (<name>:<path>)")
+	}
+
+	name := srcInstance
+	if dstInstance != "" {
+		name = dstInstance
+	}
+	instanceInfo, err := envi.DB.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	sshClient, err := newInstanceConnection(instanceInfo, 3)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	var files []ssh.CopiedFile
+	if dstInstance != "" {
+		log.Infof("Copying '%s' to instance '%s' at '%s'", srcPath, name, dstPath)
+		files, err = ssh.Upload(sshClient, srcPath, dstPath, recursive, printCopyProgress)
+	} else {
+		log.Infof("Copying '%s' from instance '%s' to '%s'", srcPath, name, dstPath)
+		files, err = ssh.Download(sshClient, srcPath, dstPath, recursive, printCopyProgress)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to copy files")
+	}
+
+	if verify {
+		log.Infof("Verifying checksums for %d file(s)", len(files))
+		err = ssh.VerifyChecksums(sshClient, files)
+		if err != nil {
+			return errors.Wrap(err, "Copied files failed verification")
+		}
+	}
+	log.Infof("Copied %d file(s)", len(files))
+	return nil
+}
+
+// instanceLogsCommand builds the remote command used to retrieve logs from an instance. The journal is used when
+// available, otherwise the log files are read directly
+func instanceLogsCommand(follow bool, since string, lines int, system bool) string {
+	journalArgs := fmt.Sprintf("--no-pager -n %d", lines)
+	tailArgs := fmt.Sprintf("-n %d", lines)
+	if follow {
+		journalArgs += " -f"
+		tailArgs += " -F"
+	}
+	if since != "" {
+		journalArgs += " --since " + ssh.ShellQuote(since)
+	}
+	logFiles := "/var/log/protosd*.log"
+	if system {
+		logFiles = "/var/log/messages"
+	} else {
+		journalArgs += " -u protosd"
+	}
+
+	// the log files can't be filtered by time, so --since is an error instead of being ignored
+	fallback := fmt.Sprintf("tail %s %s", tailArgs, logFiles)
+	if since != "" {
+		fallback = "echo 'journalctl is not available on the instance, so --since is not supported' >&2; exit 1"
+	}
+	return fmt.Sprintf("if command -v journalctl >/dev/null 2>&1; then journalctl %s; else %s; fi", journalArgs, fallback)
+}
+
+func logsInstance(name string, follow bool, since string, lines int, system bool) error {
+	instanceInfo, err := envi.DB.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	sshClient, err := newInstanceConnection(instanceInfo, 3)
+	if err != nil {
+		return err
+	}
+	releaseDB()
+
+	quit := make(chan interface{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go catchSignals(sigs, quit)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ssh.ExecuteCommandStream(instanceLogsCommand(follow, since, lines, system), sshClient, os.Stdout, os.Stderr)
+	}()
+
+	select {
+	case err = <-done:
+		sshClient.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to retrieve logs from instance '%s'", name)
+		}
+	case <-quit:
+		sshClient.Close()
+	}
+	return nil
+}
+
+// dumpInstanceLogs logs the last lines of the Protos daemon logs. Used to provide context when a deployment fails
+func dumpInstanceLogs(instanceInfo cloud.InstanceInfo) {
+	sshClient, err := newInstanceConnection(instanceInfo, 1)
+	if err != nil {
+		log.Errorf("Could not retrieve logs from instance '%s': %s", instanceInfo.Name, err.Error())
+		return
+	}
+	defer sshClient.Close()
+
+	var output bytes.Buffer
+	err = ssh.ExecuteCommandStream(instanceLogsCommand(false, "", 50, false), sshClient, &output, &output)
+	if err != nil {
+		log.Errorf("Could not retrieve logs from instance '%s': %s", instanceInfo.Name, err.Error())
+		return
+	}
+	log.Errorf("Last Protos daemon logs from instance '%s':\n%s", instanceInfo.Name, output.String())
+}
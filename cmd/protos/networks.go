@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/allocator"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/network"
+	"github.com/protosio/cli/internal/settings"
+	"github.com/protosio/cli/internal/user"
+)
+
+// Each instance and device gets its own network, allocated from the pool set using the network.pool setting. A network
+// is reserved by saving it together with its instance or device, and released when the instance or device is deleted,
+// so the allocator is rebuilt from the DB every time
+
+// networkPool returns the address pool used for allocating networks. If it's set to 'ula', a random IPv6 unique local
+// prefix is generated and saved in the config file, so the same prefix is used from then on
+func networkPool() (string, error) {
+	pool, source, err := cfg.Lookup("network.pool")
+	if err != nil {
+		return "", err
+	}
+	if pool != settings.NetworkPoolULA {
+		return pool, nil
+	}
+	if source == settings.SourceEnv {
+		return "", errors.New("PROTOS_NETWORK_POOL can't be 'ula', because the generated prefix has to be saved. Set it to a fixed unique local prefix, or use 'protos config set network.pool ula'")
+	}
+	prefix, err := allocator.GenerateULA()
+	if err != nil {
+		return "", err
+	}
+	err = cfg.Set("network.pool", prefix.String())
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to save the generated network pool")
+	}
+	log.Infof("Generated unique local IPv6 network pool '%s'", prefix.String())
+	return prefix.String(), nil
+}
+
+// newNetworkAllocator returns an allocator with the networks of the provided instances and devices reserved, and the
+// networks routed by the host excluded, so the allocated networks don't hide a local network (e.g. an office LAN)
+func newNetworkAllocator(instances []cloud.InstanceInfo, devices []user.Device) (*allocator.Allocator, error) {
+	pool, err := networkPool()
+	if err != nil {
+		return nil, err
+	}
+	alloc, err := allocator.New(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	// networks allocated by older versions could overlap, so that is only reported
+	instanceNetworks := map[string]net.IPNet{}
+	for _, instance := range instances {
+		if instance.Network == "" {
+			continue
+		}
+		_, inet, err := net.ParseCIDR(instance.Network)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse network of instance '%s'", instance.Name)
+		}
+		instanceNetworks[instance.Name] = *inet
+		err = alloc.Reserve(*inet)
+		if err != nil {
+			log.Warnf("Instance '%s': %s", instance.Name, err.Error())
+		}
+	}
+	for _, dev := range devices {
+		_, dnet, err := net.ParseCIDR(dev.Network)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse network of device '%s'", dev.Name)
+		}
+		err = alloc.Reserve(*dnet)
+		if err != nil {
+			log.Warnf("Device '%s': %s", dev.Name, err.Error())
+		}
+	}
+
+	routes, err := network.LocalRoutes()
+	if err != nil {
+		log.Warnf("Failed to read the local routes, so the allocated network might conflict with a local network: %s", err.Error())
+		return alloc, nil
+	}
+	for _, route := range routes {
+		// routes for the instance networks are added by the VPN
+		vpnRoute := false
+		for name, inet := range instanceNetworks {
+			if route.Dest.String() == inet.String() {
+				vpnRoute = true
+			} else if allocator.Overlaps(route.Dest, inet) {
+				log.Warnf("Network '%s' of instance '%s' conflicts with local route '%s' (%s), so the instance might not be reachable over the VPN", inet.String(), name, route.Dest.String(), route.Interface)
+			}
+		}
+		if !vpnRoute {
+			alloc.Exclude(route.Dest)
+		}
+	}
+	return alloc, nil
+}
+
+// allocateNetwork allocates a network which is not used by the instances in the DB, the provided devices or the host
+func allocateNetwork(devices []user.Device) (net.IPNet, error) {
+	instances, err := envi.DB.GetAllInstances()
+	if err != nil {
+		return net.IPNet{}, errors.Wrap(err, "Failed to retrieve instances")
+	}
+	alloc, err := newNetworkAllocator(instances, devices)
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	allocated, err := alloc.Allocate()
+	if err == allocator.ErrExhausted {
+		pool := alloc.Pool()
+		return net.IPNet{}, errors.Errorf("There are no free networks left in network pool '%s'. Use a larger pool, e.g. 'protos config set network.pool 10.100.0.0/16'", pool.String())
+	}
+	return allocated, err
+}
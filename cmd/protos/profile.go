@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	survey "github.com/AlecAivazis/survey/v2"
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/output"
+	"github.com/urfave/cli/v2"
+)
+
+// The default profile lives directly in the Protos home dir, so that setups created before profiles were introduced
+// keep working. Other profiles live in '<home>/profiles/<name>', each with its own DB, user, clouds and instances
+
+const defaultProfile = "default"
+
+var profileNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// protosHome is the base dir for all the profiles, set using --home or PROTOS_HOME
+var protosHome string
+
+// protosProfile is the active profile, set using --profile, PROTOS_PROFILE or 'profile use'
+var protosProfile string
+
+var cmdProfile *cli.Command = &cli.Command{
+	Name:  "profile",
+	Usage: "Manage profiles. Each profile has its own database, user, clouds and instances",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List profiles",
+			Action: func(c *cli.Context) error {
+				return listProfiles()
+			},
+		},
+		{
+			Name:      "create",
+			ArgsUsage: "<name>",
+			Usage:     "Create a new profile. Run 'init' after switching to it",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return createProfile(name)
+			},
+		},
+		{
+			Name:      "use",
+			ArgsUsage: "<name>",
+			Usage:     "Make a profile the active one",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return useProfile(name)
+			},
+		},
+		{
+			Name:      "delete",
+			ArgsUsage: "<name>",
+			Usage:     "Delete a profile, together with its database and all the instance keys and cloud credentials stored in it",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "yes",
+					Usage: "Don't ask for confirmation",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return deleteProfile(name, c.Bool("yes"))
+			},
+		},
+	},
+}
+
+// resolveHome returns the Protos home dir: the --home flag, PROTOS_HOME, or '~/.protos'
+func resolveHome(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if home := os.Getenv("PROTOS_HOME"); home != "" {
+		return home
+	}
+	homedir := os.Getenv("HOME")
+	if homedir == "" {
+		usr, _ := osuser.Current()
+		homedir = usr.HomeDir
+	}
+	return filepath.Join(homedir, ".protos")
+}
+
+func activeProfilePath() string {
+	return filepath.Join(protosHome, "active_profile")
+}
+
+// resolveProfile returns the active profile: the --profile flag, PROTOS_PROFILE, the profile selected with
+// 'profile use', or the default profile
+func resolveProfile(flagValue string) (string, error) {
+	profile := defaultProfile
+	if flagValue != "" {
+		profile = flagValue
+	} else if envProfile := os.Getenv("PROTOS_PROFILE"); envProfile != "" {
+		profile = envProfile
+	} else if data, err := ioutil.ReadFile(activeProfilePath()); err == nil && strings.TrimSpace(string(data)) != "" {
+		profile = strings.TrimSpace(string(data))
+	}
+	err := validateProfileName(profile)
+	if err != nil {
+		return "", err
+	}
+	return profile, nil
+}
+
+// profileDir returns the dir holding the files of a profile
+func profileDir(name string) string {
+	if name == defaultProfile {
+		return protosHome
+	}
+	return filepath.Join(protosHome, "profiles", name)
+}
+
+func profileExists(name string) bool {
+	if name == defaultProfile {
+		return true
+	}
+	info, err := os.Stat(profileDir(name))
+	return err == nil && info.IsDir()
+}
+
+// validateProfileName makes sure a profile name can't be used to reach files outside the profiles dir, since profile
+// dirs are created and removed based on it
+func validateProfileName(name string) error {
+	if !profileNameRegexp.MatchString(name) {
+		return errors.Errorf("Invalid profile name '%s'. Only letters, digits, '-' and '_' are allowed", name)
+	}
+	if name == defaultProfile {
+		return nil
+	}
+	profilesDir := filepath.Clean(filepath.Join(protosHome, "profiles"))
+	if !strings.HasPrefix(filepath.Clean(profileDir(name)), profilesDir+string(filepath.Separator)) {
+		return errors.Errorf("Invalid profile name '%s'", name)
+	}
+	return nil
+}
+
+//
+// Profile methods
+//
+
+func listProfiles() error {
+	profiles := []string{defaultProfile}
+	entries, err := ioutil.ReadDir(filepath.Join(protosHome, "profiles"))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Failed to list profiles")
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			profiles = append(profiles, entry.Name())
+		}
+	}
+	sort.Strings(profiles[1:])
+
+	type profileView struct {
+		Name   string `json:"name" yaml:"name"`
+		Path   string `json:"path" yaml:"path"`
+		Active bool   `json:"active" yaml:"active"`
+	}
+	views := []profileView{}
+	rows := [][]string{}
+	for _, profile := range profiles {
+		view := profileView{Name: profile, Path: profileDir(profile), Active: profile == protosProfile}
+		views = append(views, view)
+		active := ""
+		if view.Active {
+			active = "*"
+		}
+		rows = append(rows, []string{active, view.Name, view.Path})
+	}
+	return out.List(views, []output.Column{{Header: " "}, {Header: "Name"}, {Header: "Path"}}, rows)
+}
+
+func createProfile(name string) error {
+	err := validateProfileName(name)
+	if err != nil {
+		return err
+	}
+	if profileExists(name) {
+		return errors.Errorf("Profile '%s' already exists", name)
+	}
+	err = os.MkdirAll(profileDir(name), 0700)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create profile '%s'", name)
+	}
+	log.Infof("Profile '%s' created. Switch to it using 'protos profile use %s' and then run 'protos init'", name, name)
+	return nil
+}
+
+func useProfile(name string) error {
+	err := validateProfileName(name)
+	if err != nil {
+		return err
+	}
+	if !profileExists(name) {
+		return errors.Errorf("Profile '%s' does not exist. Create it using 'protos profile create %s'", name, name)
+	}
+	err = ioutil.WriteFile(activeProfilePath(), []byte(name+"\n"), 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to switch to profile '%s'", name)
+	}
+	log.Infof("Using profile '%s'", name)
+	if os.Getenv("PROTOS_PROFILE") != "" {
+		log.Warnf("PROTOS_PROFILE is set, and takes precedence over the profile selected here")
+	}
+	return nil
+}
+
+func deleteProfile(name string, yes bool) error {
+	err := validateProfileName(name)
+	if err != nil {
+		return err
+	}
+	if name == defaultProfile {
+		return errors.New("The default profile can't be deleted")
+	}
+	if !profileExists(name) {
+		return errors.Errorf("Profile '%s' does not exist", name)
+	}
+	if name == protosProfile {
+		return errors.Errorf("Profile '%s' is in use. Switch to a different profile before deleting it", name)
+	}
+
+	if !yes {
+		confirmed := false
+		err = survey.AskOne(&survey.Confirm{Message: fmt.Sprintf("Delete profile '%s'? All its instance keys and cloud credentials will be lost", name)}, &confirmed)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			return nil
+		}
+	}
+
+	err = os.RemoveAll(profileDir(name))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete profile '%s'", name)
+	}
+	// forget the deleted profile if it was selected
+	if data, err := ioutil.ReadFile(activeProfilePath()); err == nil && strings.TrimSpace(string(data)) == name {
+		os.Remove(activeProfilePath())
+	}
+	log.Infof("Profile '%s' deleted", name)
+	return nil
+}
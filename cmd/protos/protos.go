@@ -3,11 +3,14 @@ package main
 import (
 	"fmt"
 	"os"
-	osuser "os/user"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/protosio/cli/internal/db"
 	"github.com/protosio/cli/internal/env"
+	"github.com/protosio/cli/internal/output"
+	"github.com/protosio/cli/internal/settings"
 	"github.com/protosio/cli/internal/user"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -18,9 +21,15 @@ var envi *env.Env
 var cloudName string
 var cloudLocation string
 var protosVersion string
+var protosDir string
+
+const protosDB = "/protos.db"
 
 func main() {
 	var loglevel string
+	var home string
+	var profile string
+	var outputFormat string
 	app := &cli.App{
 		Name:    "protos-cli",
 		Usage:   "Command-line client for Protos",
@@ -28,10 +37,30 @@ func main() {
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "log, l",
-				Value:       "info",
-				Usage:       "Log level: warn, info, debug",
+				Usage:       "Log level: warn, info, debug (config: log.level, default: info)",
 				Destination: &loglevel,
 			},
+			&cli.StringFlag{
+				Name:        "home",
+				Usage:       "Protos home directory (default: $PROTOS_HOME or ~/.protos)",
+				Destination: &home,
+			},
+			&cli.StringFlag{
+				Name:        "profile",
+				Usage:       "Profile to use (default: $PROTOS_PROFILE or the profile selected with 'profile use')",
+				Destination: &profile,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Output format of list and info commands: " + strings.Join(output.Formats, ", ") + " (config: output, default: table)",
+				Destination: &outputFormat,
+			},
+			&cli.BoolFlag{
+				Name:        "show-secrets",
+				Usage:       "Include secrets (private keys, passwords and cloud credentials) in the output of list and info commands",
+				Destination: &showSecrets,
+			},
 		},
 		Commands: []*cli.Command{
 			cmdInit,
@@ -39,13 +68,19 @@ func main() {
 			cmdCloud,
 			cmdInstance,
 			cmdUser,
+			cmdDevice,
 			cmdDev,
 			cmdVPN,
+			cmdSSHConfig,
+			cmdDB,
+			cmdState,
+			cmdProfile,
+			cmdConfig,
 		},
 	}
 
 	app.Before = func(c *cli.Context) error {
-		config(c.Args().First(), loglevel)
+		config(c.Args().Slice(), loglevel, home, profile, outputFormat)
 		return nil
 	}
 
@@ -71,21 +106,93 @@ type userDetails struct {
 	Domain          string
 }
 
-func transformCredentials(creds map[string]interface{}) map[string]string {
-	transformed := map[string]string{}
-	for name, val := range creds {
-		transformed[name] = val.(string)
-	}
-	return transformed
-}
-
 func catchSignals(sigs chan os.Signal, quit chan interface{}) {
 	<-sigs
 	quit <- true
 }
 
-func config(currentCmd string, logLevel string) {
+// readOnlyCommands only query the DB, so they open it in read only mode and can run concurrently
+var readOnlyCommands = map[string]bool{
+	"cloud ls":      true,
+	"cloud info":    true,
+	"instance ls":   true,
+	"instance info": true,
+	"user info":     true,
+	"db info":       true,
+	"vpn status":    true,
+	"release ls":    true,
+	"ssh-config":    true,
+}
+
+// dbTimeout is how long commands wait for the DB if it's used by another protos command
+const dbTimeout = 3 * time.Second
+
+// commandName returns the command and subcommand being run, e.g. 'instance tunnel'
+func commandName(args []string) string {
+	name := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") || len(name) == 2 {
+			break
+		}
+		name = append(name, arg)
+	}
+	return strings.Join(name, " ")
+}
+
+// releaseDB closes the DB before a long running operation, so that other protos commands can use it in the meantime
+func releaseDB() {
+	err := envi.DB.Close()
+	if err != nil {
+		log.Warnf("Failed to release the database: %s", err.Error())
+		return
+	}
+	log.Debug("Database released")
+}
+
+// dbUnlockPassphrase is kept once the DB is unlocked, so that long running commands can reopen it without prompting
+var dbUnlockPassphrase string
+
+// openDB opens the DB of the active profile, and unlocks it if it's encrypted using a passphrase
+func openDB(cmdName string, readOnly bool) (db.DB, error) {
+	dbi, err := db.Open(protosDir, protosDB, db.Options{ReadOnly: readOnly, Timeout: dbTimeout, Command: cmdName})
+	if err != nil {
+		return nil, err
+	}
+	if dbi.Encryption() == db.EncryptionPassphrase {
+		if dbUnlockPassphrase == "" {
+			dbUnlockPassphrase, err = dbPassphrase("Database passphrase:", false)
+			if err != nil {
+				dbi.Close()
+				return nil, err
+			}
+		}
+		err = dbi.Unlock(dbUnlockPassphrase)
+		if err != nil {
+			dbi.Close()
+			return nil, err
+		}
+	}
+	return dbi, nil
+}
+
+func config(args []string, logLevel string, home string, profile string, outputFormat string) {
+	currentCmd := ""
+	if len(args) > 0 {
+		currentCmd = args[0]
+	}
+	cmdName := commandName(args)
+
 	log = logrus.New()
+	protosHome = resolveHome(home)
+	var err error
+	cfg, err = settings.Load(configPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if logLevel == "" {
+		logLevel = cfg.Get("log.level")
+	}
 	level, err := logrus.ParseLevel(logLevel)
 	if err != nil {
 		fmt.Println(fmt.Errorf("Log level '%s' is invalid", logLevel))
@@ -93,22 +200,46 @@ func config(currentCmd string, logLevel string) {
 	}
 	log.SetLevel(level)
 
-	homedir := os.Getenv("HOME")
-	if homedir == "" {
-		usr, _ := osuser.Current()
-		homedir = usr.HomeDir
+	if outputFormat == "" {
+		outputFormat = cfg.Get("output")
+	}
+	format, err := output.ParseFormat(outputFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out = output.New(format, os.Stdout)
+
+	protosProfile, err = resolveProfile(profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !profileExists(protosProfile) {
+		if currentCmd != "profile" {
+			log.Fatalf("Profile '%s' does not exist. Create it using 'protos profile create %s'", protosProfile, protosProfile)
+		}
+		log.Warnf("Profile '%s' does not exist", protosProfile)
+	}
+	protosDir = profileDir(protosProfile)
+
+	// profile and config commands don't need the DB
+	if currentCmd == "profile" || currentCmd == "config" {
+		return
+	}
+	if protosProfile != defaultProfile {
+		log.Infof("Using profile '%s'", protosProfile)
+	} else {
+		log.Debugf("Using profile '%s'", protosProfile)
 	}
-	protosDir := homedir + "/.protos"
-	protosDB := "/protos.db"
 
-	dbi, err := db.Open(protosDir, protosDB)
+	dbi, err := openDB(cmdName, readOnlyCommands[cmdName])
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	envi = env.New(dbi, log)
 
-	if currentCmd != "init" {
+	// init and state import can run before the user is created
+	if currentCmd != "init" && currentCmd != "state" {
 		_, err = user.Get(envi)
 		if err != nil {
 			log.Fatal(errors.Wrap(err, "Please run init command to setup Protos"))
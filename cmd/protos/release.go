@@ -5,17 +5,15 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"text/tabwriter"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/output"
 	"github.com/protosio/cli/internal/release"
 	"github.com/urfave/cli/v2"
 )
 
-const (
-	releasesURL = "https://releases.protos.io/releases.json"
-)
-
 var cmdRelease *cli.Command = &cli.Command{
 	Name:  "release",
 	Usage: "Manage Protos releases",
@@ -28,8 +26,7 @@ var cmdRelease *cli.Command = &cli.Command{
 				if err != nil {
 					return err
 				}
-				printProtosAvailableReleases(releases)
-				return nil
+				return printProtosAvailableReleases(releases)
 			},
 		},
 		{
@@ -119,22 +116,32 @@ var cmdRelease *cli.Command = &cli.Command{
 // Releases methods
 //
 
-func printProtosAvailableReleases(releases release.Releases) {
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 0, 2, ' ', 0)
-
-	defer w.Flush()
+func printProtosAvailableReleases(releases release.Releases) error {
+	versions := []string{}
+	for version := range releases.Releases {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
 
-	fmt.Fprintf(w, " %s\t%s\t%s\t", "Version", "Date", "Description")
-	fmt.Fprintf(w, "\n %s\t%s\t%s\t", "-------", "----", "-----------")
-	for _, release := range releases.Releases {
-		fmt.Fprintf(w, "\n %s\t%s\t%s\t", release.Version, release.ReleaseDate.Format("Jan 2, 2006"), release.Description)
+	views := []releaseView{}
+	rows := [][]string{}
+	for _, version := range versions {
+		view := newReleaseView(releases.Releases[version])
+		views = append(views, view)
+		images := []string{}
+		for name := range view.CloudImages {
+			images = append(images, name)
+		}
+		sort.Strings(images)
+		rows = append(rows, []string{view.Version, view.ReleaseDate.Format("Jan 2, 2006"), view.Description, strings.Join(images, ", ")})
 	}
-	fmt.Fprint(w, "\n")
+	columns := []output.Column{{Header: "Version"}, {Header: "Date"}, {Header: "Description"}, {Header: "Cloud images", Wide: true}}
+	return out.List(views, columns, rows)
 }
 
 func getProtosAvailableReleases() (release.Releases, error) {
 	var releases release.Releases
+	releasesURL := cfg.Get("releases.url")
 	resp, err := http.Get(releasesURL)
 	if err != nil {
 		return releases, errors.Wrapf(err, "Failed to retrieve releases from '%s'", releasesURL)
@@ -156,7 +163,7 @@ func getProtosAvailableReleases() (release.Releases, error) {
 func printProtosCloudImages(cloudName string) error {
 
 	// init cloud
-	provider, err := envi.DB.GetCloud(cloudName)
+	provider, err := getCloud(cloudName)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve cloud '%s'", cloudName)
 	}
@@ -171,22 +178,16 @@ func printProtosCloudImages(cloudName string) error {
 		return errors.Wrapf(err, "Failed to retrieve cloud images")
 	}
 
-	//
-	// do the printing
-	//
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 0, 2, ' ', 0)
-
-	defer w.Flush()
-
-	fmt.Fprintf(w, " %s\t%s\t%s\t", "Version", "ID", "Location")
-	fmt.Fprintf(w, "\n %s\t%s\t%s\t", "-------", "--", "--------")
+	views := []imageView{}
+	rows := [][]string{}
 	for _, img := range images {
-		fmt.Fprintf(w, "\n %s\t%s\t%s\t", img.Name, img.ID, img.Location)
+		views = append(views, imageView{Version: img.Name, ID: img.ID, Location: img.Location})
 	}
-	fmt.Fprint(w, "\n")
-
-	return nil
+	sort.Slice(views, func(i, j int) bool { return views[i].Version < views[j].Version })
+	for _, view := range views {
+		rows = append(rows, []string{view.Version, view.ID, view.Location})
+	}
+	return out.List(views, []output.Column{{Header: "Version"}, {Header: "ID"}, {Header: "Location"}}, rows)
 }
 
 func uploadLocalImageToCloud(imagePath string, imageName string, cloudName string, cloudLocation string) error {
@@ -204,7 +205,7 @@ func uploadLocalImageToCloud(imagePath string, imageName string, cloudName strin
 	}
 
 	// init cloud
-	provider, err := envi.DB.GetCloud(cloudName)
+	provider, err := getCloud(cloudName)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve cloud '%s'", cloudName)
 	}
@@ -237,7 +238,7 @@ func uploadLocalImageToCloud(imagePath string, imageName string, cloudName strin
 func deleteImageFromCloud(imageName string, cloudName string, cloudLocation string) error {
 	errMsg := fmt.Sprintf("Failed to delete image '%s' from cloud '%s'", imageName, cloudName)
 	// init cloud
-	provider, err := envi.DB.GetCloud(cloudName)
+	provider, err := getCloud(cloudName)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve cloud '%s'", cloudName)
 	}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/output"
+	"github.com/protosio/cli/internal/settings"
+	"github.com/urfave/cli/v2"
+)
+
+// cfg holds the settings from '<home>/config.yaml', overridden by environment variables
+var cfg *settings.Config
+
+var cmdConfig *cli.Command = &cli.Command{
+	Name:        "config",
+	Usage:       "Manage default settings, stored in the config file in the Protos home directory",
+	Description: "Settings provide defaults for command flags. Flags take precedence over environment variables (PROTOS_<SETTING>), which take precedence over the config file",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List all settings, with their values and where the values come from",
+			Action: func(c *cli.Context) error {
+				return listSettings()
+			},
+		},
+		{
+			Name:      "get",
+			ArgsUsage: "<setting>",
+			Usage:     "Print the value of a setting",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				value, _, err := cfg.Lookup(name)
+				if err != nil {
+					return err
+				}
+				fmt.Println(value)
+				return nil
+			},
+		},
+		{
+			Name:      "set",
+			ArgsUsage: "<setting> <value>",
+			Usage:     "Set a setting in the config file",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" || c.NArg() != 2 {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return setSetting(name, c.Args().Get(1))
+			},
+		},
+		{
+			Name:      "unset",
+			ArgsUsage: "<setting>",
+			Usage:     "Remove a setting from the config file, so the default is used",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return cfg.Unset(name)
+			},
+		},
+	},
+}
+
+func configPath() string {
+	return filepath.Join(protosHome, "config.yaml")
+}
+
+//
+// Config methods
+//
+
+func listSettings() error {
+	type settingView struct {
+		Name        string `json:"name" yaml:"name"`
+		Value       string `json:"value" yaml:"value"`
+		Source      string `json:"source" yaml:"source"`
+		Description string `json:"description" yaml:"description"`
+	}
+	views := []settingView{}
+	rows := [][]string{}
+	for _, name := range settings.Names() {
+		value, source, err := cfg.Lookup(name)
+		if err != nil {
+			return err
+		}
+		key, _ := settings.Describe(name)
+		if source == settings.SourceEnv {
+			source = settings.Source(key.EnvName())
+		}
+		view := settingView{Name: name, Value: value, Source: string(source), Description: key.Usage}
+		views = append(views, view)
+		rows = append(rows, []string{view.Name, view.Value, view.Source, view.Description})
+	}
+	return out.List(views, []output.Column{{Header: "Setting"}, {Header: "Value"}, {Header: "Source"}, {Header: "Description", Wide: true}}, rows)
+}
+
+func setSetting(name string, value string) error {
+	err := os.MkdirAll(protosHome, 0700)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create '%s' directory", protosHome)
+	}
+	err = cfg.Set(name, value)
+	if err != nil {
+		return err
+	}
+	key, _ := settings.Describe(name)
+	if _, found := os.LookupEnv(key.EnvName()); found {
+		log.Warnf("%s is set, and takes precedence over the config file", key.EnvName())
+	}
+	return nil
+}
+
+// flagOrConfig returns the flag value if set, otherwise the value of the provided setting
+func flagOrConfig(flagValue string, setting string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return cfg.Get(setting)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+	gssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var cmdSSHConfig *cli.Command = &cli.Command{
+	Name:  "ssh-config",
+	Usage: "Generates an OpenSSH config file for all instances, which can be included in '~/.ssh/config'",
+	Description: "Writes '~/.protos/ssh_config' with a Host entry for every instance, together with the instance keys and the pinned host keys. " +
+		"Once generated, the file is kept up to date automatically when instances are deployed, deleted or reconfigured",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "remove",
+			Usage: "Remove the generated files and stop updating them automatically",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.Bool("remove") {
+			return removeSSHConfig()
+		}
+		err := writeSSHConfig()
+		if err != nil {
+			return err
+		}
+		log.Infof("SSH config written to '%s'. Add 'Include %s' at the top of '~/.ssh/config' to use it", sshConfigPath(), sshConfigPath())
+		return nil
+	},
+}
+
+func sshConfigPath() string {
+	return filepath.Join(protosDir, "ssh_config")
+}
+
+func sshKnownHostsPath() string {
+	return filepath.Join(protosDir, "ssh_known_hosts")
+}
+
+func sshKeysDir() string {
+	return filepath.Join(protosDir, "keys")
+}
+
+// sshConfigValue quotes values that contain spaces
+func sshConfigValue(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return "\"" + value + "\""
+	}
+	return value
+}
+
+// writeInstanceKey materialises the SSH key of an instance in the keys dir and returns its path. For ssh-agent backed
+// instances only the public key is written, which OpenSSH uses to select the key from the agent
+func writeInstanceKey(instanceInfo cloud.InstanceInfo) (string, error) {
+	keyPath := filepath.Join(sshKeysDir(), instanceInfo.Name)
+	var data []byte
+	if len(instanceInfo.AgentKey) > 0 {
+		pubKey, err := gssh.ParsePublicKey(instanceInfo.AgentKey)
+		if err != nil {
+			return "", errors.Wrapf(err, "Instance '%s' has an invalid ssh-agent key", instanceInfo.Name)
+		}
+		keyPath = keyPath + ".pub"
+		data = gssh.MarshalAuthorizedKey(pubKey)
+	} else {
+		key, err := ssh.NewKeyFromSeed(instanceInfo.KeySeed)
+		if err != nil {
+			return "", errors.Wrapf(err, "Instance '%s' has an invalid SSH key", instanceInfo.Name)
+		}
+		data = []byte(key.EncodePrivateKeytoPEM())
+	}
+
+	err := ioutil.WriteFile(keyPath, data, 0600)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to write SSH key for instance '%s'", instanceInfo.Name)
+	}
+	// WriteFile doesn't change the permissions of existing files
+	err = os.Chmod(keyPath, 0600)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to set permissions for '%s'", keyPath)
+	}
+	return keyPath, nil
+}
+
+// sshHost holds the settings of a Host entry in the SSH config
+type sshHost struct {
+	alias        string
+	hostName     string
+	port         int
+	user         string
+	identityFile string
+	hostKey      []byte
+	proxyJump    string
+	proxyCommand string
+}
+
+// jumpHostAlias returns the Host entry name used for a jump host of an instance
+func jumpHostAlias(instanceName string, index int) string {
+	return fmt.Sprintf("%s.jump%d", instanceName, index+1)
+}
+
+// writeSSHHost writes a Host entry to the SSH config, and its pinned host key to the known hosts. The host key is
+// recorded under the alias (HostKeyAlias), so it doesn't depend on the address used to reach the host. Hosts without a
+// pinned key are trusted on first use, like protos-cli does
+func writeSSHHost(config *bytes.Buffer, knownHosts *bytes.Buffer, host sshHost) error {
+	port := host.port
+	if port == 0 {
+		port = 22
+	}
+	user := host.user
+	if user == "" {
+		user = "root"
+	}
+
+	fmt.Fprintf(config, "Host %s\n", host.alias)
+	fmt.Fprintf(config, "    HostName %s\n", host.hostName)
+	fmt.Fprintf(config, "    Port %d\n", port)
+	fmt.Fprintf(config, "    User %s\n", user)
+	fmt.Fprintf(config, "    IdentityFile %s\n", sshConfigValue(host.identityFile))
+	fmt.Fprintf(config, "    IdentitiesOnly yes\n")
+	fmt.Fprintf(config, "    HostKeyAlias %s\n", host.alias)
+	fmt.Fprintf(config, "    UserKnownHostsFile %s\n", sshConfigValue(sshKnownHostsPath()))
+	if len(host.hostKey) > 0 {
+		hostKey, err := gssh.ParsePublicKey(host.hostKey)
+		if err != nil {
+			return errors.Wrap(err, "Invalid host key")
+		}
+		fmt.Fprintln(knownHosts, knownhosts.Line([]string{host.alias}, hostKey))
+		fmt.Fprintf(config, "    StrictHostKeyChecking yes\n")
+	} else {
+		fmt.Fprintf(config, "    StrictHostKeyChecking accept-new\n")
+	}
+	if host.proxyJump != "" {
+		fmt.Fprintf(config, "    ProxyJump %s\n", host.proxyJump)
+	} else if host.proxyCommand != "" {
+		fmt.Fprintf(config, "    ProxyCommand %s\n", host.proxyCommand)
+	}
+	fmt.Fprintf(config, "\n")
+	return nil
+}
+
+// writeSSHConfig generates the SSH config, known hosts and key files for all the instances
+func writeSSHConfig() error {
+	instances, err := envi.DB.GetAllInstances()
+	if err != nil {
+		return errors.Wrap(err, "Failed to retrieve instances")
+	}
+
+	// keys of deleted instances are removed by recreating the dir
+	err = os.RemoveAll(sshKeysDir())
+	if err != nil {
+		return errors.Wrapf(err, "Failed to remove '%s' directory", sshKeysDir())
+	}
+	err = os.MkdirAll(sshKeysDir(), 0700)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create '%s' directory", sshKeysDir())
+	}
+
+	config := &bytes.Buffer{}
+	knownHosts := &bytes.Buffer{}
+	fmt.Fprintf(config, "# Generated by protos-cli. Manual changes will be overwritten\n\n")
+	for _, instanceInfo := range instances {
+		if instanceInfo.PublicIP == "" || (len(instanceInfo.KeySeed) == 0 && len(instanceInfo.AgentKey) == 0) {
+			log.Debugf("Skipping instance '%s' because it has no public IP or SSH key", instanceInfo.Name)
+			continue
+		}
+		keyPath, err := writeInstanceKey(instanceInfo)
+		if err != nil {
+			return err
+		}
+
+		// every jump host gets its own Host entry, so it uses its own key and pinned host key, and is reached through
+		// the previous jump host
+		proxyJump := ""
+		for i, jumpHost := range instanceInfo.SSH.JumpHosts {
+			identityFile := jumpHost.IdentityFile
+			if identityFile == "" {
+				identityFile = keyPath
+			}
+			host := sshHost{
+				alias:        jumpHostAlias(instanceInfo.Name, i),
+				hostName:     jumpHost.Host,
+				port:         jumpHost.Port,
+				user:         jumpHost.User,
+				identityFile: identityFile,
+				hostKey:      jumpHost.HostKey,
+				proxyJump:    proxyJump,
+			}
+			// the proxy command is only used to reach the first hop, like protos-cli does
+			if i == 0 {
+				host.proxyCommand = instanceInfo.SSH.ProxyCommand
+			}
+			err = writeSSHHost(config, knownHosts, host)
+			if err != nil {
+				return errors.Wrapf(err, "Jump host '%s' of instance '%s'", jumpHost.Host, instanceInfo.Name)
+			}
+			proxyJump = host.alias
+		}
+
+		instanceHost := sshHost{
+			alias:        instanceInfo.Name,
+			hostName:     instanceInfo.PublicIP,
+			port:         instanceInfo.SSH.Port,
+			user:         instanceInfo.SSH.User,
+			identityFile: keyPath,
+			hostKey:      instanceInfo.HostKey,
+			proxyJump:    proxyJump,
+		}
+		if proxyJump == "" {
+			instanceHost.proxyCommand = instanceInfo.SSH.ProxyCommand
+		}
+		err = writeSSHHost(config, knownHosts, instanceHost)
+		if err != nil {
+			return errors.Wrapf(err, "Instance '%s'", instanceInfo.Name)
+		}
+	}
+
+	err = ioutil.WriteFile(sshKnownHostsPath(), knownHosts.Bytes(), 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write '%s'", sshKnownHostsPath())
+	}
+	err = ioutil.WriteFile(sshConfigPath(), config.Bytes(), 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write '%s'", sshConfigPath())
+	}
+	return nil
+}
+
+// updateSSHConfig regenerates the SSH config if it was generated before. Failures are only logged, because the config
+// is not essential for the command that triggered the update
+func updateSSHConfig() {
+	_, err := os.Stat(sshConfigPath())
+	if err != nil {
+		return
+	}
+	err = writeSSHConfig()
+	if err != nil {
+		log.Warnf("Failed to update SSH config: %s", err.Error())
+		return
+	}
+	log.Debugf("SSH config '%s' updated", sshConfigPath())
+}
+
+func removeSSHConfig() error {
+	for _, path := range []string{sshConfigPath(), sshKnownHostsPath(), sshKeysDir()} {
+		err := os.RemoveAll(path)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to remove '%s'", path)
+		}
+	}
+	log.Infof("SSH config removed. Remember to remove the 'Include %s' line from '~/.ssh/config'", sshConfigPath())
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/db"
+	"github.com/protosio/cli/internal/state"
+	"github.com/protosio/cli/internal/user"
+	"github.com/urfave/cli/v2"
+)
+
+const statePassphraseEnv = "PROTOS_STATE_PASSPHRASE"
+
+var cmdState *cli.Command = &cli.Command{
+	Name:  "state",
+	Usage: "Export and import the local Protos state (user, clouds and instances)",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "export",
+			ArgsUsage: "<file>",
+			Usage:     "Export the local state to an archive encrypted with a passphrase",
+			Description: "The archive contains the user, the cloud credentials and the instance keys. Credentials stored in a secret backend " +
+				"are included in the archive, and are stored in the database when the archive is imported",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "redact-secrets",
+					Usage: "Leave out the user, the cloud credentials and the instance keys, so the archive can be shared with teammates",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				file := c.Args().Get(0)
+				if file == "" {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return exportState(file, c.Bool("redact-secrets"))
+			},
+		},
+		{
+			Name:      "import",
+			ArgsUsage: "<file>",
+			Usage:     "Import an archive created by 'state export', merging it with the local state",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "on-conflict",
+					Value: state.ConflictFail,
+					Usage: "What to do with records that differ from the local ones: fail (nothing is imported), skip (keep the local records) or overwrite",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				file := c.Args().Get(0)
+				onConflict := c.String("on-conflict")
+				if file == "" || (onConflict != state.ConflictFail && onConflict != state.ConflictSkip && onConflict != state.ConflictOverwrite) {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				return importState(file, onConflict)
+			},
+		},
+	},
+}
+
+// localState gives the state merge access to the local user, clouds and instances
+type localState struct{}
+
+func (localState) User() (user.Info, error) {
+	usr, err := user.Get(envi)
+	if err == user.ErrNoUser {
+		return usr, state.ErrNotFound
+	}
+	return usr, err
+}
+
+func (localState) Cloud(name string) (cloud.ProviderInfo, error) {
+	cloudInfo, err := getCloud(name)
+	if err == db.ErrNotFound {
+		return cloudInfo, state.ErrNotFound
+	}
+	return cloudInfo, err
+}
+
+func (localState) Instance(name string) (cloud.InstanceInfo, error) {
+	instanceInfo, err := envi.DB.GetInstance(name)
+	if err == db.ErrNotFound {
+		return instanceInfo, state.ErrNotFound
+	}
+	return instanceInfo, err
+}
+
+func (localState) PrimaryInstance() (string, error) {
+	return envi.DB.GetPrimaryInstance()
+}
+
+//
+// State methods
+//
+
+func exportState(file string, redact bool) error {
+	archive := state.Archive{Created: time.Now().UTC()}
+
+	usr, err := user.Get(envi)
+	if err == nil {
+		usr.SecretBackend = ""
+		archive.User = &usr
+	} else if err != user.ErrNoUser {
+		return err
+	}
+
+	clouds, err := envi.DB.GetAllClouds()
+	if err != nil {
+		return errors.Wrap(err, "Failed to retrieve clouds")
+	}
+	for _, cloudInfo := range clouds {
+		if !redact {
+			cloudInfo.Auth, err = envi.CloudAuth(cloudInfo)
+			if err != nil {
+				return err
+			}
+		}
+		cloudInfo.SecretBackend = ""
+		archive.Clouds = append(archive.Clouds, cloudInfo)
+	}
+
+	archive.Instances, err = envi.DB.GetAllInstances()
+	if err != nil {
+		return errors.Wrap(err, "Failed to retrieve instances")
+	}
+	archive.Primary, err = envi.DB.GetPrimaryInstance()
+	if err != nil {
+		return err
+	}
+
+	if redact {
+		archive.Redact()
+	}
+
+	passphrase, err := askPassphrase(statePassphraseEnv, "Archive passphrase:", true)
+	if err != nil {
+		return err
+	}
+	data, err := state.Encrypt(archive, passphrase)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, data, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write state archive '%s'", file)
+	}
+
+	log.Infof("Exported %d cloud(s) and %d instance(s) to '%s'", len(archive.Clouds), len(archive.Instances), file)
+	if redact {
+		log.Info("Secrets were left out of the archive")
+	}
+	return nil
+}
+
+func importState(file string, onConflict string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read state archive '%s'", file)
+	}
+	passphrase, err := askPassphrase(statePassphraseEnv, "Archive passphrase:", false)
+	if err != nil {
+		return err
+	}
+	archive, err := state.Decrypt(data, passphrase)
+	if err != nil {
+		return err
+	}
+
+	// work out what has to be imported before writing anything, so that conflicts can abort the import
+	plan, err := archive.Merge(localState{}, onConflict)
+	if err != nil {
+		return err
+	}
+	for _, warning := range plan.Warnings {
+		log.Warn(warning)
+	}
+	if len(plan.Conflicts) > 0 {
+		log.Infof("Resolved conflicts (%s) for: %s", onConflict, strings.Join(plan.Conflicts, ", "))
+	}
+
+	// write the records in a single transaction, so a failure doesn't leave a partial import behind. Credentials stored
+	// in a secret backend are written outside of it
+	err = envi.DB.Update(func(tx db.DB) error {
+		txEnv := *envi
+		txEnv.DB = tx
+		if plan.User != nil {
+			_, err := user.Import(&txEnv, *plan.User)
+			if err != nil {
+				return err
+			}
+		}
+		for _, cloudInfo := range plan.Clouds {
+			err := txEnv.SaveCloud(cloudInfo)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to import cloud '%s'", cloudInfo.Name)
+			}
+		}
+		for _, instanceInfo := range plan.Instances {
+			if _, err := tx.GetCloud(instanceInfo.CloudName); err != nil && instanceInfo.CloudType != cloud.Hyperkit {
+				log.Warnf("Instance '%s' belongs to cloud '%s', which is not available locally", instanceInfo.Name, instanceInfo.CloudName)
+			}
+			if archive.Redacted && len(instanceInfo.KeySeed) == 0 && len(instanceInfo.AgentKey) == 0 {
+				log.Warnf("Instance '%s' was imported without its SSH key, so it can't be accessed over SSH", instanceInfo.Name)
+			}
+			err := tx.SaveInstance(instanceInfo)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to import instance '%s'", instanceInfo.Name)
+			}
+		}
+		if plan.Primary != "" {
+			err := tx.SetPrimaryInstance(plan.Primary)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to set primary instance '%s'", plan.Primary)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "State import was rolled back")
+	}
+	updateSSHConfig()
+	if plan.Primary != "" {
+		log.Infof("Instance '%s' is now the primary instance", plan.Primary)
+		notifyVPNDaemon()
+	}
+
+	userCount := 0
+	if plan.User != nil {
+		userCount = 1
+	}
+	log.Infof("Imported %d user(s), %d cloud(s) and %d instance(s) from '%s'", userCount, len(plan.Clouds), len(plan.Instances), file)
+	return nil
+}
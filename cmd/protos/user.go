@@ -1,11 +1,11 @@
 package main
 
 import (
-	"encoding/base64"
-	"fmt"
 	"os"
+	"strings"
 
-	"github.com/protosio/cli/internal/ssh"
+	"github.com/protosio/cli/internal/env"
+	"github.com/protosio/cli/internal/output"
 	"github.com/protosio/cli/internal/user"
 	"github.com/urfave/cli/v2"
 )
@@ -57,29 +57,49 @@ var cmdUser *cli.Command = &cli.Command{
 						return usr.SetDomain(domain)
 					},
 				},
+				{
+					Name:      "secret-backend",
+					ArgsUsage: "<backend>",
+					Usage:     "Move the user password to a different secret backend: " + strings.Join(env.SecretBackends, ", "),
+					Action: func(c *cli.Context) error {
+						backend := c.Args().Get(0)
+						if backend == "" {
+							cli.ShowSubcommandHelp(c)
+							os.Exit(1)
+						}
+						usr, err := user.Get(envi)
+						if err != nil {
+							return err
+						}
+						return usr.SetSecretBackend(backend)
+					},
+				},
 			},
 		},
 	},
 }
 
 func infoUser() error {
-	user, err := user.Get(envi)
+	usr, err := user.Get(envi)
 	if err != nil {
 		return err
 	}
-
-	key, err := ssh.NewKeyFromSeed(user.Device.KeySeed)
+	view, err := newUserView(usr)
 	if err != nil {
 		return err
 	}
 
-	encodedPrivateKey := base64.StdEncoding.EncodeToString(key.Seed())
-	fmt.Printf("Username: %s\n", user.Username)
-	fmt.Printf("Name: %s\n", user.Name)
-	fmt.Printf("Domain: %s\n", user.Domain)
-	fmt.Printf("Device name: %s\n", user.Device.Name)
-	fmt.Printf("Device private key: %s\n", encodedPrivateKey)
-	fmt.Printf("Device public key (wireguard): %s\n", key.PublicWG().String())
-	fmt.Printf("Device network: %s\n", user.Device.Network)
-	return nil
+	fields := []output.Field{
+		{Name: "Profile", Value: view.Profile},
+		{Name: "Username", Value: view.Username},
+		{Name: "Name", Value: view.Name},
+		{Name: "Domain", Value: view.Domain},
+		{Name: "Password secret backend", Value: view.SecretBackend, Wide: usr.SecretBackend == ""},
+		secretField("Password", view.Password),
+		{Name: "Device name", Value: view.Device.Name},
+		secretField("Device private key", view.Device.PrivateKey),
+		{Name: "Device public key (wireguard)", Value: view.Device.WireguardPublicKey},
+		{Name: "Device network", Value: view.Device.Network},
+	}
+	return out.Info(view, fields)
 }
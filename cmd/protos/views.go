@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/base64"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/output"
+	"github.com/protosio/cli/internal/release"
+	"github.com/protosio/cli/internal/ssh"
+	"github.com/protosio/cli/internal/user"
+	gssh "golang.org/x/crypto/ssh"
+)
+
+// Views define the stable field names used by the JSON and YAML output formats. Secrets are only filled in when
+// --show-secrets is used
+
+// out renders the output of list and info commands, in the format selected using --output
+var out *output.Renderer
+
+// showSecrets includes secrets (private keys, passwords and credentials) in the output
+var showSecrets bool
+
+type instanceSSHView struct {
+	Address      string   `json:"address" yaml:"address"`
+	User         string   `json:"user" yaml:"user"`
+	AgentKey     string   `json:"agentKey,omitempty" yaml:"agentKey,omitempty"`
+	HostKey      string   `json:"hostKey,omitempty" yaml:"hostKey,omitempty"`
+	JumpHosts    []string `json:"jumpHosts,omitempty" yaml:"jumpHosts,omitempty"`
+	ProxyCommand string   `json:"proxyCommand,omitempty" yaml:"proxyCommand,omitempty"`
+	PrivateKey   string   `json:"privateKey,omitempty" yaml:"privateKey,omitempty"`
+}
+
+type volumeView struct {
+	ID   string `json:"id" yaml:"id"`
+	Name string `json:"name" yaml:"name"`
+	Size uint64 `json:"size" yaml:"size"`
+}
+
+type instanceView struct {
+	Name               string          `json:"name" yaml:"name"`
+	VMID               string          `json:"vmId" yaml:"vmId"`
+	PublicIP           string          `json:"publicIp" yaml:"publicIp"`
+	InternalIP         string          `json:"internalIp" yaml:"internalIp"`
+	Network            string          `json:"network" yaml:"network"`
+	WireguardPublicKey string          `json:"wireguardPublicKey" yaml:"wireguardPublicKey"`
+	CloudType          string          `json:"cloudType" yaml:"cloudType"`
+	CloudName          string          `json:"cloudName" yaml:"cloudName"`
+	Location           string          `json:"location" yaml:"location"`
+	ProtosVersion      string          `json:"protosVersion" yaml:"protosVersion"`
+	Primary            bool            `json:"primary" yaml:"primary"`
+	SSH                instanceSSHView `json:"ssh" yaml:"ssh"`
+	Volumes            []volumeView    `json:"volumes" yaml:"volumes"`
+}
+
+func newInstanceView(instance cloud.InstanceInfo) (instanceView, error) {
+	view := instanceView{
+		Name:               instance.Name,
+		VMID:               instance.VMID,
+		PublicIP:           instance.PublicIP,
+		InternalIP:         instance.InternalIP,
+		Network:            instance.Network,
+		WireguardPublicKey: base64.StdEncoding.EncodeToString(instance.PublicKey),
+		CloudType:          instance.CloudType.String(),
+		CloudName:          instance.CloudName,
+		Location:           instance.Location,
+		ProtosVersion:      instance.ProtosVersion,
+		Volumes:            []volumeView{},
+	}
+
+	sshConfig := ssh.ConnectionConfig{Host: instance.PublicIP, Port: instance.SSH.Port, User: instance.SSH.User}
+	view.SSH.Address = sshConfig.Address()
+	view.SSH.User = instance.SSH.User
+	if view.SSH.User == "" {
+		view.SSH.User = "root"
+	}
+	if len(instance.AgentKey) > 0 {
+		agentKey, err := gssh.ParsePublicKey(instance.AgentKey)
+		if err != nil {
+			return view, errors.Wrapf(err, "Instance '%s' has an invalid ssh-agent key", instance.Name)
+		}
+		view.SSH.AgentKey = gssh.FingerprintSHA256(agentKey)
+	}
+	if len(instance.HostKey) > 0 {
+		fingerprint, err := ssh.HostKeyFingerprint(instance.HostKey)
+		if err != nil {
+			return view, errors.Wrapf(err, "Instance '%s' has an invalid host key", instance.Name)
+		}
+		view.SSH.HostKey = fingerprint
+	}
+	for _, jumpHost := range instance.SSH.JumpHosts {
+		jumpConfig := ssh.ConnectionConfig{Host: jumpHost.Host, Port: jumpHost.Port}
+		view.SSH.JumpHosts = append(view.SSH.JumpHosts, jumpConfig.Address())
+	}
+	view.SSH.ProxyCommand = instance.SSH.ProxyCommand
+	if showSecrets && len(instance.KeySeed) > 0 {
+		key, err := ssh.NewKeyFromSeed(instance.KeySeed)
+		if err != nil {
+			return view, errors.Wrapf(err, "Instance '%s' has an invalid SSH key", instance.Name)
+		}
+		view.SSH.PrivateKey = key.EncodePrivateKeytoPEM()
+	}
+
+	for _, volume := range instance.Volumes {
+		view.Volumes = append(view.Volumes, volumeView{ID: volume.VolumeID, Name: volume.Name, Size: volume.Size})
+	}
+	return view, nil
+}
+
+type cloudView struct {
+	Name          string            `json:"name" yaml:"name"`
+	Type          string            `json:"type" yaml:"type"`
+	SecretBackend string            `json:"secretBackend" yaml:"secretBackend"`
+	Credentials   map[string]string `json:"credentials,omitempty" yaml:"credentials,omitempty"`
+}
+
+func newCloudView(cloudInfo cloud.ProviderInfo) cloudView {
+	view := cloudView{Name: cloudInfo.Name, Type: cloudInfo.Type.String(), SecretBackend: cloudInfo.SecretBackend}
+	if view.SecretBackend == "" {
+		view.SecretBackend = "db"
+	}
+	if showSecrets {
+		view.Credentials = cloudInfo.Auth
+	}
+	return view
+}
+
+type machineView struct {
+	Cores                uint32  `json:"cores" yaml:"cores"`
+	Memory               uint32  `json:"memory" yaml:"memory"`
+	DefaultStorage       uint32  `json:"defaultStorage" yaml:"defaultStorage"`
+	Bandwidth            uint32  `json:"bandwidth" yaml:"bandwidth"`
+	IncludedDataTransfer uint32  `json:"includedDataTransfer" yaml:"includedDataTransfer"`
+	Baremetal            bool    `json:"baremetal" yaml:"baremetal"`
+	PriceMonthly         float32 `json:"priceMonthly" yaml:"priceMonthly"`
+}
+
+type cloudInfoView struct {
+	cloudView    `yaml:",inline"`
+	Locations    []string               `json:"locations" yaml:"locations"`
+	MachineTypes map[string]machineView `json:"machineTypes" yaml:"machineTypes"`
+	Status       string                 `json:"status" yaml:"status"`
+	Error        string                 `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type cloudImageView struct {
+	Provider    string    `json:"provider" yaml:"provider"`
+	URL         string    `json:"url" yaml:"url"`
+	Digest      string    `json:"digest" yaml:"digest"`
+	ReleaseDate time.Time `json:"releaseDate" yaml:"releaseDate"`
+}
+
+type releaseView struct {
+	Version     string                    `json:"version" yaml:"version"`
+	Description string                    `json:"description" yaml:"description"`
+	ReleaseDate time.Time                 `json:"releaseDate" yaml:"releaseDate"`
+	CloudImages map[string]cloudImageView `json:"cloudImages" yaml:"cloudImages"`
+}
+
+func newReleaseView(rls release.Release) releaseView {
+	view := releaseView{Version: rls.Version, Description: rls.Description, ReleaseDate: rls.ReleaseDate, CloudImages: map[string]cloudImageView{}}
+	for name, image := range rls.CloudImages {
+		view.CloudImages[name] = cloudImageView{Provider: image.Provider, URL: image.URL, Digest: image.Digest, ReleaseDate: image.ReleaseDate}
+	}
+	return view
+}
+
+type imageView struct {
+	Version  string `json:"version" yaml:"version"`
+	ID       string `json:"id" yaml:"id"`
+	Location string `json:"location" yaml:"location"`
+}
+
+type deviceView struct {
+	Name               string `json:"name" yaml:"name"`
+	Local              bool   `json:"local" yaml:"local"`
+	Network            string `json:"network" yaml:"network"`
+	WireguardPublicKey string `json:"wireguardPublicKey" yaml:"wireguardPublicKey"`
+	PrivateKey         string `json:"privateKey,omitempty" yaml:"privateKey,omitempty"`
+}
+
+// newDeviceView returns the view of a device. local is set for the device running the CLI
+func newDeviceView(dev user.Device, local bool) (deviceView, error) {
+	key, err := ssh.NewKeyFromSeed(dev.KeySeed)
+	if err != nil {
+		return deviceView{}, errors.Wrapf(err, "Device '%s' has an invalid key", dev.Name)
+	}
+	view := deviceView{Name: dev.Name, Local: local, Network: dev.Network, WireguardPublicKey: key.PublicWG().String()}
+	if showSecrets {
+		view.PrivateKey = base64.StdEncoding.EncodeToString(key.Seed())
+	}
+	return view, nil
+}
+
+type userView struct {
+	Profile       string     `json:"profile" yaml:"profile"`
+	Username      string     `json:"username" yaml:"username"`
+	Name          string     `json:"name" yaml:"name"`
+	Domain        string     `json:"domain" yaml:"domain"`
+	SecretBackend string     `json:"secretBackend" yaml:"secretBackend"`
+	Password      string     `json:"password,omitempty" yaml:"password,omitempty"`
+	Device        deviceView `json:"device" yaml:"device"`
+}
+
+func newUserView(usr user.Info) (userView, error) {
+	device, err := newDeviceView(usr.Device, true)
+	if err != nil {
+		return userView{}, err
+	}
+	view := userView{
+		Profile:       protosProfile,
+		Username:      usr.Username,
+		Name:          usr.Name,
+		Domain:        usr.Domain,
+		SecretBackend: usr.SecretBackend,
+		Device:        device,
+	}
+	if view.SecretBackend == "" {
+		view.SecretBackend = "db"
+	}
+	if showSecrets {
+		view.Password = usr.Password
+	}
+	return view, nil
+}
+
+// sortedKeys returns the keys of a map of strings, sorted, so list output is stable
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedMachineTypes returns the machine type IDs, sorted
+func sortedMachineTypes(m map[string]machineView) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// secretField returns an info field for a secret, which is only shown when --show-secrets is used
+func secretField(name string, value string) output.Field {
+	if !showSecrets {
+		value = "<hidden, use --show-secrets>"
+	}
+	return output.Field{Name: name, Value: value}
+}
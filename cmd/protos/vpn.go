@@ -3,9 +3,13 @@ package main
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/protosio/cli/internal/cloud"
 	"github.com/protosio/cli/internal/network"
+	"github.com/protosio/cli/internal/output"
 	"github.com/protosio/cli/internal/user"
 	"github.com/urfave/cli/v2"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -24,6 +28,27 @@ var cmdVPN *cli.Command = &cli.Command{
 				return startVPN()
 			},
 		},
+		{
+			Name:  "up",
+			Usage: "Start the VPN. In daemon mode, the VPN is kept in sync with the instances until SIGTERM or SIGINT",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "daemon",
+					Usage: "Keep running, and add or remove peers and routes when instances are deployed or deleted",
+				},
+				&cli.DurationFlag{
+					Name:  "interval",
+					Value: 10 * time.Second,
+					Usage: "How often the daemon checks the VPN interface and the database for changes",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if !c.Bool("daemon") {
+					return startVPN()
+				}
+				return runVPNDaemon(c.Duration("interval"))
+			},
+		},
 		{
 			Name:  "stop",
 			Usage: "Stop the VPN",
@@ -31,6 +56,20 @@ var cmdVPN *cli.Command = &cli.Command{
 				return stopVPN()
 			},
 		},
+		{
+			Name:  "status",
+			Usage: "Print the status of the VPN peers, routes and DNS. Exits with an error if a peer has no recent handshake",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "max-handshake-age",
+					Value: 3 * time.Minute,
+					Usage: "Peers without a handshake in this `DURATION` are considered down",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return statusVPN(c.Duration("max-handshake-age"))
+			},
+		},
 	},
 }
 
@@ -46,27 +85,92 @@ func startVPN() error {
 		return err
 	}
 
-	// create protos vpn interface and configure the address
-	lnk, err := manager.CreateLink(protosNetworkInterface)
+	// create protos vpn interface and configure the address and key
+	lnk, err := createVPNLink(manager, usr)
 	if err != nil {
 		return err
 	}
-	ip, netp, err := net.ParseCIDR(usr.Device.Network)
+
+	// create wireguard peer configurations, route list and DNS servers
+	allInstances, err := envi.DB.GetAllInstances()
 	if err != nil {
 		return err
 	}
-	netp.IP = ip
-	err = lnk.AddAddr(network.Address{IPNet: *netp})
+	instances := initializedInstances(allInstances)
+	if len(instances) == 0 {
+		manager.DelLink(protosNetworkInterface)
+		return fmt.Errorf("There are no initialized instances to connect to. Deploy one using 'protos instance deploy'")
+	}
+	primary, err := envi.DB.GetPrimaryInstance()
+	if err != nil {
+		return err
+	}
+	peers, routes, err := vpnPeers(instances)
+	if err != nil {
+		return err
+	}
+	domainServers, err := vpnDNS(usr.Domain, instances, primary)
 	if err != nil {
 		return err
 	}
 
-	// create wireguard peer configurations and route list
-	instances, err := envi.DB.GetAllInstances()
+	// configure wireguard
+	err = lnk.ConfigureWG(wgtypes.Config{Peers: peers})
 	if err != nil {
 		return err
 	}
-	var masterInstaceIP net.IP
+
+	// add the routes towards instances
+	for _, route := range routes {
+		err = lnk.AddRoute(route)
+		if err != nil {
+			return err
+		}
+	}
+
+	// add DNS servers for the domain and the instance subdomains
+	dns, err := network.NewDNS()
+	if err != nil {
+		return err
+	}
+
+	for domain, servers := range domainServers {
+		err = dns.AddDomainServers(domain, servers)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createVPNLink creates the protos vpn interface, with the address and private key of the user device
+func createVPNLink(manager network.Manager, usr user.Info) (network.Link, error) {
+	lnk, err := manager.CreateLink(protosNetworkInterface)
+	if err != nil {
+		return nil, err
+	}
+	ip, netp, err := net.ParseCIDR(usr.Device.Network)
+	if err != nil {
+		return nil, err
+	}
+	netp.IP = ip
+	err = lnk.AddAddr(network.Address{IPNet: *netp})
+	if err != nil {
+		return nil, err
+	}
+
+	var pkey wgtypes.Key
+	copy(pkey[:], usr.Device.KeySeed)
+	err = lnk.ConfigureWG(wgtypes.Config{PrivateKey: &pkey})
+	if err != nil {
+		return nil, err
+	}
+	return lnk, nil
+}
+
+// vpnPeers returns the wireguard peer configurations and the routes towards the instances
+func vpnPeers(instances []cloud.InstanceInfo) ([]wgtypes.PeerConfig, []network.Route, error) {
 	keepAliveInterval := 25 * time.Second
 	peers := []wgtypes.PeerConfig{}
 	routes := []network.Route{}
@@ -76,20 +180,14 @@ func startVPN() error {
 
 		_, instanceNetwork, err := net.ParseCIDR(instance.Network)
 		if err != nil {
-			return fmt.Errorf("Failed to parse network for instance '%s': %w", instance.Name, err)
+			return nil, nil, fmt.Errorf("Failed to parse network for instance '%s': %w", instance.Name, err)
 		}
 		instancePublicIP := net.ParseIP(instance.PublicIP)
 		if instancePublicIP == nil {
-			return fmt.Errorf("Failed to parse public IP for instance '%s'", instance.Name)
+			return nil, nil, fmt.Errorf("Failed to parse public IP for instance '%s'", instance.Name)
 		}
 		routes = append(routes, network.Route{Dest: *instanceNetwork})
 
-		instanceInternalIP := net.ParseIP(instance.InternalIP)
-		if instancePublicIP == nil {
-			return fmt.Errorf("Failed to parse internal IP for instance '%s'", instance.Name)
-		}
-		masterInstaceIP = instanceInternalIP
-
 		peerConf := wgtypes.PeerConfig{
 			PublicKey:                   pubkey,
 			PersistentKeepaliveInterval: &keepAliveInterval,
@@ -98,73 +196,288 @@ func startVPN() error {
 		}
 		peers = append(peers, peerConf)
 	}
+	return peers, routes, nil
+}
 
-	// configure wireguard
-	var pkey wgtypes.Key
-	copy(pkey[:], usr.Device.KeySeed)
-	wgcfg := wgtypes.Config{
-		PrivateKey: &pkey,
-		Peers:      peers,
+// initializedInstances filters out the instances which were not initialized yet, because they can't be connected to
+func initializedInstances(instances []cloud.InstanceInfo) []cloud.InstanceInfo {
+	initialized := []cloud.InstanceInfo{}
+	for _, instance := range instances {
+		if len(instance.PublicKey) == 0 || instance.InternalIP == "" {
+			log.Debugf("Instance '%s' is not initialized, so it's not reachable using the VPN", instance.Name)
+			continue
+		}
+		initialized = append(initialized, instance)
 	}
-	err = lnk.ConfigureWG(wgcfg)
+	return initialized
+}
+
+// primaryInstance returns the instance set using 'instance set-primary'. If it's not set or not among the provided
+// instances, the first instance is used, so the choice is stable
+func primaryInstance(instances []cloud.InstanceInfo, name string) (cloud.InstanceInfo, error) {
+	if len(instances) == 0 {
+		return cloud.InstanceInfo{}, fmt.Errorf("There are no instances")
+	}
+	for _, instance := range instances {
+		if instance.Name == name {
+			return instance, nil
+		}
+	}
+	if name != "" {
+		log.Warnf("Primary instance '%s' is not available. Using '%s' instead", name, instances[0].Name)
+	}
+	return instances[0], nil
+}
+
+// vpnDNS returns the DNS servers for the user domain and the instance subdomains. The user domain is served by the
+// primary instance, with the rest of the instances as fallback, while each '<instance>.<domain>' subdomain is served by
+// its instance
+func vpnDNS(domain string, instances []cloud.InstanceInfo, primaryName string) (map[string][]net.IP, error) {
+	domainServers := map[string][]net.IP{}
+	if len(instances) == 0 {
+		return domainServers, nil
+	}
+	primary, err := primaryInstance(instances, primaryName)
+	if err != nil {
+		return nil, err
+	}
+	servers := []net.IP{}
+	for _, instance := range append([]cloud.InstanceInfo{primary}, instances...) {
+		ip := net.ParseIP(instance.InternalIP)
+		if ip == nil {
+			return nil, fmt.Errorf("Failed to parse internal IP for instance '%s'", instance.Name)
+		}
+		subdomain := instance.Name + "." + domain
+		if _, found := domainServers[subdomain]; found {
+			continue
+		}
+		servers = append(servers, ip)
+		domainServers[subdomain] = []net.IP{ip}
+	}
+	domainServers[domain] = servers
+	return domainServers, nil
+}
+
+func stopVPN() error {
+	usr, err := user.Get(envi)
 	if err != nil {
 		return err
 	}
 
-	// add the routes towards instances
-	for _, route := range routes {
-		err = lnk.AddRoute(route)
-		if err != nil {
-			return err
-		}
+	manager, err := network.NewManager()
+	if err != nil {
+		return err
+	}
+
+	// remove VPN link
+	_, err = manager.GetLink(protosNetworkInterface)
+	if err != nil {
+		return err
+	}
+
+	err = manager.DelLink(protosNetworkInterface)
+	if err != nil {
+		return err
 	}
 
-	// add DNS server for domain
+	// remove DNS servers for the domain and the instance subdomains
 	dns, err := network.NewDNS()
 	if err != nil {
 		return err
 	}
 
-	err = dns.AddDomainServer(usr.Domain, masterInstaceIP)
+	instances, err := envi.DB.GetAllInstances()
 	if err != nil {
 		return err
 	}
+	domains := []string{usr.Domain}
+	for _, instance := range instances {
+		domains = append(domains, instance.Name+"."+usr.Domain)
+	}
+	for _, domain := range domains {
+		servers, err := dns.DomainServers(domain)
+		if err != nil {
+			return err
+		}
+		if servers == nil {
+			continue
+		}
+		err = dns.DelDomainServer(domain)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func stopVPN() error {
+type vpnPeerView struct {
+	Instance      string     `json:"instance" yaml:"instance"`
+	PublicKey     string     `json:"publicKey" yaml:"publicKey"`
+	Endpoint      string     `json:"endpoint" yaml:"endpoint"`
+	LastHandshake *time.Time `json:"lastHandshake" yaml:"lastHandshake"`
+	RxBytes       int64      `json:"rxBytes" yaml:"rxBytes"`
+	TxBytes       int64      `json:"txBytes" yaml:"txBytes"`
+	Routes        []string   `json:"routes" yaml:"routes"`
+	MissingRoutes []string   `json:"missingRoutes" yaml:"missingRoutes"`
+	Subdomain     string     `json:"subdomain" yaml:"subdomain"`
+	SubdomainDNS  []string   `json:"subdomainDns" yaml:"subdomainDns"`
+	Up            bool       `json:"up" yaml:"up"`
+}
+
+type vpnStatusView struct {
+	Interface       string        `json:"interface" yaml:"interface"`
+	Domain          string        `json:"domain" yaml:"domain"`
+	PrimaryInstance string        `json:"primaryInstance" yaml:"primaryInstance"`
+	DNSServers      []string      `json:"dnsServers" yaml:"dnsServers"`
+	Peers           []vpnPeerView `json:"peers" yaml:"peers"`
+}
+
+// domainServerStrings returns the DNS servers of a domain as strings
+func domainServerStrings(dns network.DNSManager, domain string) ([]string, error) {
+	servers, err := dns.DomainServers(domain)
+	if err != nil {
+		return nil, err
+	}
+	serverStrings := []string{}
+	for _, server := range servers {
+		serverStrings = append(serverStrings, server.String())
+	}
+	return serverStrings, nil
+}
+
+func statusVPN(maxHandshakeAge time.Duration) error {
 	usr, err := user.Get(envi)
 	if err != nil {
 		return err
 	}
+	instances, err := envi.DB.GetAllInstances()
+	if err != nil {
+		return err
+	}
 
 	manager, err := network.NewManager()
 	if err != nil {
 		return err
 	}
-
-	// remove VPN link
-	_, err = manager.GetLink(protosNetworkInterface)
+	defer manager.Close()
+	lnk, err := manager.GetLink(protosNetworkInterface)
+	if err != nil {
+		return fmt.Errorf("VPN is not running: %w", err)
+	}
+	wgDev, err := lnk.WGConfig()
 	if err != nil {
 		return err
 	}
 
-	err = manager.DelLink(protosNetworkInterface)
+	view := vpnStatusView{Interface: lnk.Interface().Name, Domain: usr.Domain, Peers: []vpnPeerView{}}
+	primaryName, err := envi.DB.GetPrimaryInstance()
 	if err != nil {
 		return err
 	}
-
-	// remove DNS server for domain
+	if initialized := initializedInstances(instances); len(initialized) > 0 {
+		primary, _ := primaryInstance(initialized, primaryName)
+		view.PrimaryInstance = primary.Name
+	}
 	dns, err := network.NewDNS()
 	if err != nil {
 		return err
 	}
+	view.DNSServers, err = domainServerStrings(dns, usr.Domain)
+	if err != nil {
+		return err
+	}
 
-	err = dns.DelDomainServer(usr.Domain)
+	// peers are matched to instances using their public keys
+	instanceNames := map[wgtypes.Key]string{}
+	for _, instance := range instances {
+		var pubkey wgtypes.Key
+		copy(pubkey[:], instance.PublicKey)
+		instanceNames[pubkey] = instance.Name
+	}
+
+	down := []string{}
+	for _, peer := range wgDev.Peers {
+		peerView := vpnPeerView{
+			Instance:      instanceNames[peer.PublicKey],
+			PublicKey:     peer.PublicKey.String(),
+			RxBytes:       peer.ReceiveBytes,
+			TxBytes:       peer.TransmitBytes,
+			Routes:        []string{},
+			MissingRoutes: []string{},
+		}
+		if peerView.Instance == "" {
+			peerView.Instance = "<unknown>"
+		} else {
+			peerView.Subdomain = peerView.Instance + "." + usr.Domain
+			peerView.SubdomainDNS, err = domainServerStrings(dns, peerView.Subdomain)
+			if err != nil {
+				return err
+			}
+		}
+		if peer.Endpoint != nil {
+			peerView.Endpoint = peer.Endpoint.String()
+		}
+		if !peer.LastHandshakeTime.IsZero() {
+			lastHandshake := peer.LastHandshakeTime
+			peerView.LastHandshake = &lastHandshake
+			peerView.Up = time.Since(lastHandshake) <= maxHandshakeAge
+		}
+		for _, allowedIP := range peer.AllowedIPs {
+			installed, err := lnk.HasRoute(network.Route{Dest: allowedIP})
+			if err != nil {
+				return err
+			}
+			if installed {
+				peerView.Routes = append(peerView.Routes, allowedIP.String())
+			} else {
+				peerView.MissingRoutes = append(peerView.MissingRoutes, allowedIP.String())
+			}
+		}
+		if !peerView.Up {
+			down = append(down, peerView.Instance)
+		}
+		view.Peers = append(view.Peers, peerView)
+	}
+
+	dnsStatus := strings.Join(view.DNSServers, ", ")
+	if dnsStatus == "" {
+		dnsStatus = "not registered"
+	}
+	err = out.Info(view, []output.Field{
+		{Name: "Interface", Value: fmt.Sprintf("%s (%s)", protosNetworkInterface, view.Interface)},
+		{Name: "Primary instance", Value: view.PrimaryInstance},
+		{Name: "DNS servers for " + view.Domain, Value: dnsStatus},
+	})
 	if err != nil {
 		return err
 	}
+	if out.Format == output.Table || out.Format == output.Wide {
+		rows := [][]string{}
+		for _, peer := range view.Peers {
+			handshake := "never"
+			if peer.LastHandshake != nil {
+				handshake = time.Since(*peer.LastHandshake).Truncate(time.Second).String() + " ago"
+			}
+			routes := strings.Join(peer.Routes, ", ")
+			if len(peer.MissingRoutes) > 0 {
+				routes = strings.TrimPrefix(routes+", missing: "+strings.Join(peer.MissingRoutes, ", "), ", ")
+			}
+			subdomainDNS := strings.Join(peer.SubdomainDNS, ", ")
+			if subdomainDNS == "" {
+				subdomainDNS = "not registered"
+			}
+			rows = append(rows, []string{peer.Instance, peer.Endpoint, handshake, strconv.FormatInt(peer.RxBytes, 10), strconv.FormatInt(peer.TxBytes, 10), routes, subdomainDNS, peer.PublicKey})
+		}
+		fmt.Println()
+		err = out.List(view.Peers, []output.Column{{Header: "Instance"}, {Header: "Endpoint"}, {Header: "Last handshake"}, {Header: "Received"}, {Header: "Sent"}, {Header: "Routes"}, {Header: "Subdomain DNS", Wide: true}, {Header: "Public key", Wide: true}}, rows)
+		if err != nil {
+			return err
+		}
+	}
 
+	if len(down) > 0 {
+		return fmt.Errorf("No handshake in the last %s for instance(s) '%s'", maxHandshakeAge.String(), strings.Join(down, "', '"))
+	}
 	return nil
 }
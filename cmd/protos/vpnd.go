@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/network"
+	"github.com/protosio/cli/internal/user"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// The VPN daemon keeps the VPN in sync with the instances in the DB. The DB is only opened while reading it, so that
+// other commands can deploy or delete instances in the meantime. Those commands signal the daemon using SIGHUP, and the
+// DB file is also polled for changes made by older clients
+
+// resolveInterval is how often the public IP of an instance without a recent handshake is looked up using the cloud API
+const resolveInterval = 5 * time.Minute
+
+// staleHandshake is the age after which a peer is considered unreachable
+const staleHandshake = 3 * time.Minute
+
+func vpnPIDPath() string {
+	return filepath.Join(protosDir, "vpn.pid")
+}
+
+// notifyVPNDaemon signals the VPN daemon of the active profile, if it's running, to reload the instances
+func notifyVPNDaemon() {
+	data, err := ioutil.ReadFile(vpnPIDPath())
+	if err != nil {
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return
+	}
+	// the PID file might be left behind by a daemon that was killed, so the PID could belong to a different process now
+	cmdline, err := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "command=").Output()
+	if err != nil || !strings.Contains(string(cmdline), "vpn up") {
+		return
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return
+	}
+	err = process.Signal(syscall.SIGHUP)
+	if err != nil {
+		log.Debugf("Failed to signal the VPN daemon (PID %d): %s", pid, err.Error())
+		return
+	}
+	log.Debugf("Signalled the VPN daemon (PID %d)", pid)
+}
+
+type vpnDaemon struct {
+	usr       user.Info
+	manager   network.Manager
+	resolver  network.DNSManager
+	lnk       network.Link
+	instances map[wgtypes.Key]cloud.InstanceInfo
+	peers     map[wgtypes.Key]wgtypes.PeerConfig
+	routes    map[string]network.Route
+	dns       map[string][]net.IP
+	dbModTime time.Time
+	resolved  map[string]time.Time
+}
+
+// withDB opens the DB for the duration of fn
+func withDB(readOnly bool, fn func() error) error {
+	dbi, err := openDB("vpn up", readOnly)
+	if err != nil {
+		return err
+	}
+	envi.DB = dbi
+	defer dbi.Close()
+	return fn()
+}
+
+func runVPNDaemon(interval time.Duration) error {
+	usr, err := user.Get(envi)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(vpnPIDPath(), []byte(strconv.Itoa(os.Getpid())+"\n"), 0600)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write the VPN daemon PID file")
+	}
+	defer os.Remove(vpnPIDPath())
+
+	manager, err := network.NewManager()
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+	dns, err := network.NewDNS()
+	if err != nil {
+		return err
+	}
+	d := &vpnDaemon{usr: usr, manager: manager, resolver: dns, dns: map[string][]net.IP{}, resolved: map[string]time.Time{}}
+
+	// signals are registered before starting, so that a deploy finishing in the meantime is not missed
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	err = d.start()
+	if err != nil {
+		d.stop()
+		return err
+	}
+	releaseDB()
+	log.Infof("VPN is up. Watching for instance changes every %s", interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-quit:
+			log.Infof("Received %s. Stopping the VPN", sig.String())
+			d.stop()
+			return nil
+		case <-reload:
+			log.Info("Reloading instances")
+			d.reload()
+		case <-ticker.C:
+			d.check()
+		}
+	}
+}
+
+// start creates the VPN interface and configures it for the instances in the DB
+func (d *vpnDaemon) start() error {
+	// a link left behind by a daemon that died is removed first
+	if _, err := d.manager.GetLink(protosNetworkInterface); err == nil {
+		log.Warnf("Removing existing VPN interface '%s'", protosNetworkInterface)
+		err = d.manager.DelLink(protosNetworkInterface)
+		if err != nil {
+			return err
+		}
+	}
+
+	lnk, err := createVPNLink(d.manager, d.usr)
+	if err != nil {
+		return err
+	}
+	d.lnk = lnk
+	d.instances = map[wgtypes.Key]cloud.InstanceInfo{}
+	d.peers = map[wgtypes.Key]wgtypes.PeerConfig{}
+	d.routes = map[string]network.Route{}
+	if info, err := os.Stat(protosDir + protosDB); err == nil {
+		d.dbModTime = info.ModTime()
+	}
+
+	instances, err := envi.DB.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	primary, err := envi.DB.GetPrimaryInstance()
+	if err != nil {
+		return err
+	}
+	return d.sync(instances, primary)
+}
+
+// stop removes the VPN interface and the DNS server. Errors are only logged, so that as much as possible is cleaned up
+func (d *vpnDaemon) stop() {
+	err := d.manager.DelLink(protosNetworkInterface)
+	if err != nil {
+		log.Errorf("Failed to remove the VPN interface: %s", err.Error())
+	}
+	for domain := range d.dns {
+		err = d.resolver.DelDomainServer(domain)
+		if err != nil {
+			log.Errorf("Failed to remove the DNS servers for '%s': %s", domain, err.Error())
+		}
+		delete(d.dns, domain)
+	}
+}
+
+// reload reads the instances from the DB and updates the VPN accordingly
+func (d *vpnDaemon) reload() {
+	var instances []cloud.InstanceInfo
+	var primary string
+	err := withDB(true, func() error {
+		var err error
+		instances, err = envi.DB.GetAllInstances()
+		if err != nil {
+			return err
+		}
+		primary, err = envi.DB.GetPrimaryInstance()
+		return err
+	})
+	if err != nil {
+		log.Errorf("Failed to read instances: %s", err.Error())
+		return
+	}
+	err = d.sync(instances, primary)
+	if err != nil {
+		log.Errorf("Failed to update the VPN: %s", err.Error())
+	}
+}
+
+// check runs periodically. It restarts the VPN if wireguard-go died, reloads the instances if the DB changed and looks
+// up the public IPs of instances that can't be reached
+func (d *vpnDaemon) check() {
+	wgDev, err := d.lnk.WGConfig()
+	if err != nil {
+		log.Warnf("VPN interface is down (%s). Restarting it", err.Error())
+		d.stop()
+		err = withDB(true, d.start)
+		if err != nil {
+			log.Errorf("Failed to restart the VPN: %s", err.Error())
+		}
+		return
+	}
+
+	info, err := os.Stat(protosDir + protosDB)
+	if err == nil && !info.ModTime().Equal(d.dbModTime) {
+		d.dbModTime = info.ModTime()
+		log.Info("Database changed. Reloading instances")
+		d.reload()
+	}
+
+	for _, peer := range wgDev.Peers {
+		instance, found := d.instances[peer.PublicKey]
+		if !found || time.Since(peer.LastHandshakeTime) < staleHandshake || time.Since(d.resolved[instance.Name]) < resolveInterval {
+			continue
+		}
+		d.resolved[instance.Name] = time.Now()
+		err = d.resolve(instance)
+		if err != nil {
+			log.Warnf("Failed to look up the public IP of instance '%s': %s", instance.Name, err.Error())
+		}
+	}
+}
+
+// resolve looks up the public IP of an instance using the cloud API, and updates the instance and the VPN if it changed
+func (d *vpnDaemon) resolve(instance cloud.InstanceInfo) error {
+	var cloudInfo cloud.ProviderInfo
+	err := withDB(true, func() error {
+		var err error
+		cloudInfo, err = getCloud(instance.CloudName)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	client := cloudInfo.Client()
+	err = client.Init(cloudInfo.Auth)
+	if err != nil {
+		return err
+	}
+	vmInfo, err := client.GetInstanceInfo(instance.VMID, instance.Location)
+	if err != nil {
+		return err
+	}
+	if vmInfo.PublicIP == "" || vmInfo.PublicIP == instance.PublicIP {
+		return nil
+	}
+
+	log.Infof("Public IP of instance '%s' changed from '%s' to '%s'", instance.Name, instance.PublicIP, vmInfo.PublicIP)
+	err = withDB(false, func() error {
+		current, err := envi.DB.GetInstance(instance.Name)
+		if err != nil {
+			return err
+		}
+		current.PublicIP = vmInfo.PublicIP
+		return envi.DB.SaveInstance(current)
+	})
+	if err != nil {
+		return err
+	}
+	d.reload()
+	return nil
+}
+
+// sync updates the wireguard peers, routes and DNS servers so they match the provided instances. Only the differences
+// are applied, so the connections to unchanged instances are not interrupted
+func (d *vpnDaemon) sync(allInstances []cloud.InstanceInfo, primary string) error {
+	instances := initializedInstances(allInstances)
+	if len(instances) == 0 {
+		log.Warn("There are no initialized instances to connect to. Waiting for one to be deployed")
+	}
+	peers, routes, err := vpnPeers(instances)
+	if err != nil {
+		return err
+	}
+	domainServers, err := vpnDNS(d.usr.Domain, instances, primary)
+	if err != nil {
+		return err
+	}
+	byKey := map[wgtypes.Key]cloud.InstanceInfo{}
+	for _, instance := range instances {
+		var pubkey wgtypes.Key
+		copy(pubkey[:], instance.PublicKey)
+		byKey[pubkey] = instance
+	}
+
+	// peers
+	changes := []wgtypes.PeerConfig{}
+	wanted := map[wgtypes.Key]wgtypes.PeerConfig{}
+	for _, peer := range peers {
+		wanted[peer.PublicKey] = peer
+		current, found := d.peers[peer.PublicKey]
+		if found && current.Endpoint.String() == peer.Endpoint.String() && fmt.Sprint(current.AllowedIPs) == fmt.Sprint(peer.AllowedIPs) {
+			continue
+		}
+		if found {
+			log.Infof("Updating peer for instance '%s'", byKey[peer.PublicKey].Name)
+		} else {
+			log.Infof("Adding peer for instance '%s'", byKey[peer.PublicKey].Name)
+		}
+		peer.ReplaceAllowedIPs = true
+		changes = append(changes, peer)
+	}
+	for key := range d.peers {
+		if _, found := wanted[key]; !found {
+			log.Infof("Removing peer for instance '%s'", d.instances[key].Name)
+			changes = append(changes, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+		}
+	}
+	if len(changes) > 0 {
+		err = d.lnk.ConfigureWG(wgtypes.Config{Peers: changes})
+		if err != nil {
+			return err
+		}
+	}
+	d.peers = wanted
+	d.instances = byKey
+
+	// routes
+	wantedRoutes := map[string]network.Route{}
+	for _, route := range routes {
+		wantedRoutes[route.Dest.String()] = route
+	}
+	for dest, route := range d.routes {
+		if _, found := wantedRoutes[dest]; found {
+			continue
+		}
+		err = d.lnk.DelRoute(route)
+		if err != nil {
+			return err
+		}
+		delete(d.routes, dest)
+	}
+	for dest, route := range wantedRoutes {
+		if _, found := d.routes[dest]; found {
+			continue
+		}
+		err = d.lnk.AddRoute(route)
+		if err != nil {
+			return err
+		}
+		d.routes[dest] = route
+	}
+
+	// DNS servers
+	for domain, servers := range d.dns {
+		if wanted, found := domainServers[domain]; found && fmt.Sprint(wanted) == fmt.Sprint(servers) {
+			continue
+		}
+		err = d.resolver.DelDomainServer(domain)
+		if err != nil {
+			return err
+		}
+		delete(d.dns, domain)
+	}
+	for domain, servers := range domainServers {
+		if _, found := d.dns[domain]; found {
+			continue
+		}
+		log.Infof("Using %v as DNS servers for '%s'", servers, domain)
+		err = d.resolver.AddDomainServers(domain, servers)
+		if err != nil {
+			return err
+		}
+		d.dns[domain] = servers
+	}
+	return nil
+}
@@ -20,9 +20,12 @@ require (
 	github.com/protosio/protos v0.0.0-20200408102450-95ad50dc9dc1
 	github.com/scaleway/scaleway-sdk-go v1.0.0-beta.6
 	github.com/sirupsen/logrus v1.5.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/urfave/cli/v2 v2.2.0
+	go.etcd.io/bbolt v1.3.3
 	golang.org/x/crypto v0.0.0-20200406173513-056763e48d71
 	golang.zx2c4.com/wireguard v0.0.20200121
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200205215550-e35592f146e4
 	google.golang.org/appengine v1.6.1 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
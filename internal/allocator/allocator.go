@@ -0,0 +1,203 @@
+// Package allocator hands out non overlapping networks, for instances and devices, from an IPv4 or IPv6 address pool
+package allocator
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+const (
+	// IPv4PrefixLen is the size of the networks allocated from IPv4 pools
+	IPv4PrefixLen = 24
+	// IPv6PrefixLen is the size of the networks allocated from IPv6 pools
+	IPv6PrefixLen = 64
+	// ULAPrefixLen is the size of the IPv6 unique local prefixes returned by GenerateULA
+	ULAPrefixLen = 48
+)
+
+// ErrExhausted is returned when all the networks in the pool are in use
+var ErrExhausted = errors.New("There are no free networks left in the network pool")
+
+// ula is the IPv6 unique local address range (RFC 4193). IPv6 pools have to be part of it
+var ula = net.IPNet{IP: net.ParseIP("fc00::"), Mask: net.CIDRMask(7, 128)}
+
+// Allocator keeps track of the networks in use, and allocates new ones from the pool
+type Allocator struct {
+	pool      net.IPNet
+	prefixLen int
+	reserved  []net.IPNet
+	excluded  []net.IPNet
+}
+
+// ParsePool parses and validates an address pool, and returns it together with the prefix length of the networks
+// allocated from it
+func ParsePool(pool string) (net.IPNet, int, error) {
+	ip, network, err := net.ParseCIDR(pool)
+	if err != nil {
+		return net.IPNet{}, 0, fmt.Errorf("Invalid network pool '%s': %w", pool, err)
+	}
+	if !ip.Equal(network.IP) {
+		return net.IPNet{}, 0, fmt.Errorf("Invalid network pool '%s'. It has host bits set, did you mean '%s'?", pool, network.String())
+	}
+	ones, bits := network.Mask.Size()
+	prefixLen := IPv4PrefixLen
+	if bits == 8*net.IPv6len {
+		prefixLen = IPv6PrefixLen
+		if !ula.Contains(network.IP) {
+			return net.IPNet{}, 0, fmt.Errorf("Invalid network pool '%s'. IPv6 pools have to be unique local (%s) prefixes", pool, ula.String())
+		}
+	}
+	if ones > prefixLen {
+		return net.IPNet{}, 0, fmt.Errorf("Invalid network pool '%s'. It's smaller than the /%d networks allocated from it", pool, prefixLen)
+	}
+	return *network, prefixLen, nil
+}
+
+// New returns an allocator for the provided pool, e.g. '10.100.0.0/16' or 'fd12:3456:789a::/48'
+func New(pool string) (*Allocator, error) {
+	network, prefixLen, err := ParsePool(pool)
+	if err != nil {
+		return nil, err
+	}
+	return &Allocator{pool: network, prefixLen: prefixLen}, nil
+}
+
+// Pool returns the address pool of the allocator
+func (a *Allocator) Pool() net.IPNet {
+	return a.pool
+}
+
+// Reserve marks a network as used. Networks outside the pool can be reserved too, e.g. ones allocated from a previous
+// pool. An error is returned if the network overlaps an already reserved network
+func (a *Allocator) Reserve(network net.IPNet) error {
+	network = normalize(network)
+	for _, reserved := range a.reserved {
+		if Overlaps(reserved, network) {
+			return fmt.Errorf("Network '%s' overlaps network '%s', which is already in use", network.String(), reserved.String())
+		}
+	}
+	a.reserved = append(a.reserved, network)
+	return nil
+}
+
+// Release marks a previously reserved network as free
+func (a *Allocator) Release(network net.IPNet) {
+	network = normalize(network)
+	reserved := []net.IPNet{}
+	for _, r := range a.reserved {
+		if r.String() != network.String() {
+			reserved = append(reserved, r)
+		}
+	}
+	a.reserved = reserved
+}
+
+// Exclude prevents networks overlapping the provided one from being allocated, without reserving it. It's used for
+// networks which are not managed by Protos, like the ones routed by the host
+func (a *Allocator) Exclude(network net.IPNet) {
+	a.excluded = append(a.excluded, normalize(network))
+}
+
+// Allocate reserves and returns the first network in the pool which doesn't overlap any reserved or excluded network
+func (a *Allocator) Allocate() (net.IPNet, error) {
+	ones, bits := a.pool.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-a.prefixLen))
+	end := new(big.Int).Add(ipToInt(a.pool.IP), new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)))
+	mask := net.CIDRMask(a.prefixLen, bits)
+
+	current := ipToInt(a.pool.IP)
+	for current.Cmp(end) < 0 {
+		candidate := net.IPNet{IP: intToIP(current, bits/8), Mask: mask}
+		used, found := a.overlapping(candidate)
+		if !found {
+			a.reserved = append(a.reserved, candidate)
+			return candidate, nil
+		}
+
+		// the used network can be larger than the candidate, so the next candidate is the first one after it
+		usedOnes, usedBits := used.Mask.Size()
+		usedEnd := new(big.Int).Add(ipToInt(used.IP), new(big.Int).Lsh(big.NewInt(1), uint(usedBits-usedOnes)))
+		next := new(big.Int).Add(current, size)
+		if usedEnd.Cmp(next) > 0 {
+			// round up to a network boundary. The pool start is aligned, so absolute alignment works
+			next.Add(usedEnd, new(big.Int).Sub(size, big.NewInt(1)))
+			next.Div(next, size)
+			next.Mul(next, size)
+		}
+		current = next
+	}
+	return net.IPNet{}, ErrExhausted
+}
+
+// overlapping returns the first reserved or excluded network overlapping the provided one
+func (a *Allocator) overlapping(network net.IPNet) (net.IPNet, bool) {
+	for _, used := range append(append([]net.IPNet{}, a.reserved...), a.excluded...) {
+		if Overlaps(used, network) {
+			return used, true
+		}
+	}
+	return net.IPNet{}, false
+}
+
+//
+// package methods
+//
+
+// Overlaps returns true if the two networks have addresses in common. Networks of different address families never
+// overlap
+func Overlaps(a net.IPNet, b net.IPNet) bool {
+	a = normalize(a)
+	b = normalize(b)
+	if len(a.IP) != len(b.IP) {
+		return false
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// FirstAddress returns the first host address of a network, with the network mask, e.g. '10.100.1.1/24' for
+// '10.100.1.0/24'
+func FirstAddress(network net.IPNet) net.IPNet {
+	network = normalize(network)
+	_, bits := network.Mask.Size()
+	ip := intToIP(new(big.Int).Add(ipToInt(network.IP), big.NewInt(1)), bits/8)
+	return net.IPNet{IP: ip, Mask: network.Mask}
+}
+
+// GenerateULA returns a random IPv6 unique local /48 prefix, as described in RFC 4193
+func GenerateULA() (net.IPNet, error) {
+	prefix := make(net.IP, net.IPv6len)
+	prefix[0] = 0xfd
+	_, err := rand.Read(prefix[1:6])
+	if err != nil {
+		return net.IPNet{}, fmt.Errorf("Failed to generate unique local IPv6 prefix: %w", err)
+	}
+	return net.IPNet{IP: prefix, Mask: net.CIDRMask(ULAPrefixLen, 8*net.IPv6len)}, nil
+}
+
+// normalize returns the network with IPv4 addresses in their 4 byte form and the host bits cleared, so networks
+// parsed in different ways can be compared
+func normalize(network net.IPNet) net.IPNet {
+	ip := network.IP
+	mask := network.Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+	}
+	return net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(ip)
+}
+
+func intToIP(i *big.Int, size int) net.IP {
+	ip := make(net.IP, size)
+	b := i.Bytes()
+	copy(ip[size-len(b):], b)
+	return ip
+}
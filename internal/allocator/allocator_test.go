@@ -0,0 +1,163 @@
+package allocator
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+	"testing/quick"
+)
+
+func mustParseCIDR(t *testing.T, s string) net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *network
+}
+
+func TestParsePool(t *testing.T) {
+	tests := []struct {
+		pool      string
+		prefixLen int
+		ok        bool
+	}{
+		{"10.100.0.0/16", IPv4PrefixLen, true},
+		{"10.100.0.0/24", IPv4PrefixLen, true},
+		{"fd12:3456:789a::/48", IPv6PrefixLen, true},
+		{"10.100.0.0/25", 0, false},
+		{"10.100.1.0/16", 0, false},
+		{"2001:db8::/48", 0, false},
+		{"fd12:3456:789a::/65", 0, false},
+		{"nope", 0, false},
+	}
+	for _, tt := range tests {
+		_, prefixLen, err := ParsePool(tt.pool)
+		if (err == nil) != tt.ok || prefixLen != tt.prefixLen {
+			t.Errorf("ParsePool(%q) = %d, %v", tt.pool, prefixLen, err)
+		}
+	}
+
+	ula, err := GenerateULA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, prefixLen, err := ParsePool(ula.String())
+	if err != nil || prefixLen != IPv6PrefixLen || network.String() != ula.String() {
+		t.Errorf("ParsePool(%q) = %s, %d, %v", ula.String(), network.String(), prefixLen, err)
+	}
+}
+
+// randomNetwork returns a random network with a prefix length between minOnes and maxOnes, inside the provided network
+func randomNetwork(r *rand.Rand, parent net.IPNet, minOnes int, maxOnes int) net.IPNet {
+	_, bits := parent.Mask.Size()
+	ip := make(net.IP, len(parent.IP))
+	r.Read(ip)
+	for i := range ip {
+		ip[i] = parent.IP[i] | (ip[i] &^ parent.Mask[i])
+	}
+	mask := net.CIDRMask(minOnes+r.Intn(maxOnes-minOnes+1), bits)
+	return net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// checkAllocations reserves and excludes random networks in the pool, and then allocates networks until the pool is
+// exhausted, checking that they are inside the pool and don't overlap any used network
+func checkAllocations(t *testing.T, pool string, seed int64) bool {
+	r := rand.New(rand.NewSource(seed))
+	alloc, err := New(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poolNet := alloc.Pool()
+	ones, bits := poolNet.Mask.Size()
+	around := net.IPNet{IP: poolNet.IP, Mask: net.CIDRMask(ones-4, bits)}
+
+	used := []net.IPNet{}
+	reserved := r.Intn(6)
+	for i := 0; i < reserved; i++ {
+		network := randomNetwork(r, around, ones-2, alloc.prefixLen+4)
+		if alloc.Reserve(network) == nil {
+			used = append(used, network)
+		}
+	}
+	excluded := r.Intn(6)
+	for i := 0; i < excluded; i++ {
+		network := randomNetwork(r, around, ones-2, bits)
+		alloc.Exclude(network)
+		used = append(used, network)
+	}
+
+	for count := 0; count <= 1<<uint(alloc.prefixLen-ones); count++ {
+		network, err := alloc.Allocate()
+		if err == ErrExhausted {
+			return true
+		}
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		networkOnes, _ := network.Mask.Size()
+		if !poolNet.Contains(network.IP) || networkOnes != alloc.prefixLen {
+			t.Errorf("Network %s allocated outside pool %s", network.String(), poolNet.String())
+			return false
+		}
+		for _, u := range used {
+			if Overlaps(u, network) {
+				t.Errorf("Network %s overlaps used network %s", network.String(), u.String())
+				return false
+			}
+		}
+		used = append(used, network)
+	}
+	t.Errorf("Pool %s was not exhausted", poolNet.String())
+	return false
+}
+
+func TestAllocate(t *testing.T) {
+	for _, pool := range []string{"10.100.0.0/20", "10.100.0.0/24", "fd12:3456:789a:ff00::/60", "fd00::/62"} {
+		err := quick.Check(func(seed int64) bool { return checkAllocations(t, pool, seed) }, nil)
+		if err != nil {
+			t.Errorf("Pool %s: %v", pool, err)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	alloc, err := New("10.100.0.0/23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := alloc.Allocate()
+	second, _ := alloc.Allocate()
+	if first.String() != "10.100.0.0/24" || second.String() != "10.100.1.0/24" {
+		t.Fatal(first.String(), second.String())
+	}
+	if _, err := alloc.Allocate(); err != ErrExhausted {
+		t.Fatal("Expected ErrExhausted, got", err)
+	}
+	if alloc.Reserve(mustParseCIDR(t, "10.100.1.128/25")) == nil {
+		t.Fatal("Reserving an overlapping network should fail")
+	}
+
+	alloc.Release(first)
+	again, err := alloc.Allocate()
+	if err != nil || again.String() != first.String() {
+		t.Fatal(again.String(), err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	network := net.IPNet{IP: net.ParseIP("10.100.1.7"), Mask: net.CIDRMask(120, 128)}
+	if len(network.IP) != net.IPv6len {
+		t.Fatal("Expected a 16 byte IPv4 address")
+	}
+	normalized := normalize(network)
+	if len(normalized.IP) != net.IPv4len || len(normalized.Mask) != net.IPv4len || normalized.String() != "10.100.1.0/24" {
+		t.Fatal(normalized.String())
+	}
+	if !Overlaps(network, mustParseCIDR(t, "10.100.0.0/16")) {
+		t.Fatal("16 byte and 4 byte IPv4 networks should overlap")
+	}
+	if Overlaps(mustParseCIDR(t, "::/0"), mustParseCIDR(t, "10.0.0.0/8")) {
+		t.Fatal("IPv4 and IPv6 networks should not overlap")
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 )
 
 // Type represents a specific cloud (AWS, GCP, DigitalOcean etc.)
@@ -33,9 +35,36 @@ func SupportedProviders() []string {
 
 // ProviderInfo stores information about a cloud provider
 type ProviderInfo struct {
-	Name string `storm:"id"`
-	Type Type
-	Auth map[string]string
+	Name          string `storm:"id"`
+	Type          Type
+	Auth          map[string]string
+	SecretBackend string // spec of the backend storing the credentials. Auth is empty in the DB if set
+}
+
+// Seal returns a copy of the provider info with the credentials encrypted using the provided function
+func (pi ProviderInfo) Seal(seal func([]byte) ([]byte, error)) (interface{}, error) {
+	sealed := pi
+	sealed.Auth = map[string]string{}
+	for name, value := range pi.Auth {
+		sealedValue, err := seal([]byte(value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to encrypt credentials of cloud '%s'", pi.Name)
+		}
+		sealed.Auth[name] = string(sealedValue)
+	}
+	return &sealed, nil
+}
+
+// Unseal decrypts the credentials of the provider info using the provided function
+func (pi *ProviderInfo) Unseal(open func([]byte) ([]byte, error)) error {
+	for name, value := range pi.Auth {
+		plain, err := open([]byte(value))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to decrypt credentials of cloud '%s'", pi.Name)
+		}
+		pi.Auth[name] = string(plain)
+	}
+	return nil
 }
 
 // Client returns a cloud provider client that can be used to run all the operations exposed by the Provider interface
@@ -52,7 +81,9 @@ type InstanceInfo struct {
 	VMID          string
 	Name          string `storm:"id"`
 	KeySeed       []byte // private SSH key stored only on the client
+	AgentKey      []byte // public half of the ssh-agent key used instead of KeySeed, in SSH wire format
 	PublicKey     []byte // public key used for wireguard connection
+	HostKey       []byte // SSH host key of the instance, pinned on first connection
 	PublicIP      string
 	InternalIP    string
 	CloudType     Type
@@ -61,6 +92,46 @@ type InstanceInfo struct {
 	Network       string
 	ProtosVersion string
 	Volumes       []VolumeInfo
+	SSH           SSHInfo
+}
+
+// SSHInfo holds the settings used to connect to an instance over SSH. Empty values fall back to the defaults
+type SSHInfo struct {
+	User         string
+	Port         int
+	Timeout      int // seconds
+	JumpHosts    []SSHJumpHost
+	ProxyCommand string
+}
+
+// SSHJumpHost is a bastion host used to reach an instance
+type SSHJumpHost struct {
+	Host         string
+	Port         int
+	User         string
+	IdentityFile string // private key used for the jump host. The instance key is used if empty
+	HostKey      []byte // SSH host key of the jump host, pinned on first connection
+}
+
+// Seal returns a copy of the instance info with the SSH key encrypted using the provided function
+func (ii InstanceInfo) Seal(seal func([]byte) ([]byte, error)) (interface{}, error) {
+	sealed := ii
+	var err error
+	sealed.KeySeed, err = seal(ii.KeySeed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to encrypt SSH key of instance '%s'", ii.Name)
+	}
+	return &sealed, nil
+}
+
+// Unseal decrypts the SSH key of the instance info using the provided function
+func (ii *InstanceInfo) Unseal(open func([]byte) ([]byte, error)) error {
+	var err error
+	ii.KeySeed, err = open(ii.KeySeed)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to decrypt SSH key of instance '%s'", ii.Name)
+	}
+	return nil
 }
 
 // VolumeInfo holds information about a data volume
@@ -103,6 +174,7 @@ type Provider interface {
 	StartInstance(id string, location string) error
 	StopInstance(id string, location string) error
 	GetInstanceInfo(id string, location string) (InstanceInfo, error)
+	UpdateInstanceKey(name string, pubKey string) error // replaces the SSH key stored by the cloud provider for an instance
 	// Image methods
 	GetImages() (images map[string]ImageInfo, err error)
 	GetProtosImages() (images map[string]ImageInfo, err error)
@@ -117,6 +189,36 @@ type Provider interface {
 	DettachVolume(volumeID string, instanceID string, location string) error
 }
 
+// ErrNoHostKeys is returned by HostKeyProvider when the instance has not published its host keys (yet)
+var ErrNoHostKeys = errors.New("The instance has not published its SSH host keys")
+
+// HostKeyProvider is implemented by the cloud providers which can retrieve the SSH host keys of an instance using their
+// API, so the keys can be pinned before the first connection instead of trusting the first key presented
+type HostKeyProvider interface {
+	GetHostKeys(id string, location string) ([]ssh.PublicKey, error)
+}
+
+// parseHostKeys parses host keys published by an instance, one per line in the authorized_keys format. Blank lines and
+// comments are skipped, and ErrNoHostKeys is returned if there are no keys
+func parseHostKeys(data []byte) ([]ssh.PublicKey, error) {
+	keys := []ssh.PublicKey{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoHostKeys
+	}
+	return keys, nil
+}
+
 // NewProvider creates a new cloud provider client
 func NewProvider(cloudName string, cloud string) (Provider, error) {
 	var client Provider
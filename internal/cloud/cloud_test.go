@@ -0,0 +1,39 @@
+package cloud
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseHostKeys(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+
+	keys, err := parseHostKeys([]byte("# host keys\n\n  " + authorizedKey + " root@protos\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || string(keys[0].Marshal()) != string(key.Marshal()) {
+		t.Fatalf("Expected the published key, got %d key(s)", len(keys))
+	}
+
+	for _, data := range []string{"", "\n\n", "# no keys yet\n# still booting\n"} {
+		if _, err := parseHostKeys([]byte(data)); err != ErrNoHostKeys {
+			t.Errorf("parseHostKeys(%q) = %v, expected ErrNoHostKeys", data, err)
+		}
+	}
+	if _, err := parseHostKeys([]byte("# comment\nnot a key\n")); err == nil || err == ErrNoHostKeys {
+		t.Errorf("Expected a parse error, got %v", err)
+	}
+}
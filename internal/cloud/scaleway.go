@@ -5,6 +5,8 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"strings"
 
@@ -22,6 +24,9 @@ import (
 const (
 	scalewayArch = "x86_64"
 	uploadSSHkey = "protos-upload-key"
+	// hostKeysUserData is the user data key where the instance publishes its SSH host keys at boot, in the
+	// authorized_keys format, using the Scaleway metadata API
+	hostKeysUserData = "ssh-host-keys"
 )
 
 type scalewayCredentials struct {
@@ -146,16 +151,11 @@ func (sw *scaleway) deleteSSHkey(name string) error {
 	return errors.Errorf("Could not find an SSH key named '%s'", name)
 }
 
-// NewInstance creates a new Protos instance on Scaleway
-func (sw *scaleway) NewInstance(name string, imageID string, pubKey string, machineType string, location string) (string, error) {
-
-	//
-	// create SSH key
-	//
-
+// createSSHKey adds an SSH key named after the instance to the Scaleway account, replacing any existing key with the same name
+func (sw *scaleway) createSSHKey(name string, pubKey string) error {
 	keysResp, err := sw.accountAPI.ListSSHKeys(&account.ListSSHKeysRequest{})
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to get SSH keys")
+		return errors.Wrap(err, "Failed to get SSH keys")
 	}
 	for _, k := range keysResp.SSHKeys {
 		if k.Name == name {
@@ -167,7 +167,21 @@ func (sw *scaleway) NewInstance(name string, imageID string, pubKey string, mach
 	pubKey = strings.TrimSuffix(pubKey, "\n") + " root@protos.io"
 	_, err = sw.accountAPI.CreateSSHKey(&account.CreateSSHKeyRequest{Name: name, OrganizationID: sw.credentials.organisationID, PublicKey: pubKey})
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to add SSH key for instance")
+		return errors.Wrap(err, "Failed to add SSH key for instance")
+	}
+	return nil
+}
+
+// NewInstance creates a new Protos instance on Scaleway
+func (sw *scaleway) NewInstance(name string, imageID string, pubKey string, machineType string, location string) (string, error) {
+
+	//
+	// create SSH key
+	//
+
+	err := sw.createSSHKey(name, pubKey)
+	if err != nil {
+		return "", err
 	}
 
 	//
@@ -225,6 +239,12 @@ func (sw *scaleway) DeleteInstance(id string, location string) error {
 	return nil
 }
 
+// UpdateInstanceKey replaces the account SSH key of an instance. Scaleway only uses account keys when a server boots
+// for the first time, so this doesn't change the keys authorized on the instance itself
+func (sw *scaleway) UpdateInstanceKey(name string, pubKey string) error {
+	return sw.createSSHKey(name, pubKey)
+}
+
 func (sw *scaleway) StartInstance(id string, location string) error {
 	startReq := &instance.ServerActionAndWaitRequest{
 		ServerID: id,
@@ -266,6 +286,32 @@ func (sw *scaleway) GetInstanceInfo(id string, location string) (InstanceInfo, e
 	return info, nil
 }
 
+// GetHostKeys returns the SSH host keys published by the instance in its user data
+func (sw *scaleway) GetHostKeys(id string, location string) ([]gssh.PublicKey, error) {
+	reader, err := sw.instanceAPI.GetServerUserData(&instance.GetServerUserDataRequest{ServerID: id, Zone: scw.Zone(location), Key: hostKeysUserData})
+	if err != nil {
+		if _, ok := err.(*scw.ResourceNotFoundError); ok {
+			return nil, ErrNoHostKeys
+		}
+		if respErr, ok := err.(*scw.ResponseError); ok && respErr.StatusCode == http.StatusNotFound {
+			return nil, ErrNoHostKeys
+		}
+		return nil, errors.Wrapf(err, "Failed to retrieve the SSH host keys of Scaleway instance (%s)", id)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to retrieve the SSH host keys of Scaleway instance (%s)", id)
+	}
+
+	keys, err := parseHostKeys(data)
+	if err == ErrNoHostKeys {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse the SSH host keys of Scaleway instance (%s)", id)
+	}
+	return keys, nil
+}
+
 //
 // Images methods
 //
@@ -360,7 +406,8 @@ func (sw *scaleway) AddImage(url string, hash string, version string, location s
 
 	log.Info("Trying to connect to Scaleway upload instance over SSH")
 
-	sshClient, err := ssh.NewConnection(srv.PublicIP.Address.String(), "root", key.SSHAuth(), 10)
+	sshConfig := ssh.ConnectionConfig{Host: srv.PublicIP.Address.String(), User: "root", Auth: key.SSHAuth(), HostKeyCallback: ssh.PinnedHostKey(nil, nil)}
+	sshClient, err := ssh.NewConnection(sshConfig, 10)
 	if err != nil {
 		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway. Failed to deploy VM to Scaleway")
 	}
@@ -515,15 +562,17 @@ func (sw *scaleway) UploadLocalImage(imagePath string, imageName string, locatio
 		return "", errors.Wrap(err, errMsg)
 	}
 
-	sshConfig := &gssh.ClientConfig{
+	// the upload VM is short lived, so its host key is trusted on first use and then verified for the rest of the upload
+	hostKeyCallback := ssh.PinnedHostKey(nil, nil)
+	scpConfig := &gssh.ClientConfig{
 		User: "root",
 		Auth: []gssh.AuthMethod{
 			key.SSHAuth(),
 		},
-		HostKeyCallback: gssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
 	}
 
-	client := scp.NewClient(srv.PublicIP.Address.String()+":22", sshConfig)
+	client := scp.NewClient(srv.PublicIP.Address.String()+":22", scpConfig)
 	log.Infof("Connecting via SSH and starting SCP transfer to '%s'", srv.PublicIP.Address.String()+":22")
 	err = client.Connect()
 	if err != nil {
@@ -550,7 +599,8 @@ func (sw *scaleway) UploadLocalImage(imagePath string, imageName string, locatio
 
 	log.Info("Trying to connect to Scaleway upload instance over SSH")
 
-	sshClient, err := ssh.NewConnection(srv.PublicIP.Address.String(), "root", key.SSHAuth(), 10)
+	sshConfig := ssh.ConnectionConfig{Host: srv.PublicIP.Address.String(), User: "root", Auth: key.SSHAuth(), HostKeyCallback: hostKeyCallback}
+	sshClient, err := ssh.NewConnection(sshConfig, 10)
 	if err != nil {
 		return "", errors.Wrap(err, errMsg+". Failed to deploy VM to Scaleway")
 	}
@@ -0,0 +1,346 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"reflect"
+
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/keyring"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// EncryptionMode indicates how the key used to encrypt the secrets in the DB is obtained
+type EncryptionMode string
+
+const (
+	// EncryptionNone means the secrets are stored in plaintext
+	EncryptionNone = EncryptionMode("")
+	// EncryptionPassphrase means the key is derived from a passphrase using argon2id
+	EncryptionPassphrase = EncryptionMode("passphrase")
+	// EncryptionKeyring means a random key is stored in the OS keyring
+	EncryptionKeyring = EncryptionMode("keyring")
+
+	sealedPrefix = "protos-sealed-v1:"
+	metaBucket   = "meta"
+	keyringName  = "protos-cli"
+
+	// argon2id parameters
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+)
+
+// checkValue is sealed and stored with the encryption info, to detect a wrong passphrase
+var checkValue = []byte("protos")
+
+// encryptionInfo is stored in the meta bucket and describes how the secrets in the DB are encrypted
+type encryptionInfo struct {
+	Mode  EncryptionMode
+	Salt  []byte // argon2id salt, for passphrase encryption
+	KeyID string // name of the key in the OS keyring, for keyring encryption
+	Check []byte
+}
+
+// cipher seals and opens secrets using a symmetric key. A nil cipher leaves the secrets untouched
+type cipher struct {
+	key [32]byte
+}
+
+func deriveKey(passphrase string, salt []byte) *cipher {
+	c := &cipher{}
+	copy(c.key[:], argon2.IDKey([]byte(passphrase), salt, kdfTime, kdfMemory, kdfThreads, 32))
+	return c
+}
+
+func randomKey() (*cipher, error) {
+	c := &cipher{}
+	_, err := io.ReadFull(rand.Reader, c.key[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate encryption key")
+	}
+	return c, nil
+}
+
+// isSealed returns true if the provided value was produced by seal
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealedPrefix))
+}
+
+// seal encrypts a secret. Empty values are left empty, so that missing secrets can still be detected
+func (c *cipher) seal(data []byte) ([]byte, error) {
+	if c == nil || len(data) == 0 || isSealed(data) {
+		return data, nil
+	}
+	var nonce [24]byte
+	_, err := io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate nonce")
+	}
+	box := secretbox.Seal(nonce[:], data, &nonce, &c.key)
+	return []byte(sealedPrefix + base64.StdEncoding.EncodeToString(box)), nil
+}
+
+// open decrypts a secret. Plaintext values are returned unchanged, which allows reading DBs that are not encrypted yet
+func (c *cipher) open(data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, errors.New("Database secrets are encrypted, but the database is locked")
+	}
+	box, err := base64.StdEncoding.DecodeString(string(data[len(sealedPrefix):]))
+	if err != nil || len(box) < 24 {
+		return nil, errors.New("Failed to decrypt secret: invalid format")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box[:24])
+	plain, ok := secretbox.Open(nil, box[24:], &nonce, &c.key)
+	if !ok {
+		return nil, errors.New("Failed to decrypt secret: wrong key")
+	}
+	return plain, nil
+}
+
+// Sealable is implemented by records which contain secrets. Seal returns a copy of the record with the secrets
+// encrypted by the provided function, while Unseal decrypts the secrets in place
+type Sealable interface {
+	Seal(seal func([]byte) ([]byte, error)) (interface{}, error)
+	Unseal(open func([]byte) ([]byte, error)) error
+}
+
+//
+// DB encryption methods
+//
+
+func (db *dbprotos) keyringAccount(keyID string) string {
+	return db.path + ":" + keyID
+}
+
+// loadEncryption reads the encryption info of the DB. Keyring encrypted DBs are unlocked right away
+func (db *dbprotos) loadEncryption() error {
+	err := db.s.Get(metaBucket, "encryption", &db.encryption)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			db.encryption = encryptionInfo{Mode: EncryptionNone}
+			return nil
+		}
+		return errors.Wrap(err, "Failed to read database encryption info")
+	}
+
+	if db.encryption.Mode == EncryptionKeyring {
+		encodedKey, err := keyring.Get(keyringName, db.keyringAccount(db.encryption.KeyID))
+		if err != nil {
+			return errors.Wrap(err, "Failed to retrieve the database encryption key from the OS keyring")
+		}
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil || len(key) != 32 {
+			return errors.New("Invalid database encryption key found in the OS keyring")
+		}
+		c := &cipher{}
+		copy(c.key[:], key)
+		return db.setCipher(c)
+	}
+	return nil
+}
+
+// setCipher verifies that the cipher can decrypt the check value, and then uses it for all the secrets
+func (db *dbprotos) setCipher(c *cipher) error {
+	check, err := c.open(db.encryption.Check)
+	if err != nil || !bytes.Equal(check, checkValue) {
+		return errors.New("Wrong database encryption key")
+	}
+	db.cipher = c
+	return nil
+}
+
+// save writes a record using the provided node, encrypting its secrets with the provided cipher
+func (db *dbprotos) save(node storm.Node, c *cipher, data interface{}) error {
+	if db.encryption.Mode != EncryptionNone && c == nil {
+		return errors.New("Database secrets are encrypted, but the database is locked")
+	}
+	if sealable, ok := data.(Sealable); ok {
+		sealed, err := sealable.Seal(c.seal)
+		if err != nil {
+			return err
+		}
+		return node.Save(sealed)
+	}
+	return node.Save(data)
+}
+
+// unseal decrypts the secrets of a record, or of a slice of records, after they are read from the DB
+func (db *dbprotos) unseal(to interface{}) error {
+	if sealable, ok := to.(Sealable); ok {
+		return sealable.Unseal(db.cipher.open)
+	}
+	v := reflect.ValueOf(to)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil
+	}
+	slice := v.Elem()
+	for i := 0; i < slice.Len(); i++ {
+		if sealable, ok := slice.Index(i).Addr().Interface().(Sealable); ok {
+			err := sealable.Unseal(db.cipher.open)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Encryption returns the encryption mode of the DB
+func (db *dbprotos) Encryption() EncryptionMode {
+	return db.encryption.Mode
+}
+
+// Unlock derives the encryption key from the passphrase. It does nothing for DBs that are not passphrase encrypted
+func (db *dbprotos) Unlock(passphrase string) error {
+	if db.encryption.Mode != EncryptionPassphrase {
+		return nil
+	}
+	err := db.setCipher(deriveKey(passphrase, db.encryption.Salt))
+	if err != nil {
+		return errors.New("Wrong database passphrase")
+	}
+	return nil
+}
+
+// Rekey re-encrypts all the secrets in the DB using a new key, obtained according to the provided mode. Besides clouds
+// and instances, the records in the DB which contain secrets have to be provided as pointers to slices of Sealable
+// records (e.g. &[]user.Info{}). All the records are rewritten in a single transaction
+func (db *dbprotos) Rekey(mode EncryptionMode, passphrase string, records ...interface{}) error {
+	if db.encryption.Mode != EncryptionNone && db.cipher == nil {
+		return errors.New("Database secrets are encrypted, but the database is locked")
+	}
+
+	// read all the records using the current key
+	clouds, err := db.GetAllClouds()
+	if err != nil {
+		return errors.Wrap(err, "Failed to read clouds")
+	}
+	instances, err := db.GetAllInstances()
+	if err != nil {
+		return errors.Wrap(err, "Failed to read instances")
+	}
+	for _, rec := range records {
+		err = db.All(rec)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read records")
+		}
+	}
+
+	// create the new key
+	info := encryptionInfo{Mode: mode}
+	var newCipher *cipher
+	switch mode {
+	case EncryptionNone:
+	case EncryptionPassphrase:
+		if passphrase == "" {
+			return errors.New("Passphrase can't be empty")
+		}
+		info.Salt = make([]byte, 16)
+		_, err = io.ReadFull(rand.Reader, info.Salt)
+		if err != nil {
+			return errors.Wrap(err, "Failed to generate salt")
+		}
+		newCipher = deriveKey(passphrase, info.Salt)
+	case EncryptionKeyring:
+		newCipher, err = randomKey()
+		if err != nil {
+			return err
+		}
+		keyID := make([]byte, 8)
+		_, err = io.ReadFull(rand.Reader, keyID)
+		if err != nil {
+			return errors.Wrap(err, "Failed to generate key ID")
+		}
+		info.KeyID = hex.EncodeToString(keyID)
+		// the new key is stored under a new name, so the old key stays usable if the transaction fails
+		err = keyring.Set(keyringName, db.keyringAccount(info.KeyID), base64.StdEncoding.EncodeToString(newCipher.key[:]))
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("Unknown encryption mode '%s'", mode)
+	}
+	if newCipher != nil {
+		info.Check, err = newCipher.seal(checkValue)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.rewrite(newCipher, info, clouds, instances, records)
+	if err != nil {
+		if mode == EncryptionKeyring {
+			keyring.Delete(keyringName, db.keyringAccount(info.KeyID))
+		}
+		return errors.Wrap(err, "Failed to re-encrypt database")
+	}
+
+	if db.encryption.Mode == EncryptionKeyring {
+		err = keyring.Delete(keyringName, db.keyringAccount(db.encryption.KeyID))
+		if err != nil {
+			return errors.Wrap(err, "Database re-encrypted, but the old key could not be removed from the OS keyring")
+		}
+	}
+	db.encryption = info
+	db.cipher = newCipher
+	return nil
+}
+
+// rewrite saves all the records and the encryption info in a single transaction
+func (db *dbprotos) rewrite(c *cipher, info encryptionInfo, clouds []cloud.ProviderInfo, instances []cloud.InstanceInfo, records []interface{}) error {
+	tx, err := db.s.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// saving with the new mode set, so that save doesn't refuse a nil cipher when decrypting
+	oldInfo := db.encryption
+	db.encryption = info
+	defer func() { db.encryption = oldInfo }()
+
+	for i := range clouds {
+		err = db.save(tx, c, &clouds[i])
+		if err != nil {
+			return err
+		}
+	}
+	for i := range instances {
+		err = db.save(tx, c, &instances[i])
+		if err != nil {
+			return err
+		}
+	}
+	for _, rec := range records {
+		slice := reflect.ValueOf(rec).Elem()
+		for i := 0; i < slice.Len(); i++ {
+			err = db.save(tx, c, slice.Index(i).Addr().Interface())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if info.Mode == EncryptionNone {
+		if oldInfo.Mode != EncryptionNone {
+			err = tx.Delete(metaBucket, "encryption")
+		}
+	} else {
+		err = tx.Set(metaBucket, "encryption", info)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -2,16 +2,31 @@ package db
 
 import (
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/asdine/storm"
 	"github.com/pkg/errors"
 	"github.com/protosio/cli/internal/cloud"
+	bolt "go.etcd.io/bbolt"
 )
 
 var dbi DB
 
+// ErrNotFound is returned when a record doesn't exist in the DB
+var ErrNotFound = storm.ErrNotFound
+
+// primaryInstanceKey is the key in the meta bucket that holds the name of the primary instance
+const primaryInstanceKey = "primaryInstance"
+
 type dbprotos struct {
-	s *storm.DB
+	s          *storm.DB
+	tx         storm.Node // set for the DBs passed to Update, so all the reads and writes use the transaction
+	path       string
+	encryption encryptionInfo
+	cipher     *cipher
+	readOnly   bool
+	closed     bool
 }
 
 // DB represents a DB client instance, used to interract with the database
@@ -24,16 +39,34 @@ type DB interface {
 	DeleteInstance(name string) error
 	GetInstance(name string) (cloud.InstanceInfo, error)
 	GetAllInstances() ([]cloud.InstanceInfo, error)
+	SetPrimaryInstance(name string) error
+	GetPrimaryInstance() (string, error)
 
 	// generalized
 	// Save writes a new value for a specific key in a bucket
 	Save(data interface{}) error
 	All(to interface{}) error
+	Delete(data interface{}) error
+	// Update runs fn with a DB whose reads and writes are part of a single transaction, which is committed if fn
+	// returns nil and rolled back otherwise
+	Update(fn func(tx DB) error) error
 	Close() error
+
+	// encryption
+	Encryption() EncryptionMode
+	Unlock(passphrase string) error
+	Rekey(mode EncryptionMode, passphrase string, records ...interface{}) error
+}
+
+// Options control how the DB is opened
+type Options struct {
+	ReadOnly bool          // open the DB with a shared lock, which allows other read-only opens
+	Timeout  time.Duration // how long to wait for the DB lock. Zero waits forever
+	Command  string        // command that is running, shown to other processes waiting for the DB
 }
 
 // Init creates a new local database used by the Protos client
-func initDB(protosDir string, protosDB string) (*storm.DB, error) {
+func initDB(protosDir string, protosDB string, opts Options) (*storm.DB, error) {
 	dbPath := protosDir + protosDB
 
 	dirInfo, err := os.Stat(protosDir)
@@ -52,33 +85,82 @@ func initDB(protosDir string, protosDB string) (*storm.DB, error) {
 		}
 	}
 
-	db, err := storm.Open(dbPath)
+	// a new DB can't be created in read only mode
+	opts.ReadOnly = false
+	return openStorm(dbPath, opts)
+}
+
+// openStorm opens the DB file, waiting at most opts.Timeout for the lock held by other processes
+func openStorm(dbPath string, opts Options) (*storm.DB, error) {
+	db, err := storm.Open(dbPath, storm.BoltOptions(0600, &bolt.Options{Timeout: opts.Timeout, ReadOnly: opts.ReadOnly}))
 	if err != nil {
-		return nil, err
+		if err == bolt.ErrTimeout {
+			return nil, inUseError(dbPath)
+		}
+		return nil, errors.Wrapf(err, "Failed to open database '%s'", dbPath)
+	}
+	if !opts.ReadOnly {
+		err = writeOwner(dbPath, opts.Command)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 	return db, nil
-
 }
 
 // Open tries to open a client for the db on the provided path
-func Open(protosDir string, protosDB string) (DB, error) {
+func Open(protosDir string, protosDB string, opts Options) (DB, error) {
 	dbPath := protosDir + protosDB
-	db := &dbprotos{}
+	db := &dbprotos{readOnly: opts.ReadOnly}
 	var dbg *storm.DB
+	newDB := false
 
 	_, err := os.Stat(dbPath)
 	if err == nil {
-		dbg, err = storm.Open(dbPath)
+		dbg, err = openStorm(dbPath, opts)
 		if err != nil {
 			return nil, err
 		}
 	} else if os.IsNotExist(err) {
-		dbg, err = initDB(protosDir, protosDB)
+		dbg, err = initDB(protosDir, protosDB, opts)
+		if err != nil {
+			return nil, err
+		}
+		newDB = true
+		db.readOnly = false
 	} else {
 		return db, errors.Wrapf(err, "Failed to stat path '%s'", dbPath)
 	}
 
 	db.s = dbg
+	db.path, _ = filepath.Abs(dbPath)
+
+	// migrations need to write, so read only DBs are reopened for writing when the schema is outdated
+	if db.readOnly {
+		version, err := db.schemaVersion()
+		if err != nil || version < SchemaVersion() {
+			dbg.Close()
+			opts.ReadOnly = false
+			db.readOnly = false
+			dbg, err = openStorm(dbPath, opts)
+			if err != nil {
+				return nil, err
+			}
+			db.s = dbg
+		}
+	}
+
+	err = db.migrate(newDB)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = db.loadEncryption()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 	return db, nil
 }
 
@@ -86,38 +168,78 @@ func Open(protosDir string, protosDB string) (DB, error) {
 // db storm methods for implementing the DB interface
 //
 
+// node returns the storm node used for reads and writes: the transaction inside Update, and the DB otherwise
+func (db *dbprotos) node() storm.Node {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.s
+}
+
+// Update runs fn inside a read-write transaction. Calls nested in another Update reuse the outer transaction
+func (db *dbprotos) Update(fn func(tx DB) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	tx, err := db.s.Begin(true)
+	if err != nil {
+		return errors.Wrap(err, "Failed to start database transaction")
+	}
+	defer tx.Rollback()
+
+	txdb := *db
+	txdb.tx = tx
+	err = fn(&txdb)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "Failed to commit database transaction")
+	}
+	return nil
+}
+
 // Save writes a new value for a specific key in a bucket
 func (db *dbprotos) Save(data interface{}) error {
-	return db.s.Save(data)
+	return db.save(db.node(), db.cipher, data)
 }
 
 // One retrieves one record from the database based on the field name
 func (db *dbprotos) One(fieldName string, value interface{}, to interface{}) error {
-	return db.s.One(fieldName, value, to)
+	err := db.node().One(fieldName, value, to)
+	if err != nil {
+		return err
+	}
+	return db.unseal(to)
 }
 
 // All retrieves all records for a specific type
 func (db *dbprotos) All(to interface{}) error {
-	return db.s.All(to)
+	err := db.node().All(to)
+	if err != nil {
+		return err
+	}
+	return db.unseal(to)
 }
 
 // Delete removes a record of specific type
 func (db *dbprotos) Delete(data interface{}) error {
-	return db.s.DeleteStruct(data)
+	return db.node().DeleteStruct(data)
 }
 
 func (db *dbprotos) SaveCloud(cloud cloud.ProviderInfo) error {
-	return db.s.Save(&cloud)
+	return db.Save(&cloud)
 }
 
 func (db *dbprotos) DeleteCloud(name string) error {
 	cp := cloud.ProviderInfo{}
-	err := db.s.One("Name", name, &cp)
+	err := db.node().One("Name", name, &cp)
 	if err != nil {
 		return err
 	}
 
-	err = db.s.Delete("ProviderInfo", name)
+	err = db.node().Delete("ProviderInfo", name)
 	if err != nil {
 		return err
 	}
@@ -126,7 +248,7 @@ func (db *dbprotos) DeleteCloud(name string) error {
 
 func (db *dbprotos) GetCloud(name string) (cloud.ProviderInfo, error) {
 	cp := cloud.ProviderInfo{}
-	err := db.s.One("Name", name, &cp)
+	err := db.One("Name", name, &cp)
 	if err != nil {
 		return cp, err
 	}
@@ -135,7 +257,7 @@ func (db *dbprotos) GetCloud(name string) (cloud.ProviderInfo, error) {
 
 func (db *dbprotos) GetAllClouds() ([]cloud.ProviderInfo, error) {
 	cps := []cloud.ProviderInfo{}
-	err := db.s.All(&cps)
+	err := db.All(&cps)
 	if err != nil {
 		return cps, err
 	}
@@ -143,17 +265,17 @@ func (db *dbprotos) GetAllClouds() ([]cloud.ProviderInfo, error) {
 }
 
 func (db *dbprotos) SaveInstance(instance cloud.InstanceInfo) error {
-	return db.s.Save(&instance)
+	return db.Save(&instance)
 }
 
 func (db *dbprotos) DeleteInstance(name string) error {
 	instance := cloud.InstanceInfo{}
-	err := db.s.One("Name", name, &instance)
+	err := db.node().One("Name", name, &instance)
 	if err != nil {
 		return err
 	}
 
-	err = db.s.Delete("InstanceInfo", name)
+	err = db.node().Delete("InstanceInfo", name)
 	if err != nil {
 		return err
 	}
@@ -162,7 +284,7 @@ func (db *dbprotos) DeleteInstance(name string) error {
 
 func (db *dbprotos) GetInstance(name string) (cloud.InstanceInfo, error) {
 	instance := cloud.InstanceInfo{}
-	err := db.s.One("Name", name, &instance)
+	err := db.One("Name", name, &instance)
 	if err != nil {
 		return instance, err
 	}
@@ -171,13 +293,46 @@ func (db *dbprotos) GetInstance(name string) (cloud.InstanceInfo, error) {
 
 func (db *dbprotos) GetAllInstances() ([]cloud.InstanceInfo, error) {
 	instances := []cloud.InstanceInfo{}
-	err := db.s.All(&instances)
+	err := db.All(&instances)
 	if err != nil {
 		return instances, err
 	}
 	return instances, nil
 }
 
+// SetPrimaryInstance records the instance which serves DNS for the user domain. An empty name clears it
+func (db *dbprotos) SetPrimaryInstance(name string) error {
+	if name == "" {
+		err := db.node().Delete(metaBucket, primaryInstanceKey)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	return db.node().Set(metaBucket, primaryInstanceKey, name)
+}
+
+// GetPrimaryInstance returns the name of the primary instance, or an empty string if none was set
+func (db *dbprotos) GetPrimaryInstance() (string, error) {
+	name := ""
+	err := db.node().Get(metaBucket, primaryInstanceKey, &name)
+	if err != nil && err != storm.ErrNotFound {
+		return "", errors.Wrap(err, "Failed to read the primary instance")
+	}
+	return name, nil
+}
+
+// Close releases the DB. It can be called more than once, so long running commands can release the DB early
 func (db *dbprotos) Close() error {
+	if db.tx != nil {
+		return errors.New("Database can't be closed inside a transaction")
+	}
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	if !db.readOnly {
+		removeOwner(db.path)
+	}
 	return db.s.Close()
 }
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BoltDB holds an exclusive file lock on the DB while it is open for writing. The process holding the lock records
+// itself in an owner file next to the DB, so that other processes can tell the user what is blocking them
+
+// owner describes the process which has the DB open for writing
+type owner struct {
+	PID     int
+	Command string
+	Since   time.Time
+}
+
+func ownerPath(dbPath string) string {
+	return dbPath + ".owner"
+}
+
+func writeOwner(dbPath string, command string) error {
+	data, err := json.Marshal(owner{PID: os.Getpid(), Command: command, Since: time.Now()})
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode database owner")
+	}
+	err = ioutil.WriteFile(ownerPath(dbPath), data, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write database owner")
+	}
+	return nil
+}
+
+// removeOwner deletes the owner file, if it still belongs to the current process
+func removeOwner(dbPath string) {
+	o, err := readOwner(dbPath)
+	if err != nil || o.PID != os.Getpid() {
+		return
+	}
+	os.Remove(ownerPath(dbPath))
+}
+
+func readOwner(dbPath string) (owner, error) {
+	o := owner{}
+	data, err := ioutil.ReadFile(ownerPath(dbPath))
+	if err != nil {
+		return o, err
+	}
+	err = json.Unmarshal(data, &o)
+	return o, err
+}
+
+// inUseError builds the error returned when the DB lock could not be acquired in time
+func inUseError(dbPath string) error {
+	o, err := readOwner(dbPath)
+	if err != nil || o.PID == 0 {
+		return errors.Errorf("Database '%s' is in use by another protos command. Wait for it to finish, then try again", dbPath)
+	}
+	return errors.Errorf("Database '%s' is in use by PID %d running '%s' since %s. Wait for it to finish or stop it, then try again",
+		dbPath, o.PID, o.Command, o.Since.Format(time.RFC1123))
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// schemaKey is the key in the meta bucket that holds the schema version of the DB
+const schemaKey = "schema"
+
+// migration upgrades the DB to a specific schema version. Migrations operate on the raw storm records, because the
+// structs used by the rest of the code always reflect the latest schema
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx storm.Node) error
+}
+
+// migrations are applied in order to bring older DBs to the current schema. New migrations are appended with the next
+// version number, and existing ones should never be modified
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Record the schema version",
+		migrate:     func(tx storm.Node) error { return nil },
+	},
+}
+
+// SchemaVersion returns the schema version supported by this version of the client
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// schemaVersion reads the schema version of the DB. DBs created before versioning was introduced have version 0
+func (db *dbprotos) schemaVersion() (int, error) {
+	version := 0
+	err := db.s.Get(metaBucket, schemaKey, &version)
+	if err != nil && err != storm.ErrNotFound {
+		return 0, errors.Wrap(err, "Failed to read database schema version")
+	}
+	return version, nil
+}
+
+// backup copies the DB file next to the original, before it gets modified by migrations
+func (db *dbprotos) backup(version int) (string, error) {
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", db.path, version, time.Now().Format("20060102150405"))
+	data, err := ioutil.ReadFile(db.path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read database '%s'", db.path)
+	}
+	err = ioutil.WriteFile(backupPath, data, 0600)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to write database backup '%s'", backupPath)
+	}
+	return backupPath, nil
+}
+
+// migrate brings the DB to the current schema version. New DBs are marked with the current version straight away
+func (db *dbprotos) migrate(newDB bool) error {
+	if newDB {
+		return db.s.Set(metaBucket, schemaKey, SchemaVersion())
+	}
+
+	version, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion() {
+		return errors.Errorf("Database schema version %d is newer than the version supported by this client (%d). Please upgrade protos-cli", version, SchemaVersion())
+	}
+	if version == SchemaVersion() {
+		return nil
+	}
+
+	backupPath, err := db.backup(version)
+	if err != nil {
+		return errors.Wrap(err, "Failed to back up database before migrating it")
+	}
+	logrus.Infof("Migrating database from schema version %d to %d. A backup was saved to '%s'", version, SchemaVersion(), backupPath)
+
+	tx, err := db.s.Begin(true)
+	if err != nil {
+		return errors.Wrap(err, "Failed to start database migration")
+	}
+	defer tx.Rollback()
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		logrus.Debugf("Applying database migration %d: %s", m.version, m.description)
+		err = m.migrate(tx)
+		if err != nil {
+			return errors.Wrapf(err, "Database migration %d (%s) failed. The database was not modified", m.version, m.description)
+		}
+	}
+	err = tx.Set(metaBucket, schemaKey, SchemaVersion())
+	if err != nil {
+		return errors.Wrap(err, "Failed to update database schema version")
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "Failed to commit database migration")
+	}
+	return nil
+}
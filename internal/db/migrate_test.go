@@ -0,0 +1,153 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/asdine/storm"
+)
+
+const testDBName = "protos.db"
+
+// newTestDB creates a DB with the current schema in a temporary directory, and returns the directory (with a trailing
+// separator, as expected by Open)
+func newTestDB(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "protos-db")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	dir += string(filepath.Separator)
+	db, err := Open(dir, testDBName, Options{})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create database: %s", err)
+	}
+	db.Close()
+	return dir
+}
+
+// setSchemaVersion changes the schema version stored in a closed DB. Version 0 removes it, like in the DBs created
+// before versioning was introduced
+func setSchemaVersion(t *testing.T, dir string, version int) {
+	s, err := storm.Open(dir + testDBName)
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	defer s.Close()
+	if version == 0 {
+		err = s.Delete(metaBucket, schemaKey)
+	} else {
+		err = s.Set(metaBucket, schemaKey, version)
+	}
+	if err != nil {
+		t.Fatalf("Failed to set schema version %d: %s", version, err)
+	}
+}
+
+func backups(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(dir + testDBName + ".v*.bak")
+	if err != nil {
+		t.Fatalf("Failed to list database backups: %s", err)
+	}
+	return matches
+}
+
+func checkSchemaVersion(t *testing.T, db DB, expected int) {
+	version, err := db.(*dbprotos).schemaVersion()
+	if err != nil {
+		t.Fatalf("Failed to read schema version: %s", err)
+	}
+	if version != expected {
+		t.Fatalf("Expected schema version %d, got %d", expected, version)
+	}
+}
+
+func TestNewDBSchema(t *testing.T) {
+	dir := newTestDB(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, testDBName, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	defer db.Close()
+	checkSchemaVersion(t, db, SchemaVersion())
+	if len(backups(t, dir)) != 0 {
+		t.Fatalf("New databases should not be backed up, found %v", backups(t, dir))
+	}
+}
+
+func TestMigrateUnversionedDB(t *testing.T) {
+	dir := newTestDB(t)
+	defer os.RemoveAll(dir)
+	setSchemaVersion(t, dir, 0)
+
+	db, err := Open(dir, testDBName, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	checkSchemaVersion(t, db, SchemaVersion())
+	db.Close()
+
+	found := backups(t, dir)
+	if len(found) != 1 || !strings.Contains(filepath.Base(found[0]), ".v0-") {
+		t.Fatalf("Expected one backup of schema version 0, found %v", found)
+	}
+
+	// the DB is only backed up and migrated once
+	db, err = Open(dir, testDBName, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open migrated database: %s", err)
+	}
+	db.Close()
+	if len(backups(t, dir)) != 1 {
+		t.Fatalf("Expected a single backup, found %v", backups(t, dir))
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	dir := newTestDB(t)
+	defer os.RemoveAll(dir)
+	setSchemaVersion(t, dir, SchemaVersion()+1)
+
+	_, err := Open(dir, testDBName, Options{})
+	if err == nil || !strings.Contains(err.Error(), "newer than the version supported") {
+		t.Fatalf("Expected the newer schema to be refused, got: %v", err)
+	}
+	if len(backups(t, dir)) != 0 {
+		t.Fatalf("Refused databases should not be backed up, found %v", backups(t, dir))
+	}
+}
+
+func TestMigrateReadOnly(t *testing.T) {
+	dir := newTestDB(t)
+	defer os.RemoveAll(dir)
+
+	// up to date DBs stay read only
+	db, err := Open(dir, testDBName, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open database read only: %s", err)
+	}
+	if !db.(*dbprotos).readOnly {
+		t.Fatal("Expected an up to date database to stay read only")
+	}
+	db.Close()
+
+	// outdated DBs are reopened for writing, so they can be migrated
+	setSchemaVersion(t, dir, 0)
+	db, err = Open(dir, testDBName, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open outdated database read only: %s", err)
+	}
+	defer db.Close()
+	if db.(*dbprotos).readOnly {
+		t.Fatal("Expected the outdated database to be reopened for writing")
+	}
+	checkSchemaVersion(t, db, SchemaVersion())
+	if len(backups(t, dir)) != 1 {
+		t.Fatalf("Expected a backup of the outdated database, found %v", backups(t, dir))
+	}
+}
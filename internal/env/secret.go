@@ -0,0 +1,385 @@
+package env
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/keyring"
+)
+
+// ErrSecretNotFound is returned by secret backends when a secret does not exist
+var ErrSecretNotFound = errors.New("Secret not found")
+
+const (
+	secretService   = "protos-cli"
+	secretEnvPrefix = "PROTOS_SECRET_"
+	passPrefix      = "protos/"
+	// exit code used by secret command hooks to signal that a secret does not exist
+	commandNotFoundCode = 2
+)
+
+// SecretBackends lists the supported secret backend specs, used in help messages
+var SecretBackends = []string{"db", "keyring", "pass", "env", "command:<hook>", "file:<path>"}
+
+// SecretBackend stores secrets outside the DB. Keys are slash separated paths like 'cloud/<name>/<field>'
+type SecretBackend interface {
+	Get(key string) (string, error)
+	Set(key string, value string) error
+	Delete(key string) error
+}
+
+// NewSecretBackend creates a secret backend from its spec:
+// - 'db' or empty: secrets are stored in the DB, and nil is returned
+// - 'keyring': the OS keyring (Secret Service over D-Bus on Linux, Keychain on MacOS)
+// - 'pass': the pass password manager, under the 'protos/' folder
+// - 'env': environment variables named PROTOS_SECRET_<KEY>. This backend is read only
+// - 'command:<hook>': an external command, called as '<hook> get|set|delete <key>'
+// - 'file:<path>': a JSON file, meant for testing
+func NewSecretBackend(spec string) (SecretBackend, error) {
+	name := spec
+	arg := ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name = spec[:i]
+		arg = spec[i+1:]
+	}
+
+	switch name {
+	case "", "db":
+		return nil, nil
+	case "keyring":
+		return keyringBackend{}, nil
+	case "pass":
+		return passBackend{}, nil
+	case "env":
+		return envBackend{}, nil
+	case "command":
+		if arg == "" {
+			return nil, errors.New("Secret backend 'command' requires a hook, e.g. 'command:/usr/local/bin/protos-secrets'")
+		}
+		return commandBackend{hook: arg}, nil
+	case "file":
+		if arg == "" {
+			return nil, errors.New("Secret backend 'file' requires a path, e.g. 'file:/tmp/secrets.json'")
+		}
+		return fileBackend{path: arg}, nil
+	default:
+		return nil, errors.Errorf("Unknown secret backend '%s'. Supported backends: %s", spec, strings.Join(SecretBackends, ", "))
+	}
+}
+
+// runSecretCommand executes a command and returns its stdout and exit code
+func runSecretCommand(stdin string, name string, args ...string) (string, int, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", exitErr.ExitCode(), errors.Errorf("'%s' failed: %s", name, strings.TrimSpace(stderr.String()))
+		}
+		return "", -1, errors.Wrapf(err, "Failed to run '%s'", name)
+	}
+	return stdout.String(), 0, nil
+}
+
+//
+// keyring backend
+//
+
+type keyringBackend struct{}
+
+func (b keyringBackend) Get(key string) (string, error) {
+	value, err := keyring.Get(secretService, key)
+	if err == keyring.ErrNotFound {
+		return "", ErrSecretNotFound
+	}
+	return value, err
+}
+
+func (b keyringBackend) Set(key string, value string) error {
+	return keyring.Set(secretService, key, value)
+}
+
+func (b keyringBackend) Delete(key string) error {
+	return keyring.Delete(secretService, key)
+}
+
+//
+// pass backend
+//
+
+type passBackend struct{}
+
+func (b passBackend) Get(key string) (string, error) {
+	out, _, err := runSecretCommand("", "pass", "show", passPrefix+key)
+	if err != nil {
+		if strings.Contains(err.Error(), "is not in the password store") {
+			return "", ErrSecretNotFound
+		}
+		return "", errors.Wrapf(err, "Failed to retrieve secret '%s' from pass", key)
+	}
+	// pass stores the secret on the first line
+	return strings.SplitN(out, "\n", 2)[0], nil
+}
+
+func (b passBackend) Set(key string, value string) error {
+	_, _, err := runSecretCommand(value+"\n", "pass", "insert", "--multiline", "--force", passPrefix+key)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store secret '%s' in pass", key)
+	}
+	return nil
+}
+
+func (b passBackend) Delete(key string) error {
+	_, _, err := runSecretCommand("", "pass", "rm", "--force", passPrefix+key)
+	if err != nil && !strings.Contains(err.Error(), "is not in the password store") {
+		return errors.Wrapf(err, "Failed to delete secret '%s' from pass", key)
+	}
+	return nil
+}
+
+//
+// environment variables backend
+//
+
+type envBackend struct{}
+
+// envName converts a secret key into an environment variable name, e.g. cloud/my-scw/ACCESS_KEY becomes
+// PROTOS_SECRET_CLOUD_MY_SCW_ACCESS_KEY
+func envName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return '_'
+		}
+		return unicode.ToUpper(r)
+	}, key)
+	return secretEnvPrefix + name
+}
+
+func (b envBackend) Get(key string) (string, error) {
+	value, found := os.LookupEnv(envName(key))
+	if !found {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+func (b envBackend) Set(key string, value string) error {
+	current, found := os.LookupEnv(envName(key))
+	if found && current == value {
+		return nil
+	}
+	return errors.Errorf("The env secret backend is read only. Set the '%s' environment variable instead", envName(key))
+}
+
+func (b envBackend) Delete(key string) error {
+	return nil
+}
+
+//
+// external command backend
+//
+
+type commandBackend struct {
+	hook string
+}
+
+// run calls the hook through the shell, so that it can contain arguments. The key is passed as a separate argument and
+// the secret is passed on stdin, to avoid quoting issues
+func (b commandBackend) run(stdin string, action string, key string) (string, int, error) {
+	return runSecretCommand(stdin, "sh", "-c", b.hook+" \"$@\"", "sh", action, key)
+}
+
+func (b commandBackend) Get(key string) (string, error) {
+	out, code, err := b.run("", "get", key)
+	if err != nil {
+		if code == commandNotFoundCode {
+			return "", ErrSecretNotFound
+		}
+		return "", errors.Wrapf(err, "Failed to retrieve secret '%s' using secret hook", key)
+	}
+	return strings.TrimSuffix(out, "\n"), nil
+}
+
+func (b commandBackend) Set(key string, value string) error {
+	_, _, err := b.run(value, "set", key)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store secret '%s' using secret hook", key)
+	}
+	return nil
+}
+
+func (b commandBackend) Delete(key string) error {
+	_, code, err := b.run("", "delete", key)
+	if err != nil && code != commandNotFoundCode {
+		return errors.Wrapf(err, "Failed to delete secret '%s' using secret hook", key)
+	}
+	return nil
+}
+
+//
+// file backend
+//
+
+type fileBackend struct {
+	path string
+}
+
+func (b fileBackend) read() (map[string]string, error) {
+	secrets := map[string]string{}
+	data, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return secrets, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to read secrets file '%s'", b.path)
+	}
+	err = json.Unmarshal(data, &secrets)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse secrets file '%s'", b.path)
+	}
+	return secrets, nil
+}
+
+func (b fileBackend) write(secrets map[string]string) error {
+	data, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode secrets")
+	}
+	err = ioutil.WriteFile(b.path, data, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write secrets file '%s'", b.path)
+	}
+	return nil
+}
+
+func (b fileBackend) Get(key string) (string, error) {
+	secrets, err := b.read()
+	if err != nil {
+		return "", err
+	}
+	value, found := secrets[key]
+	if !found {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+func (b fileBackend) Set(key string, value string) error {
+	secrets, err := b.read()
+	if err != nil {
+		return err
+	}
+	secrets[key] = value
+	return b.write(secrets)
+}
+
+func (b fileBackend) Delete(key string) error {
+	secrets, err := b.read()
+	if err != nil {
+		return err
+	}
+	delete(secrets, key)
+	return b.write(secrets)
+}
+
+//
+// Env secret methods
+//
+
+func cloudSecretKey(cloudName string, field string) string {
+	return "cloud/" + cloudName + "/" + field
+}
+
+// UserPasswordKey returns the key under which the password of a user is stored in a secret backend
+func UserPasswordKey(username string) string {
+	return "user/" + username + "/password"
+}
+
+// CloudAuth returns the credentials of a cloud. If the cloud uses a secret backend, the credentials are retrieved from it
+func (e *Env) CloudAuth(pi cloud.ProviderInfo) (map[string]string, error) {
+	backend, err := NewSecretBackend(pi.SecretBackend)
+	if err != nil || backend == nil {
+		return pi.Auth, err
+	}
+
+	auth := map[string]string{}
+	for _, field := range pi.Client().AuthFields() {
+		value, err := backend.Get(cloudSecretKey(pi.Name, field))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to retrieve credentials field '%s' of cloud '%s' from secret backend '%s'", field, pi.Name, pi.SecretBackend)
+		}
+		auth[field] = value
+	}
+	return auth, nil
+}
+
+// LookupCloudAuth returns the credential fields of a cloud which are already present in its secret backend. It allows
+// reusing credentials provisioned outside protos, like environment variables
+func (e *Env) LookupCloudAuth(pi cloud.ProviderInfo, fields []string) (map[string]string, error) {
+	auth := map[string]string{}
+	backend, err := NewSecretBackend(pi.SecretBackend)
+	if err != nil || backend == nil {
+		return auth, err
+	}
+	for _, field := range fields {
+		value, err := backend.Get(cloudSecretKey(pi.Name, field))
+		if err == ErrSecretNotFound {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "Failed to retrieve credentials field '%s' of cloud '%s'", field, pi.Name)
+		}
+		auth[field] = value
+	}
+	return auth, nil
+}
+
+// SaveCloud saves a cloud in the DB. If the cloud uses a secret backend, the credentials are stored in the backend and
+// only the rest of the cloud info is written to the DB
+func (e *Env) SaveCloud(pi cloud.ProviderInfo) error {
+	backend, err := NewSecretBackend(pi.SecretBackend)
+	if err != nil {
+		return err
+	}
+	if backend != nil {
+		for field, value := range pi.Auth {
+			err = backend.Set(cloudSecretKey(pi.Name, field), value)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to store credentials of cloud '%s'", pi.Name)
+			}
+		}
+		pi.Auth = nil
+	}
+	return e.DB.SaveCloud(pi)
+}
+
+// DeleteCloud removes a cloud from the DB, together with its credentials stored in a secret backend
+func (e *Env) DeleteCloud(name string) error {
+	pi, err := e.DB.GetCloud(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	backend, err := NewSecretBackend(pi.SecretBackend)
+	if err != nil {
+		return err
+	}
+	if backend != nil {
+		for _, field := range pi.Client().AuthFields() {
+			err = backend.Delete(cloudSecretKey(pi.Name, field))
+			if err != nil {
+				e.Log.Warnf("Failed to delete credentials field '%s' of cloud '%s': %s", field, pi.Name, err.Error())
+			}
+		}
+	}
+	return e.DB.DeleteCloud(name)
+}
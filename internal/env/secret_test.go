@@ -0,0 +1,66 @@
+package env
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setEnv sets an environment variable and returns a function which restores its previous value
+func setEnv(name string, value string) func() {
+	previous, found := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if found {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestSecretBackends(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sec")
+	defer os.RemoveAll(dir)
+	hook := filepath.Join(dir, "hook.sh")
+	ioutil.WriteFile(hook, []byte(`#!/bin/sh
+f="`+dir+`/$(echo $2 | tr / _)"
+case $1 in
+get) [ -f "$f" ] || exit 2; cat "$f";;
+set) cat > "$f";;
+delete) [ -f "$f" ] || exit 2; rm "$f";;
+esac
+`), 0700)
+	for _, spec := range []string{"file:" + filepath.Join(dir, "s.json"), "command:" + hook} {
+		b, err := NewSecretBackend(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Get("cloud/a/K"); err != ErrSecretNotFound {
+			t.Fatal(spec, err)
+		}
+		if err := b.Set("cloud/a/K", "v 1"); err != nil {
+			t.Fatal(err)
+		}
+		v, err := b.Get("cloud/a/K")
+		if err != nil || v != "v 1" {
+			t.Fatal(spec, v, err)
+		}
+		if err := b.Delete("cloud/a/K"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete("cloud/a/K"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer setEnv("PROTOS_SECRET_CLOUD_MY_SCW_ACCESS_KEY", "x")()
+	b, _ := NewSecretBackend("env")
+	v, err := b.Get("cloud/my-scw/ACCESS_KEY")
+	if err != nil || v != "x" {
+		t.Fatal(v, err)
+	}
+	if b.Set("cloud/my-scw/SECRET_KEY", "y") == nil {
+		t.Fatal("expected read only")
+	}
+}
@@ -0,0 +1,119 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned when a secret does not exist in the keyring
+var ErrNotFound = errors.New("Secret not found in keyring")
+
+// The OS keyring is accessed using the command line tools shipped with each OS: secret-tool (libsecret) talks to the
+// Secret Service over D-Bus on Linux, and security talks to the Keychain on MacOS
+
+// run executes a command and returns its stdout. If the command fails, the error includes its stderr and exit code
+func run(stdin string, name string, args ...string) (string, int, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", exitErr.ExitCode(), errors.Errorf("'%s' failed: %s", name, strings.TrimSpace(stderr.String()))
+		}
+		return "", -1, errors.Wrapf(err, "Failed to run '%s'", name)
+	}
+	return stdout.String(), 0, nil
+}
+
+// Get retrieves a secret from the OS keyring
+func Get(service string, account string) (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		out, code, err := run("", "secret-tool", "lookup", "service", service, "account", account)
+		if err != nil {
+			// secret-tool exits with 1 when the secret doesn't exist
+			if code == 1 {
+				return "", ErrNotFound
+			}
+			return "", errors.Wrap(err, "Failed to retrieve secret from keyring")
+		}
+		if out == "" {
+			return "", ErrNotFound
+		}
+		return out, nil
+	case "darwin":
+		out, code, err := run("", "security", "find-generic-password", "-s", service, "-a", account, "-w")
+		if err != nil {
+			// security exits with 44 when the item doesn't exist
+			if code == 44 {
+				return "", ErrNotFound
+			}
+			return "", errors.Wrap(err, "Failed to retrieve secret from keyring")
+		}
+		return strings.TrimSuffix(out, "\n"), nil
+	default:
+		return "", errors.Errorf("OS keyring is not supported on '%s'", runtime.GOOS)
+	}
+}
+
+// Set stores a secret in the OS keyring, replacing any existing secret for the same service and account
+func Set(service string, account string, secret string) error {
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		_, _, err = run(secret, "secret-tool", "store", "--label", service+" ("+account+")", "service", service, "account", account)
+	case "darwin":
+		// security reads the command from stdin in interactive mode (-i), so the secret is not visible in the process
+		// list. It's passed hex encoded (-X) so it doesn't need quoting
+		if strings.ContainsAny(service+account, "'\"\\\n") {
+			return errors.Errorf("Invalid keyring service '%s' or account '%s'", service, account)
+		}
+		command := fmt.Sprintf("add-generic-password -U -s '%s' -a '%s' -X %s\n", service, account, hex.EncodeToString([]byte(secret)))
+		_, _, err = run(command, "security", "-i")
+		if err != nil {
+			break
+		}
+		// errors of interactive commands don't change the exit code, so the secret is read back to confirm it was stored
+		stored, getErr := Get(service, account)
+		if getErr != nil {
+			err = getErr
+		} else if stored != secret {
+			err = errors.New("The stored secret does not match")
+		}
+	default:
+		return errors.Errorf("OS keyring is not supported on '%s'", runtime.GOOS)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to store secret in keyring")
+	}
+	return nil
+}
+
+// Delete removes a secret from the OS keyring. Deleting a secret which doesn't exist is not an error
+func Delete(service string, account string) error {
+	switch runtime.GOOS {
+	case "linux":
+		_, _, err := run("", "secret-tool", "clear", "service", service, "account", account)
+		if err != nil {
+			return errors.Wrap(err, "Failed to delete secret from keyring")
+		}
+	case "darwin":
+		_, code, err := run("", "security", "delete-generic-password", "-s", service, "-a", account)
+		if err != nil && code != 44 {
+			return errors.Wrap(err, "Failed to delete secret from keyring")
+		}
+	default:
+		return errors.Errorf("OS keyring is not supported on '%s'", runtime.GOOS)
+	}
+	return nil
+}
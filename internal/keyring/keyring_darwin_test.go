@@ -0,0 +1,48 @@
+package keyring
+
+import (
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestKeychain(t *testing.T) {
+	if _, err := exec.LookPath("security"); err != nil {
+		t.Skip("security is not available")
+	}
+	service := fmt.Sprintf("protos-test-%d", time.Now().UnixNano())
+	account := "test account"
+	defer Delete(service, account)
+
+	if _, err := Get(service, account); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound before storing the secret, got: %v", err)
+	}
+
+	// the secrets include characters which would need quoting, and the second one replaces the first
+	for _, secret := range []string{`-w {"TOKEN": "a 'b' \c"}`, "second secret"} {
+		if err := Set(service, account, secret); err != nil {
+			t.Fatalf("Failed to store secret: %s", err)
+		}
+		stored, err := Get(service, account)
+		if err != nil {
+			t.Fatalf("Failed to retrieve secret: %s", err)
+		}
+		if stored != secret {
+			t.Fatalf("Expected secret %q, got %q", secret, stored)
+		}
+	}
+
+	if err := Delete(service, account); err != nil {
+		t.Fatalf("Failed to delete secret: %s", err)
+	}
+	if _, err := Get(service, account); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound after deleting the secret, got: %v", err)
+	}
+	if err := Delete(service, account); err != nil {
+		t.Fatalf("Deleting a missing secret should not fail: %s", err)
+	}
+	if err := Set(service, "it's", "secret"); err == nil {
+		t.Fatal("Expected an error for an account which can't be quoted")
+	}
+}
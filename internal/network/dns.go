@@ -4,8 +4,11 @@ import "net"
 
 // DNSManager allows for addition and deletion of DNS servers
 type DNSManager interface {
-	AddDomainServer(domain string, server net.IP) error
+	// AddDomainServers sets the DNS servers used for a domain. The servers are tried in order
+	AddDomainServers(domain string, servers []net.IP) error
 	DelDomainServer(domain string) error
+	// DomainServers returns the DNS servers used for a domain, or nil if there are none
+	DomainServers(domain string) ([]net.IP, error)
 	AddServer(server net.IP) error
 	DelServer(server net.IP) error
 }
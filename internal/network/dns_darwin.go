@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 )
 
 const (
@@ -15,10 +16,13 @@ const (
 type dnsManager struct {
 }
 
-func (m *dnsManager) AddDomainServer(domain string, server net.IP) error {
+func (m *dnsManager) AddDomainServers(domain string, servers []net.IP) error {
 	if domain == "" {
 		return fmt.Errorf("Domain cannot be empty")
 	}
+	if len(servers) == 0 {
+		return fmt.Errorf("Could not add DNS servers for domain '%s': no servers provided", domain)
+	}
 
 	// check if the file exists
 	resolverFile := resolverPath + "/" + domain
@@ -27,8 +31,12 @@ func (m *dnsManager) AddDomainServer(domain string, server net.IP) error {
 		return fmt.Errorf("Could not add DNS server for domain '%s': file '%s' already exists", domain, resolverFile)
 	}
 
-	// write file
-	dnsData := fmt.Sprintf("nameserver %s\n", server.String())
+	// write file. The resolver tries the servers in order, with a short timeout so that failover is fast
+	dnsData := ""
+	for _, server := range servers {
+		dnsData += fmt.Sprintf("nameserver %s\n", server.String())
+	}
+	dnsData += "timeout 2\n"
 	err = ioutil.WriteFile(resolverFile, []byte(dnsData), 0644)
 	if err != nil {
 		return fmt.Errorf("Could not add DNS server for domain '%s': %w", domain, err)
@@ -52,6 +60,25 @@ func (m *dnsManager) DelDomainServer(domain string) error {
 	return nil
 }
 
+func (m *dnsManager) DomainServers(domain string) ([]net.IP, error) {
+	resolverFile := resolverPath + "/" + domain
+	data, err := ioutil.ReadFile(resolverFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read DNS server for domain '%s': %w", domain, err)
+	}
+	servers := []net.IP{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.ParseIP(fields[1]))
+		}
+	}
+	return servers, nil
+}
+
 func (m *dnsManager) AddServer(server net.IP) error {
 	return nil
 }
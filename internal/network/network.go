@@ -16,6 +16,12 @@ type Route struct {
 	Src  net.IP
 }
 
+// LocalRoute is an entry in the routing table of the host
+type LocalRoute struct {
+	Dest      net.IPNet
+	Interface string
+}
+
 type Link interface {
 	Interface() net.Interface
 	Name() string
@@ -32,6 +38,8 @@ type Link interface {
 
 	AddRoute(Route) error
 	DelRoute(Route) error
+	// HasRoute checks if the route is installed, and uses the link
+	HasRoute(Route) (bool, error)
 }
 
 // Manager deals with the management of network interfaces
@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
@@ -17,6 +18,7 @@ const (
 	wgGoPath     = "/usr/local/bin/wireguard-go"
 	ifconfigPath = "/sbin/ifconfig"
 	routePath    = "/sbin/route"
+	netstatPath  = "/usr/sbin/netstat"
 )
 
 type LinkError struct {
@@ -165,6 +167,29 @@ func (l *linkTUN) DelRoute(r Route) error {
 	}
 	return nil
 }
+func (l *linkTUN) HasRoute(r Route) (bool, error) {
+	// 'route get' fails if there is no route for the destination
+	cmd := exec.Command(routePath, "-n", "get", "-net", r.Dest.String())
+	output, err := cmd.Output()
+	if err != nil {
+		return false, nil
+	}
+	destination := ""
+	iface := ""
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "destination:":
+			destination = fields[1]
+		case "interface:":
+			iface = fields[1]
+		}
+	}
+	return destination == r.Dest.IP.String() && iface == l.realInterface, nil
+}
 
 //
 // linkMngr implements the Manager interface
@@ -311,3 +336,72 @@ func NewManager() (Manager, error) {
 	}
 	return &linkMngr{wg: wg}, nil
 }
+
+// LocalRoutes returns the IPv4 and IPv6 routes of the host, except the default routes
+func LocalRoutes() ([]LocalRoute, error) {
+	routes := []LocalRoute{}
+	for _, family := range []string{"inet", "inet6"} {
+		output, err := exec.Command(netstatPath, "-rn", "-f", family).Output()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list %s routes: %w", family, err)
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[0] == "default" || fields[0] == "Destination" {
+				continue
+			}
+			dest, err := parseNetstatDestination(fields[0])
+			if err != nil {
+				continue
+			}
+			routes = append(routes, LocalRoute{Dest: dest, Interface: fields[3]})
+		}
+	}
+	return routes, nil
+}
+
+// parseNetstatDestination parses the destinations printed by netstat, which leave out the trailing zero octets of IPv4
+// networks ('192.168.1' is 192.168.1.0/24), the mask of host routes and add the zone to IPv6 link local addresses
+func parseNetstatDestination(dest string) (net.IPNet, error) {
+	addr := dest
+	prefix := ""
+	if i := strings.Index(dest, "/"); i >= 0 {
+		addr = dest[:i]
+		prefix = dest[i+1:]
+	}
+	if i := strings.Index(addr, "%"); i >= 0 {
+		addr = addr[:i]
+	}
+
+	bits := 8 * net.IPv6len
+	ones := bits
+	if !strings.Contains(addr, ":") {
+		octets := strings.Split(addr, ".")
+		if len(octets) > 4 {
+			return net.IPNet{}, fmt.Errorf("Invalid route destination '%s'", dest)
+		}
+		bits = 8 * net.IPv4len
+		ones = 8 * len(octets)
+		for len(octets) < 4 {
+			octets = append(octets, "0")
+		}
+		addr = strings.Join(octets, ".")
+	}
+	if prefix != "" {
+		var err error
+		ones, err = strconv.Atoi(prefix)
+		if err != nil || ones < 0 || ones > bits {
+			return net.IPNet{}, fmt.Errorf("Invalid route destination '%s'", dest)
+		}
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("Invalid route destination '%s'", dest)
+	}
+	if bits == 8*net.IPv4len {
+		ip = ip.To4()
+	}
+	mask := net.CIDRMask(ones, bits)
+	return net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
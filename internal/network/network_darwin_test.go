@@ -0,0 +1,35 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestParseNetstatDestination(t *testing.T) {
+	tests := []struct {
+		dest string
+		want string
+	}{
+		{"192.168.1", "192.168.1.0/24"},
+		{"10", "10.0.0.0/8"},
+		{"192.168.1.20", "192.168.1.20/32"},
+		{"224.0.0/4", "224.0.0.0/4"},
+		{"fe80::%lo0/64", "fe80::/64"},
+		{"fd00::1", "fd00::1/128"},
+	}
+	for _, tt := range tests {
+		got, err := parseNetstatDestination(tt.dest)
+		if err != nil {
+			t.Errorf("parseNetstatDestination(%q) failed: %v", tt.dest, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("parseNetstatDestination(%q) = %s, want %s", tt.dest, got.String(), tt.want)
+		}
+	}
+
+	for _, dest := range []string{"1.2.3.4.5", "10/33", "default", "fe80::/x"} {
+		if _, err := parseNetstatDestination(dest); err == nil {
+			t.Errorf("parseNetstatDestination(%q) should fail", dest)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Format is the output format used by list and info commands
+type Format string
+
+const (
+	// JSON prints the data as indented JSON
+	JSON = Format("json")
+	// YAML prints the data as YAML
+	YAML = Format("yaml")
+	// Table prints the main fields as a table, or as a list of 'Field: value' lines for info commands
+	Table = Format("table")
+	// Wide is like Table, but includes all the fields
+	Wide = Format("wide")
+)
+
+// Formats lists the supported formats, used in help messages
+var Formats = []string{string(JSON), string(YAML), string(Table), string(Wide)}
+
+// ParseFormat validates an output format
+func ParseFormat(format string) (Format, error) {
+	for _, f := range Formats {
+		if format == f {
+			return Format(format), nil
+		}
+	}
+	return "", errors.Errorf("Invalid output format '%s'. Supported formats: %s", format, strings.Join(Formats, ", "))
+}
+
+// Column is a table column. Wide columns are only shown in the wide format
+type Column struct {
+	Header string
+	Wide   bool
+}
+
+// Field is a line printed by info commands in the table formats. Wide fields are only shown in the wide format
+type Field struct {
+	Name  string
+	Value string
+	Wide  bool
+}
+
+// Renderer prints the data of list and info commands in the selected format. For the JSON and YAML formats, the data
+// is marshalled as it is, so the views passed to the renderer define the field names
+type Renderer struct {
+	Format Format
+	Out    io.Writer
+}
+
+// New creates a renderer which writes to out
+func New(format Format, out io.Writer) *Renderer {
+	return &Renderer{Format: format, Out: out}
+}
+
+// marshal prints the data for the machine readable formats. It returns false for the table formats
+func (r *Renderer) marshal(data interface{}) (bool, error) {
+	switch r.Format {
+	case JSON:
+		enc := json.NewEncoder(r.Out)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(data)
+		if err != nil {
+			return true, errors.Wrap(err, "Failed to encode output as JSON")
+		}
+		return true, nil
+	case YAML:
+		out, err := yaml.Marshal(data)
+		if err != nil {
+			return true, errors.Wrap(err, "Failed to encode output as YAML")
+		}
+		_, err = r.Out.Write(out)
+		return true, err
+	default:
+		return false, nil
+	}
+}
+
+// List prints a list of records. data is marshalled for the machine readable formats, while rows, which must have
+// one value for each column, are used for the table formats
+func (r *Renderer) List(data interface{}, columns []Column, rows [][]string) error {
+	if done, err := r.marshal(data); done {
+		return err
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(r.Out, 0, 0, 2, ' ', 0)
+	headers := []string{}
+	separators := []string{}
+	for _, column := range columns {
+		if column.Wide && r.Format != Wide {
+			continue
+		}
+		headers = append(headers, column.Header)
+		separators = append(separators, strings.Repeat("-", len(column.Header)))
+	}
+	fmt.Fprintf(w, " %s\t", strings.Join(headers, "\t"))
+	fmt.Fprintf(w, "\n %s\t", strings.Join(separators, "\t"))
+	for _, row := range rows {
+		values := []string{}
+		for i, column := range columns {
+			if column.Wide && r.Format != Wide {
+				continue
+			}
+			values = append(values, row[i])
+		}
+		fmt.Fprintf(w, "\n %s\t", strings.Join(values, "\t"))
+	}
+	fmt.Fprint(w, "\n")
+	return w.Flush()
+}
+
+// Info prints a single record. data is marshalled for the machine readable formats, while fields are used for the
+// table formats
+func (r *Renderer) Info(data interface{}, fields []Field) error {
+	if done, err := r.marshal(data); done {
+		return err
+	}
+
+	for _, field := range fields {
+		if field.Wide && r.Format != Wide {
+			continue
+		}
+		_, err := fmt.Fprintf(r.Out, "%s: %s\n", field.Name, field.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
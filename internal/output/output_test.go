@@ -0,0 +1,51 @@
+package output
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	type record struct {
+		Name string `json:"name" yaml:"name"`
+	}
+	columns := []Column{{Header: "Name"}, {Header: "Extra", Wide: true}}
+	fields := []Field{{Name: "Name", Value: "a"}, {Name: "Extra", Value: "x", Wide: true}}
+	expected := map[Format][]string{
+		JSON:  {`"name": "a"`},
+		YAML:  {"name: a"},
+		Table: {"Name", "a"},
+		Wide:  {"Name", "Extra", "a", "x"},
+	}
+	for format, contains := range expected {
+		var out bytes.Buffer
+		err := New(format, &out).List([]record{{"a"}}, columns, [][]string{{"a", "x"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = New(format, &out).Info(record{"a"}, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range contains {
+			if !strings.Contains(out.String(), s) {
+				t.Errorf("%s output does not contain '%s':\n%s", format, s, out.String())
+			}
+		}
+		if format == Table && strings.Contains(out.String(), "Extra") {
+			t.Errorf("table output contains wide column:\n%s", out.String())
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, format := range []string{"json", "yaml", "table", "wide"} {
+		if _, err := ParseFormat(format); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
@@ -8,11 +8,15 @@ import (
 	"github.com/pkg/errors"
 )
 
+// CapabilitySSHHostKeys is listed by the images which publish their SSH host keys through the cloud API at boot
+const CapabilitySSHHostKeys = "ssh-host-keys"
+
 type CloudImage struct {
-	Provider    string
-	URL         string
-	Digest      string
-	ReleaseDate time.Time `json:"release-date"`
+	Provider     string
+	URL          string
+	Digest       string
+	ReleaseDate  time.Time `json:"release-date"`
+	Capabilities []string  `json:"capabilities,omitempty"`
 }
 
 type Release struct {
@@ -26,6 +30,20 @@ type Releases struct {
 	Releases map[string]Release
 }
 
+//
+// CloudImage methods
+//
+
+// Supports returns true if the image lists the provided capability
+func (ci CloudImage) Supports(capability string) bool {
+	for _, c := range ci.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
 //
 // Releases methods
 //
@@ -0,0 +1,20 @@
+package release
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCloudImageSupports(t *testing.T) {
+	image := CloudImage{}
+	err := json.Unmarshal([]byte(`{"Provider": "scaleway", "capabilities": ["ssh-host-keys"]}`), &image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !image.Supports(CapabilitySSHHostKeys) || image.Supports("other") {
+		t.Fatalf("Unexpected capabilities %v", image.Capabilities)
+	}
+	if (CloudImage{}).Supports(CapabilitySSHHostKeys) {
+		t.Fatal("Images without capabilities should not support any")
+	}
+}
@@ -0,0 +1,285 @@
+package settings
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/allocator"
+	"github.com/protosio/cli/internal/output"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Source indicates where the value of a setting comes from
+type Source string
+
+const (
+	// SourceDefault means the built-in default is used
+	SourceDefault = Source("default")
+	// SourceFile means the value comes from the config file
+	SourceFile = Source("file")
+	// SourceEnv means the value comes from an environment variable
+	SourceEnv = Source("env")
+)
+
+// Key describes a supported setting. Names are dot separated, and map to nested maps in the YAML file
+type Key struct {
+	Name     string
+	Default  string
+	Usage    string
+	validate func(value string) error
+}
+
+// EnvName returns the environment variable which overrides the setting, e.g. deploy.data-size is overridden by
+// PROTOS_DEPLOY_DATA_SIZE
+func (k Key) EnvName() string {
+	return "PROTOS_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(k.Name))
+}
+
+func validateInt(value string) error {
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return errors.Errorf("'%s' is not a valid positive number", value)
+	}
+	return nil
+}
+
+func validateLogLevel(value string) error {
+	_, err := logrus.ParseLevel(value)
+	if err != nil {
+		return errors.Errorf("'%s' is not a valid log level", value)
+	}
+	return nil
+}
+
+func validateOutput(value string) error {
+	_, err := output.ParseFormat(value)
+	return err
+}
+
+// NetworkPoolULA is the network.pool value which makes the CLI generate a random IPv6 unique local prefix
+const NetworkPoolULA = "ula"
+
+func validateNetworkPool(value string) error {
+	if value == NetworkPoolULA {
+		return nil
+	}
+	_, _, err := allocator.ParsePool(value)
+	return err
+}
+
+// Keys lists all the supported settings
+var Keys = []Key{
+	{Name: "log.level", Default: "info", Usage: "Log level: warn, info, debug", validate: validateLogLevel},
+	{Name: "output", Default: "table", Usage: "Output format of list and info commands: json, yaml, table, wide", validate: validateOutput},
+	{Name: "deploy.cloud", Usage: "Cloud used by 'instance deploy'"},
+	{Name: "deploy.location", Usage: "Cloud location used by 'instance deploy'"},
+	{Name: "deploy.type", Usage: "Machine type used by 'instance deploy'"},
+	{Name: "deploy.version", Usage: "Protos version used by 'instance deploy'. The latest release is used if empty"},
+	{Name: "deploy.data-size", Default: "30", Usage: "Size of the data volume created by 'instance deploy', in GB", validate: validateInt},
+	{Name: "releases.url", Default: "https://releases.protos.io/releases.json", Usage: "URL of the Protos releases list"},
+	{Name: "network.pool", Default: "10.100.0.0/16", Usage: "Address pool for the instance and device networks: an IPv4 network (/24 networks are allocated), an IPv6 unique local prefix (/64 networks are allocated) or 'ula' to generate one", validate: validateNetworkPool},
+	{Name: "tunnel.port", Default: "0", Usage: "Local port used by 'instance tunnel'. A random port is used if 0", validate: validateInt},
+}
+
+func findKey(name string) (Key, error) {
+	for _, key := range Keys {
+		if key.Name == name {
+			return key, nil
+		}
+	}
+	return Key{}, errors.Errorf("Unknown setting '%s'. Run 'protos config ls' to see the supported settings", name)
+}
+
+// Config holds the settings loaded from the config file
+type Config struct {
+	path   string
+	values map[string]string
+}
+
+// flatten converts the nested maps read from YAML into dot separated keys
+func flatten(prefix string, in map[interface{}]interface{}, out map[string]string) {
+	for k, v := range in {
+		name := fmt.Sprintf("%v", k)
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if nested, ok := v.(map[interface{}]interface{}); ok {
+			flatten(name, nested, out)
+		} else if v != nil {
+			out[name] = fmt.Sprintf("%v", v)
+		}
+	}
+}
+
+// unflatten converts dot separated keys into nested maps, so the config file stays readable
+func unflatten(in map[string]string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for name, value := range in {
+		parts := strings.Split(name, ".")
+		m := out
+		for _, part := range parts[:len(parts)-1] {
+			nested, ok := m[part].(map[string]interface{})
+			if !ok {
+				nested = map[string]interface{}{}
+				m[part] = nested
+			}
+			m = nested
+		}
+		m[parts[len(parts)-1]] = value
+	}
+	return out
+}
+
+// Load reads the config file at the provided path. A missing file is not an error
+func Load(path string) (*Config, error) {
+	cfg := &Config{path: path, values: map[string]string{}}
+	err := cfg.validateEnv()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to read config file '%s'", path)
+	}
+
+	raw := map[interface{}]interface{}{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse config file '%s'", path)
+	}
+	flatten("", raw, cfg.values)
+	for name, value := range cfg.values {
+		key, err := findKey(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid config file '%s'", path)
+		}
+		if key.validate != nil {
+			err = key.validate(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid value for '%s' in config file '%s'", name, path)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// validateEnv checks the environment variables which override settings, so invalid values are reported when the config
+// is loaded instead of when the setting is first used
+func (c *Config) validateEnv() error {
+	for _, key := range Keys {
+		_, _, err := c.Lookup(key.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Path returns the path of the config file
+func (c *Config) Path() string {
+	return c.path
+}
+
+// Lookup returns the value of a setting and where it comes from. Environment variables take precedence over the config
+// file, which takes precedence over the defaults. Values of environment variables are validated like the ones in the
+// config file
+func (c *Config) Lookup(name string) (string, Source, error) {
+	key, err := findKey(name)
+	if err != nil {
+		return "", SourceDefault, err
+	}
+	if value, found := os.LookupEnv(key.EnvName()); found {
+		if key.validate != nil {
+			err = key.validate(value)
+			if err != nil {
+				return "", SourceEnv, errors.Wrapf(err, "Invalid value for '%s' in environment variable %s", name, key.EnvName())
+			}
+		}
+		return value, SourceEnv, nil
+	}
+	if value, found := c.values[name]; found {
+		return value, SourceFile, nil
+	}
+	return key.Default, SourceDefault, nil
+}
+
+// Get returns the value of a setting. Unknown settings are a programming error and invalid environment variables are
+// rejected by Load, so lookup errors panic
+func (c *Config) Get(name string) string {
+	value, _, err := c.Lookup(name)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// GetInt returns the value of a numeric setting. Values are validated when they are loaded or set, so they always parse
+func (c *Config) GetInt(name string) int {
+	i, err := strconv.Atoi(c.Get(name))
+	if err != nil {
+		panic(errors.Wrapf(err, "Setting '%s' is not numeric", name))
+	}
+	return i
+}
+
+// Set validates a setting and saves it in the config file
+func (c *Config) Set(name string, value string) error {
+	key, err := findKey(name)
+	if err != nil {
+		return err
+	}
+	if key.validate != nil {
+		err = key.validate(value)
+		if err != nil {
+			return err
+		}
+	}
+	c.values[name] = value
+	return c.save()
+}
+
+// Unset removes a setting from the config file, so the default is used again
+func (c *Config) Unset(name string) error {
+	_, err := findKey(name)
+	if err != nil {
+		return err
+	}
+	delete(c.values, name)
+	return c.save()
+}
+
+// Names returns the names of all the settings, sorted
+func Names() []string {
+	names := []string{}
+	for _, key := range Keys {
+		names = append(names, key.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describe returns the key of a setting, which holds its description and env variable
+func Describe(name string) (Key, error) {
+	return findKey(name)
+}
+
+func (c *Config) save() error {
+	data, err := yaml.Marshal(unflatten(c.values))
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode config")
+	}
+	err = ioutil.WriteFile(c.path, data, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write config file '%s'", c.path)
+	}
+	return nil
+}
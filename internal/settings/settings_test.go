@@ -0,0 +1,64 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setEnv sets an environment variable and returns a function which restores its previous value
+func setEnv(name string, value string) func() {
+	previous, found := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if found {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestSettings(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cfg")
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "config.yaml")
+	c, err := Load(p)
+	if err != nil || c.Get("deploy.data-size") != "30" {
+		t.Fatal(err)
+	}
+	if c.Set("deploy.data-size", "x") == nil || c.Set("nope", "1") == nil {
+		t.Fatal("expected errors")
+	}
+	c.Set("deploy.cloud", "scw")
+	c.Set("deploy.data-size", "50")
+	c2, err := Load(p)
+	if err != nil || c2.Get("deploy.cloud") != "scw" || c2.GetInt("deploy.data-size") != 50 {
+		t.Fatal(err, c2.values)
+	}
+	defer setEnv("PROTOS_DEPLOY_DATA_SIZE", "70")()
+	if v, src, _ := c2.Lookup("deploy.data-size"); v != "70" || src != SourceEnv {
+		t.Fatal(v, src)
+	}
+}
+
+func TestInvalidEnv(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cfg")
+	defer os.RemoveAll(dir)
+	c, err := Load(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer setEnv("PROTOS_OUTPUT", "xml")()
+	_, _, err = c.Lookup("output")
+	if err == nil || !strings.Contains(err.Error(), "PROTOS_OUTPUT") {
+		t.Fatalf("Expected an error naming PROTOS_OUTPUT, got: %v", err)
+	}
+	_, err = Load(filepath.Join(dir, "config.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "PROTOS_OUTPUT") {
+		t.Fatalf("Expected Load to reject PROTOS_OUTPUT, got: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package ssh
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var agentLock sync.Mutex
+var agentConn net.Conn
+var agentClient agent.ExtendedAgent
+
+// getAgent returns a client for the ssh-agent listening on SSH_AUTH_SOCK. The connection is opened on first use and
+// reused afterwards, because tunnels need the agent every time they reconnect
+func getAgent() (agent.ExtendedAgent, error) {
+	agentLock.Lock()
+	defer agentLock.Unlock()
+	if agentClient != nil {
+		return agentClient, nil
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("Failed to connect to ssh-agent: SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to ssh-agent at '%s'", socket)
+	}
+	agentConn = conn
+	agentClient = agent.NewClient(conn)
+	return agentClient, nil
+}
+
+// resetAgent closes the cached ssh-agent connection, so that the next getAgent call connects again using the current
+// SSH_AUTH_SOCK
+func resetAgent() {
+	agentLock.Lock()
+	defer agentLock.Unlock()
+	if agentConn != nil {
+		agentConn.Close()
+	}
+	agentConn = nil
+	agentClient = nil
+}
+
+// withAgent runs fn using the cached ssh-agent client. If fn fails, the connection is assumed to be broken (e.g. the
+// agent was restarted) so fn is retried once on a new connection
+func withAgent(fn func(sshAgent agent.ExtendedAgent) error) error {
+	for attempt := 0; ; attempt++ {
+		sshAgent, err := getAgent()
+		if err != nil {
+			return err
+		}
+		err = fn(sshAgent)
+		if err == nil || attempt > 0 {
+			return err
+		}
+		resetAgent()
+	}
+}
+
+// FindAgentKey returns the public key of an ssh-agent key, selected by its SHA256 fingerprint or its comment. An empty
+// selector is only valid if the agent holds exactly one key
+func FindAgentKey(selector string) (ssh.PublicKey, error) {
+	var keys []*agent.Key
+	err := withAgent(func(sshAgent agent.ExtendedAgent) error {
+		var err error
+		keys, err = sshAgent.List()
+		return errors.Wrap(err, "Failed to list ssh-agent keys")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("ssh-agent does not hold any keys")
+	}
+
+	if selector == "" {
+		if len(keys) > 1 {
+			return nil, errors.Errorf("ssh-agent holds %d keys. Select one using its fingerprint or comment", len(keys))
+		}
+		return keys[0], nil
+	}
+
+	for _, key := range keys {
+		if ssh.FingerprintSHA256(key) == selector || strings.TrimPrefix(ssh.FingerprintSHA256(key), "SHA256:") == selector || key.Comment == selector {
+			return key, nil
+		}
+	}
+	return nil, errors.Errorf("Could not find key '%s' in ssh-agent", selector)
+}
+
+// NewAgentAuth returns an SSH authentication method which signs using the ssh-agent key matching the provided public
+// key (in SSH wire format). Only that key is offered to the server
+func NewAgentAuth(publicKey []byte) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		err := withAgent(func(sshAgent agent.ExtendedAgent) error {
+			var err error
+			signers, err = sshAgent.Signers()
+			return errors.Wrap(err, "Failed to retrieve ssh-agent keys")
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, signer := range signers {
+			if bytes.Equal(signer.PublicKey().Marshal(), publicKey) {
+				return []ssh.Signer{signer}, nil
+			}
+		}
+		return nil, errors.New("The instance key is not available in ssh-agent. Make sure it is loaded (ssh-add) and SSH_AUTH_SOCK is set")
+	})
+}
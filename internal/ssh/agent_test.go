@@ -0,0 +1,141 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testAgent is an ssh-agent listening on a unix socket
+type testAgent struct {
+	socket   string
+	listener net.Listener
+	lock     sync.Mutex
+	conns    []net.Conn
+}
+
+// stop closes the agent socket and all the client connections, like an agent that was killed
+func (a *testAgent) stop() {
+	a.listener.Close()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, c := range a.conns {
+		c.Close()
+	}
+}
+
+// startTestAgent starts an ssh-agent holding a new key with the provided comment
+func startTestAgent(t *testing.T, dir string, name string, comment string) *testAgent {
+	socket := filepath.Join(dir, name)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on agent socket: %s", err)
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: comment}); err != nil {
+		t.Fatalf("Failed to add key to agent: %s", err)
+	}
+
+	a := &testAgent{socket: socket, listener: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			a.lock.Lock()
+			a.conns = append(a.conns, c)
+			a.lock.Unlock()
+			go agent.ServeAgent(keyring, c)
+		}
+	}()
+	return a
+}
+
+// setAuthSock points SSH_AUTH_SOCK to socket and returns a function which restores the previous value. The cached
+// agent connection is reset both times
+func setAuthSock(socket string) func() {
+	previous, found := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	resetAgent()
+	return func() {
+		if found {
+			os.Setenv("SSH_AUTH_SOCK", previous)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+		resetAgent()
+	}
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "protos-ssh")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestFindAgentKey(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	a := startTestAgent(t, dir, "agent.sock", "test@key")
+	defer a.stop()
+	defer setAuthSock(a.socket)()
+
+	key, err := FindAgentKey("test@key")
+	if err != nil {
+		t.Fatalf("Failed to find key by comment: %s", err)
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	for _, selector := range []string{"", fingerprint, fingerprint[len("SHA256:"):]} {
+		found, err := FindAgentKey(selector)
+		if err != nil {
+			t.Fatalf("Failed to find key using selector '%s': %s", selector, err)
+		}
+		if string(found.Marshal()) != string(key.Marshal()) {
+			t.Errorf("Selector '%s' returned a different key", selector)
+		}
+	}
+	if _, err := FindAgentKey("missing@key"); err == nil {
+		t.Error("Expected an error for a key which is not in the agent")
+	}
+}
+
+func TestFindAgentKeyNoAgent(t *testing.T) {
+	defer setAuthSock("")()
+	if _, err := FindAgentKey(""); err == nil {
+		t.Error("Expected an error when SSH_AUTH_SOCK is not set")
+	}
+}
+
+func TestAgentReconnect(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	first := startTestAgent(t, dir, "first.sock", "first@key")
+	defer setAuthSock(first.socket)()
+	if _, err := FindAgentKey("first@key"); err != nil {
+		t.Fatalf("Failed to find key in the first agent: %s", err)
+	}
+
+	// the agent is restarted on a new socket, which breaks the cached connection
+	first.stop()
+	second := startTestAgent(t, dir, "second.sock", "second@key")
+	defer second.stop()
+	os.Setenv("SSH_AUTH_SOCK", second.socket)
+	if _, err := FindAgentKey("second@key"); err != nil {
+		t.Fatalf("Expected a new connection to the restarted agent, got: %s", err)
+	}
+}
@@ -0,0 +1,455 @@
+package ssh
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// ProgressFunc is called periodically during a file transfer with the number of bytes transferred so far
+type ProgressFunc func(file string, transferred int64, size int64)
+
+// CopiedFile holds the local and remote path of a file transferred over SSH
+type CopiedFile struct {
+	Local  string
+	Remote string
+	Size   int64
+}
+
+type progressReader struct {
+	r           io.Reader
+	file        string
+	size        int64
+	transferred int64
+	progress    ProgressFunc
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.transferred += int64(n)
+	if pr.progress != nil && n > 0 {
+		pr.progress(pr.file, pr.transferred, pr.size)
+	}
+	return n, err
+}
+
+// ShellQuote quotes a string so that it can be safely used as a single argument in a remote shell command
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runCommand executes a command without requesting a pseudo terminal and returns its combined output
+func runCommand(cmd string, client *ssh.Client) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create new session")
+	}
+	defer session.Close()
+
+	log.Debugf("Executing (SSH) command '%s'", cmd)
+	output, err := session.CombinedOutput(cmd)
+	if err != nil {
+		return string(output), errors.Wrapf(err, "Failed to execute command '%s'", cmd)
+	}
+	return string(output), nil
+}
+
+// readAck reads an SCP protocol acknowledgement and returns an error if the remote reported one
+func readAck(r *bufio.Reader) error {
+	code, err := r.ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "Failed to read SCP acknowledgement")
+	}
+	if code == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return errors.Errorf("Remote SCP error: %s", strings.TrimSpace(msg))
+}
+
+func remoteIsDir(client *ssh.Client, remotePath string) bool {
+	_, err := runCommand("test -d "+ShellQuote(remotePath), client)
+	return err == nil
+}
+
+// Upload copies a local file or directory to a remote path using the SCP protocol. Directories are only copied if recursive is set
+func Upload(client *ssh.Client, localPath string, remotePath string, recursive bool, progress ProgressFunc) ([]CopiedFile, error) {
+	finfo, err := os.Stat(localPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not stat '%s'", localPath)
+	}
+	if finfo.IsDir() && !recursive {
+		return nil, errors.Errorf("'%s' is a directory. Use the recursive option to copy it", localPath)
+	}
+	if remotePath == "" {
+		remotePath = "."
+	}
+
+	// the remote scp follows the same semantics as cp: if the destination is a directory, the source is copied inside it
+	remoteBase := remotePath
+	if remoteIsDir(client, remotePath) {
+		remoteBase = path.Join(remotePath, filepath.Base(localPath))
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create new session")
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open SCP session")
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open SCP session")
+	}
+	r := bufio.NewReader(stdout)
+
+	cmd := "scp -qt " + ShellQuote(remotePath)
+	if recursive {
+		cmd = "scp -qrt " + ShellQuote(remotePath)
+	}
+	log.Debugf("Executing (SSH) command '%s'", cmd)
+	err = session.Start(cmd)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to start remote SCP")
+	}
+	err = readAck(r)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []CopiedFile{}
+	err = uploadEntry(stdin, r, localPath, remoteBase, finfo, progress, &files)
+	if err != nil {
+		return files, err
+	}
+	stdin.Close()
+
+	err = session.Wait()
+	if err != nil {
+		return files, errors.Wrap(err, "Remote SCP failed")
+	}
+	return files, nil
+}
+
+func uploadEntry(w io.Writer, r *bufio.Reader, localPath string, remotePath string, finfo os.FileInfo, progress ProgressFunc, files *[]CopiedFile) error {
+	if finfo.IsDir() {
+		_, err := fmt.Fprintf(w, "D%04o 0 %s\n", finfo.Mode().Perm(), finfo.Name())
+		if err != nil {
+			return errors.Wrapf(err, "Failed to send directory '%s'", localPath)
+		}
+		err = readAck(r)
+		if err != nil {
+			return err
+		}
+		entries, err := ioutil.ReadDir(localPath)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read directory '%s'", localPath)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && !entry.Mode().IsRegular() {
+				log.Warnf("Skipping '%s': not a regular file", filepath.Join(localPath, entry.Name()))
+				continue
+			}
+			err = uploadEntry(w, r, filepath.Join(localPath, entry.Name()), path.Join(remotePath, entry.Name()), entry, progress, files)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprint(w, "E\n")
+		if err != nil {
+			return errors.Wrapf(err, "Failed to send directory '%s'", localPath)
+		}
+		return readAck(r)
+	}
+
+	fd, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open '%s'", localPath)
+	}
+	defer fd.Close()
+
+	_, err = fmt.Fprintf(w, "C%04o %d %s\n", finfo.Mode().Perm(), finfo.Size(), finfo.Name())
+	if err != nil {
+		return errors.Wrapf(err, "Failed to send file '%s'", localPath)
+	}
+	err = readAck(r)
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(localPath, 0, finfo.Size())
+	}
+	pr := &progressReader{r: fd, file: localPath, size: finfo.Size(), progress: progress}
+	n, err := io.Copy(w, pr)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to send file '%s'", localPath)
+	}
+	if n != finfo.Size() {
+		return errors.Errorf("File '%s' changed size during the transfer", localPath)
+	}
+	_, err = w.Write([]byte{0})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to send file '%s'", localPath)
+	}
+	err = readAck(r)
+	if err != nil {
+		return err
+	}
+	*files = append(*files, CopiedFile{Local: localPath, Remote: remotePath, Size: finfo.Size()})
+	return nil
+}
+
+// parseSCPHeader parses a 'C' or 'D' SCP header line and returns the mode, size and name of the entry
+func parseSCPHeader(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(strings.TrimSuffix(line[1:], "\n"), " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", errors.Errorf("Invalid SCP header '%s'", strings.TrimSpace(line))
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errors.Wrapf(err, "Invalid mode in SCP header '%s'", strings.TrimSpace(line))
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, "", errors.Wrapf(err, "Invalid size in SCP header '%s'", strings.TrimSpace(line))
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", errors.Errorf("Invalid file name '%s' in SCP header", name)
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// Download copies a remote file or directory to a local path using the SCP protocol. Directories are only copied if recursive is set
+func Download(client *ssh.Client, remotePath string, localPath string, recursive bool, progress ProgressFunc) ([]CopiedFile, error) {
+	if remotePath == "" {
+		return nil, errors.New("Remote path cannot be empty")
+	}
+
+	// same semantics as cp: if the local destination is a directory, the source is copied inside it
+	localTargetIsDir := false
+	if finfo, err := os.Stat(localPath); err == nil && finfo.IsDir() {
+		localTargetIsDir = true
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create new session")
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open SCP session")
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open SCP session")
+	}
+	r := bufio.NewReader(stdout)
+
+	cmd := "scp -qf " + ShellQuote(remotePath)
+	if recursive {
+		cmd = "scp -qrf " + ShellQuote(remotePath)
+	}
+	log.Debugf("Executing (SSH) command '%s'", cmd)
+	err = session.Start(cmd)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to start remote SCP")
+	}
+
+	ack := func() error {
+		_, err := stdin.Write([]byte{0})
+		return err
+	}
+
+	files := []CopiedFile{}
+	// localDirs and remoteDirs track the directory we are currently writing to
+	localDirs := []string{}
+	remoteDirs := []string{}
+	targetPath := func(name string) (string, string) {
+		if len(localDirs) == 0 {
+			if localTargetIsDir {
+				return filepath.Join(localPath, name), remotePath
+			}
+			return localPath, remotePath
+		}
+		return filepath.Join(localDirs[len(localDirs)-1], name), path.Join(remoteDirs[len(remoteDirs)-1], name)
+	}
+
+	err = ack()
+	if err != nil {
+		return files, errors.Wrap(err, "Failed to start SCP transfer")
+	}
+	for {
+		code, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return files, errors.Wrap(err, "Failed to read from remote SCP")
+		}
+
+		switch code {
+		case 1, 2:
+			msg, _ := r.ReadString('\n')
+			return files, errors.Errorf("Remote SCP error: %s", strings.TrimSpace(msg))
+		case 'T':
+			// timestamps are ignored
+			_, err = r.ReadString('\n')
+			if err != nil {
+				return files, errors.Wrap(err, "Failed to read from remote SCP")
+			}
+		case 'E':
+			_, err = r.ReadString('\n')
+			if err != nil {
+				return files, errors.Wrap(err, "Failed to read from remote SCP")
+			}
+			if len(localDirs) == 0 {
+				return files, errors.New("Remote SCP sent an unexpected end of directory")
+			}
+			localDirs = localDirs[:len(localDirs)-1]
+			remoteDirs = remoteDirs[:len(remoteDirs)-1]
+		case 'D':
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return files, errors.Wrap(err, "Failed to read from remote SCP")
+			}
+			mode, _, name, err := parseSCPHeader(string(code) + line)
+			if err != nil {
+				return files, err
+			}
+			localDir, remoteDir := targetPath(name)
+			err = os.MkdirAll(localDir, mode|0700)
+			if err != nil {
+				return files, errors.Wrapf(err, "Failed to create directory '%s'", localDir)
+			}
+			localDirs = append(localDirs, localDir)
+			remoteDirs = append(remoteDirs, remoteDir)
+		case 'C':
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return files, errors.Wrap(err, "Failed to read from remote SCP")
+			}
+			mode, size, name, err := parseSCPHeader(string(code) + line)
+			if err != nil {
+				return files, err
+			}
+			localFile, remoteFile := targetPath(name)
+			err = ack()
+			if err != nil {
+				return files, errors.Wrap(err, "Failed to acknowledge SCP header")
+			}
+			err = downloadFile(r, localFile, mode, size, progress)
+			if err != nil {
+				return files, err
+			}
+			err = readAck(r)
+			if err != nil {
+				return files, err
+			}
+			files = append(files, CopiedFile{Local: localFile, Remote: remoteFile, Size: size})
+		default:
+			return files, errors.Errorf("Unexpected SCP message type '%c'", code)
+		}
+
+		err = ack()
+		if err != nil {
+			return files, errors.Wrap(err, "Failed to acknowledge SCP message")
+		}
+	}
+
+	err = session.Wait()
+	if err != nil {
+		return files, errors.Wrap(err, "Remote SCP failed")
+	}
+	return files, nil
+}
+
+func downloadFile(r io.Reader, localFile string, mode os.FileMode, size int64, progress ProgressFunc) error {
+	fd, err := os.OpenFile(localFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create file '%s'", localFile)
+	}
+	defer fd.Close()
+
+	if progress != nil {
+		progress(localFile, 0, size)
+	}
+	pr := &progressReader{r: io.LimitReader(r, size), file: localFile, size: size, progress: progress}
+	n, err := io.Copy(fd, pr)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write file '%s'", localFile)
+	}
+	if n != size {
+		return errors.Errorf("Transfer of '%s' ended prematurely", localFile)
+	}
+	return nil
+}
+
+func localChecksum(file string) (string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksums compares the SHA256 checksum of the local and remote copies of the provided files
+func VerifyChecksums(client *ssh.Client, files []CopiedFile) error {
+	// checksums are retrieved in batches to avoid hitting the remote command line length limit
+	batchSize := 100
+	for start := 0; start < len(files); start += batchSize {
+		end := start + batchSize
+		if end > len(files) {
+			end = len(files)
+		}
+		batch := files[start:end]
+
+		args := []string{}
+		for _, file := range batch {
+			args = append(args, ShellQuote(file.Remote))
+		}
+		out, err := runCommand("sha256sum -- "+strings.Join(args, " "), client)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to retrieve remote checksums: %s", strings.TrimSpace(out))
+		}
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if len(lines) != len(batch) {
+			return errors.Errorf("Expected %d remote checksums but got %d", len(batch), len(lines))
+		}
+
+		for i, file := range batch {
+			remoteSum := strings.TrimPrefix(strings.Fields(lines[i])[0], "\\")
+			localSum, err := localChecksum(file.Local)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to compute checksum for '%s'", file.Local)
+			}
+			if localSum != remoteSum {
+				return errors.Errorf("Checksum mismatch for '%s': local '%s', remote '%s'", file.Remote, localSum, remoteSum)
+			}
+		}
+	}
+	return nil
+}
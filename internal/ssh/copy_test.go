@@ -0,0 +1,164 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path string, content string, mode os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory for '%s': %s", path, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatalf("Failed to write '%s': %s", path, err)
+	}
+}
+
+func checkTestFile(t *testing.T, path string, expected string) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read '%s': %s", path, err)
+	}
+	if string(content) != expected {
+		t.Fatalf("Expected '%s' to contain %q, got %q", path, expected, string(content))
+	}
+}
+
+func TestCopy(t *testing.T) {
+	addr, _ := startTestServer(t)
+	c := dialTest(t, addr)
+	defer c.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello", 0644)
+	writeTestFile(t, filepath.Join(src, "sub", "b it's.txt"), "world!!", 0600)
+	dst := filepath.Join(dir, "dst")
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatalf("Failed to create '%s': %s", dst, err)
+	}
+
+	// directories are copied inside existing destination directories
+	files, err := Upload(c, src, dst, true, nil)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 uploaded files, got %v (%v)", files, err)
+	}
+	if err := VerifyChecksums(c, files); err != nil {
+		t.Fatalf("Checksums of uploaded files don't match: %s", err)
+	}
+	checkTestFile(t, filepath.Join(dst, "src", "sub", "b it's.txt"), "world!!")
+
+	// single files are copied to the destination name if it doesn't exist
+	renamed := filepath.Join(dir, "renamed.txt")
+	files, err = Upload(c, filepath.Join(src, "a.txt"), renamed, false, nil)
+	if err != nil || len(files) != 1 || files[0].Remote != renamed {
+		t.Fatalf("Expected a single file uploaded to '%s', got %v (%v)", renamed, files, err)
+	}
+	if _, err := Upload(c, src, dst, false, nil); err == nil {
+		t.Fatal("Expected an error when uploading a directory without the recursive option")
+	}
+
+	down := filepath.Join(dir, "down")
+	files, err = Download(c, src, down, true, nil)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 downloaded files, got %v (%v)", files, err)
+	}
+	if err := VerifyChecksums(c, files); err != nil {
+		t.Fatalf("Checksums of downloaded files don't match: %s", err)
+	}
+	checkTestFile(t, filepath.Join(down, "sub", "b it's.txt"), "world!!")
+
+	files, err = Download(c, filepath.Join(src, "a.txt"), down, false, nil)
+	if err != nil || len(files) != 1 || files[0].Local != filepath.Join(down, "a.txt") {
+		t.Fatalf("Expected a single file downloaded inside '%s', got %v (%v)", down, files, err)
+	}
+	if _, err = Download(c, filepath.Join(src, "missing"), down, false, nil); err == nil {
+		t.Fatal("Expected an error when downloading a missing file")
+	}
+
+	// a remote file which changed after the transfer is reported
+	writeTestFile(t, renamed, "changed", 0644)
+	err = VerifyChecksums(c, []CopiedFile{{Local: filepath.Join(src, "a.txt"), Remote: renamed}})
+	if err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+		t.Fatalf("Expected a checksum mismatch, got: %v", err)
+	}
+}
+
+// fakeSCP is a remote scp which sends one file and then a warning when sending (-f), and rejects every file with a
+// warning when receiving (-t)
+const fakeSCP = `#!/bin/sh
+case "$1" in
+*f*)
+	head -c 1 >/dev/null
+	printf 'C0644 5 first.txt\n'
+	head -c 1 >/dev/null
+	printf 'hello\000'
+	head -c 1 >/dev/null
+	printf '\001scp: second.txt: Permission denied\n'
+	exit 1
+	;;
+*)
+	printf '\000'
+	head -n 1 >/dev/null
+	printf '\001scp: protected.txt: Permission denied\n'
+	exit 1
+	;;
+esac
+`
+
+// installFakeSCP puts fakeSCP first in PATH, which is inherited by the commands run by the test server. It returns a
+// function which restores PATH
+func installFakeSCP(t *testing.T, dir string) func() {
+	bin := filepath.Join(dir, "bin")
+	writeTestFile(t, filepath.Join(bin, "scp"), fakeSCP, 0755)
+	return setEnv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// setEnv sets an environment variable and returns a function which restores its previous value
+func setEnv(name string, value string) func() {
+	previous, found := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if found {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestCopyRemoteWarnings(t *testing.T) {
+	addr, _ := startTestServer(t)
+	c := dialTest(t, addr)
+	defer c.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	local := filepath.Join(dir, "protected.txt")
+	writeTestFile(t, local, "secret", 0644)
+	defer installFakeSCP(t, dir)()
+
+	// the warning stops the download, and the files received before it are returned
+	down := filepath.Join(dir, "down")
+	if err := os.MkdirAll(down, 0755); err != nil {
+		t.Fatalf("Failed to create '%s': %s", down, err)
+	}
+	files, err := Download(c, "/remote", down, true, nil)
+	if err == nil || !strings.Contains(err.Error(), "second.txt: Permission denied") {
+		t.Fatalf("Expected the remote warning, got: %v", err)
+	}
+	if len(files) != 1 || files[0].Remote != "/remote" {
+		t.Fatalf("Expected the file received before the warning, got %v", files)
+	}
+	checkTestFile(t, filepath.Join(down, "first.txt"), "hello")
+
+	files, err = Upload(c, local, "/remote", false, nil)
+	if err == nil || !strings.Contains(err.Error(), "protected.txt: Permission denied") {
+		t.Fatalf("Expected the remote warning, got: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected no uploaded files, got %v", files)
+	}
+}
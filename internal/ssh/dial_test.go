@@ -0,0 +1,68 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+// TestProxyCommandHelper is not a real test. It's run as a proxy command by TestDialProxyCommand, and connects its
+// stdin and stdout to the address passed as its last argument
+func TestProxyCommandHelper(t *testing.T) {
+	if os.Getenv("PROTOS_TEST_PROXY_COMMAND") != "1" {
+		return
+	}
+	conn, err := net.Dial("tcp", os.Args[len(os.Args)-1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.Close()
+	}()
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+// checkCommand runs a command over an SSH connection made using cfg
+func checkCommand(t *testing.T, cfg ConnectionConfig) {
+	c, err := Dial(cfg)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer c.Close()
+	out, err := ExecuteCommand("echo hi", c)
+	if err != nil || out != "hi\n" {
+		t.Fatalf("Expected the command output, got %q (%v)", out, err)
+	}
+}
+
+func TestDialJumpHosts(t *testing.T) {
+	jump, _ := startTestServer(t)
+	target, _ := startTestServer(t)
+	cfg := testConfig(target)
+	cfg.JumpHosts = []ConnectionConfig{testConfig(jump), testConfig(jump)}
+	checkCommand(t, cfg)
+
+	unreachable := testConfig("127.0.0.1:1")
+	cfg.JumpHosts = []ConnectionConfig{testConfig(jump), unreachable}
+	if _, err := Dial(cfg); err == nil {
+		t.Fatal("Expected an error for an unreachable jump host")
+	}
+}
+
+func TestDialProxyCommand(t *testing.T) {
+	target, _ := startTestServer(t)
+	cfg := testConfig(target)
+	cfg.ProxyCommand = fmt.Sprintf("PROTOS_TEST_PROXY_COMMAND=1 %s -test.run=TestProxyCommandHelper -- %%h:%%p", ShellQuote(os.Args[0]))
+	checkCommand(t, cfg)
+
+	cfg = testConfig(target)
+	cfg.ProxyCommand = "exit 1"
+	if _, err := Dial(cfg); err == nil {
+		t.Fatal("Expected an error for a proxy command which exits")
+	}
+}
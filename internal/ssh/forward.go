@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ForwardType indicates the direction of a port forward
+type ForwardType int
+
+const (
+	// LocalForward listens on the local machine and forwards connections to a target reachable from the remote host
+	LocalForward ForwardType = iota
+	// RemoteForward listens on the remote host and forwards connections to a target reachable from the local machine
+	RemoteForward
+)
+
+func (ft ForwardType) String() string {
+	if ft == RemoteForward {
+		return "remote"
+	}
+	return "local"
+}
+
+// Forward describes a single port forward carried over an SSH tunnel
+type Forward struct {
+	Type       ForwardType
+	ListenAddr string
+	TargetAddr string
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s %s -> %s", f.Type.String(), f.ListenAddr, f.TargetAddr)
+}
+
+// splitForwardSpec splits a forward specification on colons, ignoring the ones enclosed in square brackets (IPv6 addresses)
+func splitForwardSpec(spec string) []string {
+	parts := []string{}
+	current := ""
+	inBrackets := false
+	for _, c := range spec {
+		switch {
+		case c == '[':
+			inBrackets = true
+		case c == ']':
+			inBrackets = false
+		case c == ':' && !inBrackets:
+			parts = append(parts, current)
+			current = ""
+		default:
+			current += string(c)
+		}
+	}
+	return append(parts, current)
+}
+
+func validPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p >= 0 && p <= 65535
+}
+
+// ParseForward parses a forward specification using the '[bind_address:]port:host:hostport' format used by ssh -L and -R.
+// Only TCP is supported, because SSH can't carry UDP without a relay running on the remote host
+func ParseForward(spec string, forwardType ForwardType) (Forward, error) {
+	fwd := Forward{Type: forwardType}
+	if strings.HasSuffix(spec, "/udp") {
+		return fwd, errors.Errorf("Invalid forward '%s'. UDP forwards are not supported", spec)
+	}
+	spec = strings.TrimSuffix(spec, "/tcp")
+
+	parts := splitForwardSpec(spec)
+	bindAddr := "localhost"
+	switch len(parts) {
+	case 3:
+	case 4:
+		bindAddr = parts[0]
+		parts = parts[1:]
+	default:
+		return fwd, errors.Errorf("Invalid forward '%s'. Expected format is '[bind_address:]port:host:hostport'", spec)
+	}
+	if !validPort(parts[0]) || !validPort(parts[2]) {
+		return fwd, errors.Errorf("Invalid port in forward '%s'", spec)
+	}
+	if parts[1] == "" {
+		return fwd, errors.Errorf("Invalid host in forward '%s'", spec)
+	}
+
+	fwd.ListenAddr = net.JoinHostPort(bindAddr, parts[0])
+	fwd.TargetAddr = net.JoinHostPort(parts[1], parts[2])
+	return fwd, nil
+}
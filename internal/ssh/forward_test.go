@@ -0,0 +1,44 @@
+package ssh
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	valid := map[string]string{
+		"8080:localhost:80":          "local localhost:8080 -> localhost:80",
+		"0.0.0.0:53:10.0.0.1:53/tcp": "local 0.0.0.0:53 -> 10.0.0.1:53",
+		"[::1]:80:[fe80::1]:8080":    "local [::1]:80 -> [fe80::1]:8080",
+	}
+	for spec, expected := range valid {
+		f, err := ParseForward(spec, LocalForward)
+		if err != nil {
+			t.Errorf("Failed to parse forward '%s': %s", spec, err)
+		} else if f.String() != expected {
+			t.Errorf("Forward '%s' parsed as '%s', expected '%s'", spec, f.String(), expected)
+		}
+	}
+
+	invalid := []string{"80", "a:b:c", "80:host", "1:2:3:4:5", "53:10.0.0.1:53/udp"}
+	for _, spec := range invalid {
+		if _, err := ParseForward(spec, LocalForward); err == nil {
+			t.Errorf("Expected an error for forward '%s'", spec)
+		}
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	addr, _ := startTestServer(t)
+	tun := newTestTunnel(addr, echoServer(t))
+	port, err := tun.Start()
+	if err != nil {
+		t.Fatalf("Failed to start tunnel: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		checkEcho(t, fmt.Sprintf("127.0.0.1:%d", port))
+	}
+	if err := tun.Close(); err != nil {
+		t.Fatalf("Failed to close tunnel: %s", err)
+	}
+}
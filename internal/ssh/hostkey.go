@@ -0,0 +1,122 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyMismatchError is returned when a server presents a host key that differs from the pinned one
+type HostKeyMismatchError struct {
+	Host     string
+	Expected ssh.PublicKey
+	Received ssh.PublicKey
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("Host key verification failed for '%s'. Expected %s key %s, but the server presented %s key %s. "+
+		"The server might have been rebuilt, or someone could be intercepting the connection",
+		e.Host, e.Expected.Type(), ssh.FingerprintSHA256(e.Expected), e.Received.Type(), ssh.FingerprintSHA256(e.Received))
+}
+
+// hostKeyPin holds the host key trusted for a server. If no key has been pinned yet, the first key seen is trusted,
+// provided that it's one of the candidates (when there are any)
+type hostKeyPin struct {
+	lock       sync.Mutex
+	key        []byte
+	candidates []ssh.PublicKey
+	save       func(key ssh.PublicKey) error
+}
+
+func (p *hostKeyPin) isCandidate(key ssh.PublicKey) bool {
+	for _, candidate := range p.candidates {
+		if bytes.Equal(candidate.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *hostKeyPin) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.key) == 0 {
+		if len(p.candidates) > 0 && !p.isCandidate(key) {
+			return &HostKeyMismatchError{Host: hostname, Expected: p.candidates[0], Received: key}
+		}
+		if p.save != nil {
+			err := p.save(key)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to pin host key for '%s'", hostname)
+			}
+		}
+		p.key = key.Marshal()
+		return nil
+	}
+
+	if !bytes.Equal(p.key, key.Marshal()) {
+		expected, err := ssh.ParsePublicKey(p.key)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to parse pinned host key for '%s'", hostname)
+		}
+		return &HostKeyMismatchError{Host: hostname, Expected: expected, Received: key}
+	}
+	return nil
+}
+
+// PinnedHostKey returns a host key callback which only accepts the provided key (in SSH wire format). If no key is
+// provided, the first key presented by the server is trusted and passed to save, which can be nil. All connections made
+// using the same callback are then verified against that key
+func PinnedHostKey(key []byte, save func(key ssh.PublicKey) error) ssh.HostKeyCallback {
+	pin := &hostKeyPin{key: key, save: save}
+	return pin.check
+}
+
+// CapturedHostKey returns a host key callback which only accepts one of the provided keys, obtained out of band (e.g.
+// from the cloud provider API). The key presented by the server is passed to save, which can be nil, and all
+// connections made using the same callback are then verified against it
+func CapturedHostKey(keys []ssh.PublicKey, save func(key ssh.PublicKey) error) ssh.HostKeyCallback {
+	pin := &hostKeyPin{candidates: keys, save: save}
+	return pin.check
+}
+
+// HostKeyFingerprint returns the SHA256 fingerprint of a host key stored in SSH wire format
+func HostKeyFingerprint(key []byte) (string, error) {
+	pubKey, err := ssh.ParsePublicKey(key)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to parse host key")
+	}
+	return ssh.FingerprintSHA256(pubKey), nil
+}
+
+// newClient performs the SSH handshake over an established connection. Host key mismatches are returned as a
+// HostKeyMismatchError instead of the generic handshake error returned by the ssh package
+func newClient(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var mismatch *HostKeyMismatchError
+	cfg := *config
+	if config.HostKeyCallback != nil {
+		cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := config.HostKeyCallback(hostname, remote, key)
+			if e, ok := err.(*HostKeyMismatchError); ok {
+				mismatch = e
+			}
+			return err
+		}
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &cfg)
+	if mismatch != nil {
+		conn.Close()
+		return nil, mismatch
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// otherHostKey returns a public key which is not used by any test server
+func otherHostKey(t *testing.T) ssh.PublicKey {
+	other, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	otherPub, err := ssh.NewPublicKey(ed25519.PublicKey(other.Public()))
+	if err != nil {
+		t.Fatalf("Failed to convert key: %s", err)
+	}
+	return otherPub
+}
+
+func TestHostKeyPinning(t *testing.T) {
+	addr, hostKey := startTestServer(t)
+
+	// without a pinned key, the first key presented by the server is trusted and saved
+	var saved ssh.PublicKey
+	cfg := testConfig(addr)
+	cfg.HostKeyCallback = PinnedHostKey(nil, func(k ssh.PublicKey) error { saved = k; return nil })
+	c, err := Dial(cfg)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	c.Close()
+	if saved == nil || string(saved.Marshal()) != string(hostKey.Marshal()) {
+		t.Fatal("The presented host key was not saved")
+	}
+
+	cfg = testConfig(addr)
+	cfg.HostKeyCallback = PinnedHostKey(otherHostKey(t).Marshal(), nil)
+	tun := NewTunnel(cfg, "127.0.0.1:1", testLog)
+	_, err = tun.Start()
+	if _, ok := err.(*HostKeyMismatchError); !ok {
+		t.Fatalf("Expected a host key mismatch, got: %v", err)
+	}
+}
+
+func TestCapturedHostKey(t *testing.T) {
+	addr, hostKey := startTestServer(t)
+	otherPub := otherHostKey(t)
+
+	// the presented key is only trusted if it's one of the captured keys
+	cfg := testConfig(addr)
+	cfg.HostKeyCallback = CapturedHostKey([]ssh.PublicKey{otherPub}, nil)
+	if _, err := Dial(cfg); err == nil {
+		t.Fatal("Expected a host key mismatch")
+	} else if _, ok := err.(*HostKeyMismatchError); !ok {
+		t.Fatalf("Expected a host key mismatch, got: %s", err)
+	}
+
+	var saved ssh.PublicKey
+	cfg.HostKeyCallback = CapturedHostKey([]ssh.PublicKey{otherPub, hostKey}, func(k ssh.PublicKey) error { saved = k; return nil })
+	c, err := Dial(cfg)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	c.Close()
+	if saved == nil || string(saved.Marshal()) != string(hostKey.Marshal()) {
+		t.Fatal("The presented host key was not saved")
+	}
+}
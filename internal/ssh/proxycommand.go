@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyCommandConn is a net.Conn which uses the stdin and stdout of a proxy command as transport
+type proxyCommandConn struct {
+	cmd    *exec.Cmd
+	stdin  *os.File
+	stdout *os.File
+	addr   string
+	once   sync.Once
+}
+
+func (p *proxyCommandConn) Read(b []byte) (int, error) {
+	return p.stdout.Read(b)
+}
+
+func (p *proxyCommandConn) Write(b []byte) (int, error) {
+	return p.stdin.Write(b)
+}
+
+// Close terminates the proxy command. It can be called multiple times, from different goroutines
+func (p *proxyCommandConn) Close() error {
+	p.once.Do(func() {
+		p.stdin.Close()
+		p.stdout.Close()
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+	})
+	return nil
+}
+
+func (p *proxyCommandConn) LocalAddr() net.Addr {
+	return proxyCommandAddr("proxy command")
+}
+
+func (p *proxyCommandConn) RemoteAddr() net.Addr {
+	return proxyCommandAddr(p.addr)
+}
+
+// deadlines are not supported on pipes, so they are ignored
+func (p *proxyCommandConn) SetDeadline(t time.Time) error      { return nil }
+func (p *proxyCommandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (p *proxyCommandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type proxyCommandAddr string
+
+func (a proxyCommandAddr) Network() string { return "proxy" }
+func (a proxyCommandAddr) String() string  { return string(a) }
+
+// newProxyCommandConn starts the proxy command of the provided config and returns a connection wrapping it
+func newProxyCommandConn(cc ConnectionConfig) (net.Conn, error) {
+	port := cc.Port
+	if port == 0 {
+		port = 22
+	}
+	command := strings.NewReplacer("%h", cc.Host, "%p", strconv.Itoa(port), "%r", cc.clientConfig().User, "%%", "%").Replace(cc.ProxyCommand)
+
+	// the pipes are created manually, so that closing the connection doesn't race with pending reads
+	stdinReader, stdin, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to run proxy command '%s'", command)
+	}
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdin.Close()
+		return nil, errors.Wrapf(err, "Failed to run proxy command '%s'", command)
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	stdinReader.Close()
+	stdoutWriter.Close()
+	if err != nil {
+		stdin.Close()
+		stdout.Close()
+		return nil, errors.Wrapf(err, "Failed to run proxy command '%s'", command)
+	}
+	return &proxyCommandConn{cmd: cmd, stdin: stdin, stdout: stdout, addr: cc.Address()}, nil
+}
@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitForStates checks that the tunnel goes through the provided states, in order
+func waitForStates(t *testing.T, tun *Tunnel, states ...TunnelState) {
+	deadline := time.After(10 * time.Second)
+	for _, expected := range states {
+		select {
+		case state := <-tun.StateChanges():
+			if state != expected {
+				t.Fatalf("Expected tunnel state '%s', got '%s'", expected, state)
+			}
+		case <-deadline:
+			t.Fatalf("Timed out waiting for tunnel state '%s'", expected)
+		}
+	}
+}
+
+func TestTunnelReconnect(t *testing.T) {
+	addr, _ := startTestServer(t)
+	tun := newTestTunnel(addr, echoServer(t))
+	port, err := tun.Start()
+	if err != nil {
+		t.Fatalf("Failed to start tunnel: %s", err)
+	}
+	defer tun.Close()
+	waitForStates(t, tun, TunnelConnected)
+
+	tun.client().Close()
+	waitForStates(t, tun, TunnelReconnecting, TunnelConnected)
+	checkEcho(t, fmt.Sprintf("127.0.0.1:%d", port))
+
+	tun.Close()
+	if tun.State() != TunnelClosed {
+		t.Fatalf("Expected the tunnel to be closed, got '%s'", tun.State())
+	}
+}
+
+func TestTunnelReconnectServerDown(t *testing.T) {
+	server := newTestServer(t)
+	tun := newTestTunnel(server.addr, echoServer(t))
+	port, err := tun.Start()
+	if err != nil {
+		t.Fatalf("Failed to start tunnel: %s", err)
+	}
+	defer tun.Close()
+	waitForStates(t, tun, TunnelConnected)
+
+	// the first reconnect attempt fails while the server is down, and the tunnel keeps trying until it's back
+	server.stop()
+	waitForStates(t, tun, TunnelReconnecting)
+	time.Sleep(1500 * time.Millisecond)
+	if tun.State() != TunnelReconnecting {
+		t.Fatalf("Expected the tunnel to be reconnecting while the server is down, got '%s'", tun.State())
+	}
+	server.start(t)
+	waitForStates(t, tun, TunnelConnected)
+	checkEcho(t, fmt.Sprintf("127.0.0.1:%d", port))
+}
+
+func TestTunnelReconnectHostKeyMismatch(t *testing.T) {
+	server := newTestServer(t)
+	tun := newTestTunnel(server.addr, echoServer(t))
+	if _, err := tun.Start(); err != nil {
+		t.Fatalf("Failed to start tunnel: %s", err)
+	}
+	defer tun.Close()
+	waitForStates(t, tun, TunnelConnected)
+
+	// the server comes back with a different host key, so the tunnel gives up instead of retrying
+	server.stop()
+	server.rotateHostKey(t)
+	server.start(t)
+	waitForStates(t, tun, TunnelReconnecting, TunnelClosed)
+	if _, ok := tun.Err().(*HostKeyMismatchError); !ok {
+		t.Fatalf("Expected a host key mismatch, got: %v", tun.Err())
+	}
+}
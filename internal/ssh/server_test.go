@@ -0,0 +1,264 @@
+package ssh
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+var testLog = logrus.New()
+
+// testServer is an SSH server which accepts any client, executes commands using the local shell and supports local
+// port forwarding. It can be stopped and started again on the same address, to test reconnects
+type testServer struct {
+	addr     string
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	lock     sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+}
+
+// newTestServer starts a test server on a random local port, using a new host key
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{addr: "127.0.0.1:0"}
+	s.rotateHostKey(t)
+	s.start(t)
+	return s
+}
+
+// rotateHostKey generates a new host key, which is used for the connections accepted after the next start
+func (s *testServer) rotateHostKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to create host key signer: %s", err)
+	}
+	s.config = &ssh.ServerConfig{NoClientAuth: true}
+	s.config.AddHostKey(signer)
+	s.hostKey = signer.PublicKey()
+}
+
+// start listens on the address of the server and accepts connections until stop is called
+func (s *testServer) start(t *testing.T) {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		t.Fatalf("Failed to start SSH server: %s", err)
+	}
+	s.addr = l.Addr().String()
+	s.lock.Lock()
+	s.listener = l
+	s.lock.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns = append(s.conns, conn)
+			s.lock.Unlock()
+			go s.serve(conn, s.config)
+		}
+	}()
+}
+
+// stop closes the listener and all the client connections, like a server that went down
+func (s *testServer) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listener.Close()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go func() {
+		for req := range reqs {
+			if req.WantReply {
+				req.Reply(req.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}()
+
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			go serveSession(newChannel)
+		case "direct-tcpip":
+			go serveDirectTCPIP(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// serveSession handles exec requests by running the command with 'sh -c'. Pseudo terminals are accepted but ignored
+func serveSession(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	for req := range reqs {
+		if req.Type != "exec" {
+			if req.WantReply {
+				req.Reply(req.Type == "pty-req", nil)
+			}
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go runSessionCommand(channel, payload.Command)
+	}
+}
+
+func runSessionCommand(channel ssh.Channel, command string) {
+	defer channel.Close()
+	cmd := exec.Command("sh", "-c", command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+
+	status := struct{ Status uint32 }{0}
+	if err := cmd.Run(); err != nil {
+		status.Status = 1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status.Status = uint32(exitErr.ExitCode())
+		}
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(status))
+}
+
+// serveDirectTCPIP connects a local port forwarding channel to its destination
+func serveDirectTCPIP(newChannel ssh.NewChannel) {
+	var dest struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &dest); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+	}()
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+}
+
+// startTestServer starts a test server and returns its address and host key
+func startTestServer(t *testing.T) (string, ssh.PublicKey) {
+	s := newTestServer(t)
+	return s.addr, s.hostKey
+}
+
+// testConfig returns the connection config for a test server. The first host key presented by the server is pinned
+func testConfig(addr string) ConnectionConfig {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return ConnectionConfig{Host: host, Port: p, User: "root", Auth: ssh.Password(""), HostKeyCallback: PinnedHostKey(nil, nil)}
+}
+
+// dialTest connects to a test server without verifying its host key
+func dialTest(t *testing.T, addr string) *ssh.Client {
+	c, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "root", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("Failed to connect to SSH server: %s", err)
+	}
+	return c
+}
+
+func newTestTunnel(addr string, target string) *Tunnel {
+	testLog.SetLevel(logrus.DebugLevel)
+	return NewTunnel(testConfig(addr), target, testLog)
+}
+
+// echoServer starts a TCP server which echoes back every line it receives, prefixed with 'echo:'
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start echo server: %s", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fmt.Fprint(c, "echo:"+line)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// checkEcho sends a line to an echo server reached via addr, and checks the reply
+func checkEcho(t *testing.T, addr string) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to '%s': %s", addr, err)
+	}
+	defer c.Close()
+	fmt.Fprint(c, "hi\n")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "echo:hi\n" {
+		t.Fatalf("Expected the echo reply via '%s', got %q (%v)", addr, line, err)
+	}
+}
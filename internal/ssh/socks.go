@@ -0,0 +1,236 @@
+package ssh
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	socksVersion         = 5
+	socksNoAuth          = 0
+	socksNoAcceptable    = 0xff
+	socksCmdConnect      = 1
+	socksAddrIPv4        = 1
+	socksAddrDomain      = 3
+	socksAddrIPv6        = 4
+	socksSucceeded       = 0
+	socksGeneralFailure  = 1
+	socksHostUnreach     = 4
+	socksCmdUnsupported  = 7
+	socksAddrUnsupported = 8
+)
+
+// SOCKSProxy is a SOCKS5 server which opens all its connections via an SSH connection
+type SOCKSProxy struct {
+	sshConn  *ssh.Client
+	listener net.Listener
+	domain   string
+	resolver *net.Resolver
+	log      *logrus.Logger
+	lock     sync.Mutex
+	connMap  map[net.Conn]chan bool
+}
+
+// resolve returns the address that should be dialed over SSH for a specific host. Hosts in the proxy domain are resolved
+// using the remote DNS server, while the rest are left for the remote SSH server to resolve
+func (p *SOCKSProxy) resolve(host string) (string, error) {
+	host = strings.TrimSuffix(host, ".")
+	if p.resolver == nil || p.domain == "" || net.ParseIP(host) != nil {
+		return host, nil
+	}
+	if host != p.domain && !strings.HasSuffix(host, "."+p.domain) {
+		return host, nil
+	}
+
+	addrs, err := p.resolver.LookupHost(context.Background(), host)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to resolve '%s' using the remote DNS server", host)
+	}
+	if len(addrs) == 0 {
+		return "", errors.Errorf("No addresses found for '%s'", host)
+	}
+	return addrs[0], nil
+}
+
+func socksReply(conn net.Conn, status byte) error {
+	// the bound address is not relevant for the client, so it's always reported as 0.0.0.0:0
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// handshake performs the SOCKS5 negotiation and returns the requested destination
+func (p *SOCKSProxy) handshake(conn net.Conn) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", errors.Wrap(err, "Failed to read SOCKS greeting")
+	}
+	if header[0] != socksVersion {
+		return "", "", errors.Errorf("Unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", errors.Wrap(err, "Failed to read SOCKS authentication methods")
+	}
+	noAuth := false
+	for _, m := range methods {
+		if m == socksNoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", "", errors.New("SOCKS client does not support unauthenticated access")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", "", errors.Wrap(err, "Failed to write SOCKS reply")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", "", errors.Wrap(err, "Failed to read SOCKS request")
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksCmdUnsupported)
+		return "", "", errors.Errorf("Unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if request[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", "", errors.Wrap(err, "Failed to read SOCKS destination")
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", "", errors.Wrap(err, "Failed to read SOCKS destination")
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", "", errors.Wrap(err, "Failed to read SOCKS destination")
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddrUnsupported)
+		return "", "", errors.Errorf("Unsupported SOCKS address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", "", errors.Wrap(err, "Failed to read SOCKS destination")
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(port))), nil
+}
+
+func (p *SOCKSProxy) handle(conn net.Conn) {
+	host, port, err := p.handshake(conn)
+	if err != nil {
+		p.log.Errorf("SOCKS request from '%s' failed: %s", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	addr, err := p.resolve(host)
+	if err != nil {
+		p.log.Error(err)
+		socksReply(conn, socksHostUnreach)
+		conn.Close()
+		return
+	}
+
+	p.log.Debugf("SOCKS connection from '%s' to '%s'", conn.RemoteAddr().String(), net.JoinHostPort(host, port))
+	remoteConn, err := p.sshConn.Dial("tcp", net.JoinHostPort(addr, port))
+	if err != nil {
+		p.log.Errorf("Failed to establish remote connection to '%s' over SSH: %s", net.JoinHostPort(host, port), err.Error())
+		socksReply(conn, socksGeneralFailure)
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		conn.Close()
+		remoteConn.Close()
+		return
+	}
+
+	close := make(chan bool, 1)
+	p.lock.Lock()
+	p.connMap[conn] = close
+	p.lock.Unlock()
+
+	newForwarder(conn, remoteConn, close, p.log).proxy()
+
+	p.lock.Lock()
+	delete(p.connMap, conn)
+	p.lock.Unlock()
+}
+
+// Start starts listening for SOCKS connections on the provided address and returns the address actually used
+func (p *SOCKSProxy) Start(listenAddr string) (string, error) {
+	var err error
+	p.listener, err = net.Listen("tcp", listenAddr)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to listen on '%s'", listenAddr)
+	}
+
+	go func() {
+		for {
+			conn, err := p.listener.Accept()
+			if err != nil {
+				if isClosedErr(err) {
+					p.log.Debug("SOCKS proxy listener closed. Not accepting any new connections.")
+					return
+				}
+				p.log.Errorf("Failed to accept SOCKS connection: %s", err)
+				continue
+			}
+			go p.handle(conn)
+		}
+	}()
+
+	return p.listener.Addr().String(), nil
+}
+
+// Close stops the SOCKS proxy and terminates all the active connections. The SSH connection is left open
+func (p *SOCKSProxy) Close() error {
+	err := p.listener.Close()
+	if err != nil && !isClosedErr(err) {
+		return errors.Wrap(err, "Error while closing SOCKS proxy listener")
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, close := range p.connMap {
+		close <- true
+	}
+	return nil
+}
+
+// NewSOCKSProxy creates a SOCKS5 proxy which dials every connection through the provided SSH connection. Names under
+// domain are resolved using dnsServer (host:port), which is also reached via the SSH connection
+func NewSOCKSProxy(sshConn *ssh.Client, domain string, dnsServer string, logger *logrus.Logger) *SOCKSProxy {
+	proxy := &SOCKSProxy{sshConn: sshConn, domain: strings.TrimSuffix(domain, "."), log: logger, connMap: map[net.Conn]chan bool{}}
+	if dnsServer != "" {
+		proxy.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				// SSH connections are streams so the resolver falls back to DNS over TCP
+				return sshConn.Dial("tcp", dnsServer)
+			},
+		}
+	}
+	return proxy
+}
@@ -0,0 +1,163 @@
+package ssh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// dnsServer starts a DNS over TCP server which answers A queries for the provided names and replies with NXDOMAIN for
+// every other name
+func dnsServer(t *testing.T, records map[string]net.IP) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start DNS server: %s", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					size := make([]byte, 2)
+					if _, err := io.ReadFull(c, size); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(size))
+					if _, err := io.ReadFull(c, query); err != nil {
+						return
+					}
+					reply := dnsReply(query, records)
+					binary.BigEndian.PutUint16(size, uint16(len(reply)))
+					c.Write(append(size, reply...))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// dnsReply builds the response to a DNS query with a single question
+func dnsReply(query []byte, records map[string]net.IP) []byte {
+	labels := []string{}
+	end := 12
+	for query[end] != 0 {
+		labels = append(labels, string(query[end+1:end+1+int(query[end])]))
+		end += int(query[end]) + 1
+	}
+	question := query[12 : end+5]
+	qtype := binary.BigEndian.Uint16(query[end+1:])
+
+	// QR, AA, RD and RA flags are set on every reply
+	flags := uint16(0x8580)
+	ip, found := records[strings.Join(labels, ".")]
+	if !found {
+		flags |= 3 // NXDOMAIN
+	}
+	answers := uint16(0)
+	if found && qtype == 1 {
+		answers = 1
+	}
+
+	reply := make([]byte, 12)
+	copy(reply, query[:2])
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[6:], answers)
+	reply = append(reply, question...)
+	if answers > 0 {
+		// name pointer to the question, type A, class IN, TTL 60, 4 bytes of data
+		reply = append(reply, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		reply = append(reply, ip.To4()...)
+	}
+	return reply
+}
+
+// socksConnect performs a SOCKS5 handshake on conn and requests a connection to host:port. It returns the reply code
+// sent by the proxy
+func socksConnect(t *testing.T, conn net.Conn, r *bufio.Reader, host string, port int) byte {
+	if _, err := conn.Write([]byte{socksVersion, 1, socksNoAuth}); err != nil {
+		t.Fatalf("Failed to write SOCKS greeting: %s", err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(r, method); err != nil {
+		t.Fatalf("Failed to read SOCKS method: %s", err)
+	}
+	if method[1] != socksNoAuth {
+		t.Fatalf("Expected the proxy to accept unauthenticated access, got method %d", method[1])
+	}
+
+	request := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		request = append(append(request, socksAddrIPv4), ip...)
+	} else {
+		request = append(append(request, socksAddrDomain, byte(len(host))), host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("Failed to write SOCKS request: %s", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		t.Fatalf("Failed to read SOCKS reply: %s", err)
+	}
+	return reply[1]
+}
+
+// startTestProxy starts a SOCKS proxy over a connection to a test SSH server. Names under example.test are resolved
+// using the provided records
+func startTestProxy(t *testing.T, records map[string]net.IP) *SOCKSProxy {
+	addr, _ := startTestServer(t)
+	return NewSOCKSProxy(dialTest(t, addr), "example.test", dnsServer(t, records), testLog)
+}
+
+func TestSOCKS(t *testing.T) {
+	echoHost, echoPort, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(echoPort)
+	p := startTestProxy(t, map[string]net.IP{"app.example.test": net.ParseIP(echoHost)})
+	laddr, err := p.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start SOCKS proxy: %s", err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		name   string
+		host   string
+		status byte
+	}{
+		{"IP address", echoHost, socksSucceeded},
+		{"name resolved by the SSH server", "localhost", socksSucceeded},
+		{"name resolved by the remote DNS server", "app.example.test", socksSucceeded},
+		{"fully qualified name resolved by the remote DNS server", "app.example.test.", socksSucceeded},
+		{"unknown name in the proxy domain", "missing.example.test", socksHostUnreach},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", laddr)
+		if err != nil {
+			t.Fatalf("%s: failed to connect to SOCKS proxy: %s", tt.name, err)
+		}
+		r := bufio.NewReader(conn)
+		status := socksConnect(t, conn, r, tt.host, port)
+		if status != tt.status {
+			conn.Close()
+			t.Fatalf("%s: expected SOCKS reply %d for '%s', got %d", tt.name, tt.status, tt.host, status)
+		}
+		if status == socksSucceeded {
+			fmt.Fprint(conn, "ping\n")
+			line, err := r.ReadString('\n')
+			if err != nil || line != "echo:ping\n" {
+				t.Errorf("%s: expected the echo reply, got %q (%v)", tt.name, line, err)
+			}
+		}
+		conn.Close()
+	}
+}
@@ -3,7 +3,10 @@ package ssh
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
@@ -82,24 +85,137 @@ func ExecuteCommand(cmd string, client *ssh.Client) (string, error) {
 
 }
 
-func NewConnection(host string, user string, auth ssh.AuthMethod, maxRetries int) (*ssh.Client, error) {
-	sshConfig := &ssh.ClientConfig{
-		User: "root",
-		Auth: []ssh.AuthMethod{
-			auth,
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO validate server before?
+// ExecuteCommandStream opens a session using the provided client and executes the provided command, streaming its output
+// to the provided writers as it is produced. Unlike ExecuteCommand, no pseudo terminal is requested
+func ExecuteCommandStream(cmd string, client *ssh.Client, stdout io.Writer, stderr io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return errors.Wrap(err, "Failed to create new session")
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	log.Debugf("Executing (SSH) command '%s'", cmd)
+	err = session.Run(cmd)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to execute command '%s'", cmd)
 	}
+	return nil
+}
+
+// ConnectionConfig holds everything needed to open an SSH connection to a host
+type ConnectionConfig struct {
+	Host            string
+	Port            int
+	User            string
+	Auth            ssh.AuthMethod
+	HostKeyCallback ssh.HostKeyCallback
+	Timeout         time.Duration
+	// JumpHosts are connected to in order, each one through the previous one, before reaching the host
+	JumpHosts []ConnectionConfig
+	// ProxyCommand is executed and its stdin and stdout are used as the transport for the first hop. The %h, %p and %r
+	// tokens are replaced with the host, port and user of the first hop
+	ProxyCommand string
+}
 
+// Address returns the host:port address of the SSH server
+func (cc ConnectionConfig) Address() string {
+	port := cc.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(cc.Host, strconv.Itoa(port))
+}
+
+func (cc ConnectionConfig) clientConfig() *ssh.ClientConfig {
+	user := cc.User
+	if user == "" {
+		user = "root"
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{cc.Auth},
+		HostKeyCallback: cc.HostKeyCallback,
+		Timeout:         cc.Timeout,
+	}
+}
+
+// handshake performs the SSH handshake over conn, enforcing the configured timeout
+func (cc ConnectionConfig) handshake(conn net.Conn) (*ssh.Client, error) {
+	if cc.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(cc.Timeout))
+	}
+	client, err := newClient(conn, cc.Address(), cc.clientConfig())
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// Dial opens an SSH connection using the provided config, going through the proxy command and jump hosts if present
+func Dial(cc ConnectionConfig) (*ssh.Client, error) {
+	hops := append(append([]ConnectionConfig{}, cc.JumpHosts...), cc)
+	hops[0].ProxyCommand = cc.ProxyCommand
+
+	var client *ssh.Client
+	for _, hop := range hops {
+		var conn net.Conn
+		var err error
+		switch {
+		case client != nil:
+			conn, err = client.Dial("tcp", hop.Address())
+		case hop.ProxyCommand != "":
+			conn, err = newProxyCommandConn(hop)
+		default:
+			conn, err = net.DialTimeout("tcp", hop.Address(), hop.Timeout)
+		}
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil, errors.Wrapf(err, "Failed to connect to '%s'", hop.Address())
+		}
+
+		next, err := hop.handshake(conn)
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			if _, ok := err.(*HostKeyMismatchError); ok {
+				return nil, err
+			}
+			return nil, errors.Wrapf(err, "SSH handshake with '%s' failed", hop.Address())
+		}
+		if client != nil {
+			// the jump host connection is closed once the connection going through it terminates
+			go func(jump *ssh.Client) {
+				next.Wait()
+				jump.Close()
+			}(client)
+		}
+		client = next
+	}
+	return client, nil
+}
+
+// NewConnection opens an SSH connection using the provided config, retrying up to maxRetries times. A host key
+// mismatch is never retried
+func NewConnection(cc ConnectionConfig, maxRetries int) (*ssh.Client, error) {
 	tries := 0
 	var client *ssh.Client
 	var err error
 	for {
 		tries++
 		if tries > maxRetries {
-			return nil, errors.Wrapf(err, "Failed to open SSH connection to '%s@%s'", user, host)
+			return nil, errors.Wrapf(err, "Failed to open SSH connection to '%s@%s'", cc.clientConfig().User, cc.Address())
+		}
+		client, err = Dial(cc)
+		if _, ok := err.(*HostKeyMismatchError); ok {
+			return nil, err
 		}
-		client, err = ssh.Dial("tcp", host+":22", sshConfig) // TODO remove hardocoded port?
 		if err != nil {
 			time.Sleep(3 * time.Second)
 		} else {
@@ -4,28 +4,72 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
+const (
+	keepAliveInterval = 15 * time.Second
+	keepAliveTimeout  = 10 * time.Second
+	dialTimeout       = 15 * time.Second
+	maxBackoff        = 30 * time.Second
+)
+
+// TunnelState represents the health of an SSH tunnel
+type TunnelState int
+
+const (
+	// TunnelConnecting is the state of a tunnel before the first SSH connection is established
+	TunnelConnecting TunnelState = iota
+	// TunnelConnected means the SSH connection is up and the forwards are working
+	TunnelConnected
+	// TunnelReconnecting means the SSH connection was lost and the tunnel is trying to establish a new one
+	TunnelReconnecting
+	// TunnelClosed means the tunnel was closed by the user
+	TunnelClosed
+)
+
+func (ts TunnelState) String() string {
+	switch ts {
+	case TunnelConnecting:
+		return "connecting"
+	case TunnelConnected:
+		return "connected"
+	case TunnelReconnecting:
+		return "reconnecting"
+	case TunnelClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
 // Tunnel represents and SSH tunnel to a remote host
 type Tunnel struct {
-	sshHost   string
-	sshUser   string
-	sshAuth   ssh.AuthMethod
-	sshConn   *ssh.Client
-	listener  net.Listener
-	localPort int
-	target    string
-	log       *logrus.Logger
-	connMap   []chan bool
+	config        ConnectionConfig
+	sshConn       *ssh.Client
+	forwards      []Forward
+	closers       []io.Closer
+	remoteClosers []io.Closer
+	log           *logrus.Logger
+	lock          sync.Mutex
+	state         TunnelState
+	stateChanges  chan TunnelState
+	closed        chan struct{}
+	connMap       map[int]chan bool
+	connID        int
+	err           error
 }
 
 type forwarder struct {
 	log    *logrus.Logger
+	lock   sync.Mutex
 	closed bool
 	errsig chan bool
 	close  chan bool
@@ -56,6 +100,8 @@ func (t *forwarder) pipe(src, dst net.Conn, name string) {
 }
 
 func (t *forwarder) errSig(s string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	if t.closed {
 		return
 	}
@@ -75,7 +121,9 @@ func (t *forwarder) proxy() {
 	case <-t.errsig:
 		t.log.Debugf("Forwarder %p closed because of underlying connections", t.lconn)
 	case <-t.close:
+		t.lock.Lock()
 		t.closed = true
+		t.lock.Unlock()
 		t.lconn.Close()
 		t.rconn.Close()
 		t.log.Debugf("Forwarder %p closed by user", t.lconn)
@@ -87,85 +135,332 @@ func newForwarder(lconn, rconn net.Conn, close chan bool, log *logrus.Logger) *f
 		lconn:  lconn,
 		rconn:  rconn,
 		closed: false,
-		errsig: make(chan bool),
+		errsig: make(chan bool, 2),
 		close:  close,
 		log:    log,
 	}
 }
 
-// Start initiates the ssh tunnel
-func (t *Tunnel) Start() (int, error) {
-	// setup the local listener using a random port
-	var err error
-	t.listener, err = net.Listen("tcp", "localhost:0")
-	if err != nil {
-		return 0, err
+func isClosedErr(err error) bool {
+	return err == io.EOF || strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// client returns the current SSH connection, which changes after every reconnect
+func (t *Tunnel) client() *ssh.Client {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.sshConn
+}
+
+func (t *Tunnel) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
 	}
-	t.localPort = t.listener.Addr().(*net.TCPAddr).Port
+}
 
-	// setup the SSH connection
-	sshConfig := &ssh.ClientConfig{
-		User: t.sshUser,
-		Auth: []ssh.AuthMethod{t.sshAuth},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// Always accept key.
-			return nil
-		}}
-	t.sshConn, err = ssh.Dial("tcp", t.sshHost, sshConfig)
-	if err != nil {
-		return 0, err
+func (t *Tunnel) setState(state TunnelState) {
+	t.lock.Lock()
+	t.state = state
+	t.lock.Unlock()
+
+	// state changes are dropped if the caller is not keeping up
+	select {
+	case t.stateChanges <- state:
+	default:
 	}
+}
+
+// State returns the current state of the tunnel
+func (t *Tunnel) State() TunnelState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.state
+}
 
-	// accept local connections and start the forwarding
-	go func() {
-		for {
-			// accept a connection on localhost
-			localConn, err := t.listener.Accept()
-			if err != nil {
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					t.log.Debug("Local SSH tunnel listener closed. Not accepting any new connections.")
+// Err returns the error which caused the tunnel to close, if it wasn't closed by the user
+func (t *Tunnel) Err() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.err
+}
+
+// StateChanges returns a channel which receives the state of the tunnel every time it changes
+func (t *Tunnel) StateChanges() <-chan TunnelState {
+	return t.stateChanges
+}
+
+// forward starts a forwarder for a pair of connections and keeps track of it until it finishes
+func (t *Tunnel) forward(localConn net.Conn, remoteConn net.Conn) {
+	close := make(chan bool, 1)
+	t.lock.Lock()
+	t.connID++
+	id := t.connID
+	t.connMap[id] = close
+	t.lock.Unlock()
+
+	newForwarder(localConn, remoteConn, close, t.log).proxy()
+
+	t.lock.Lock()
+	delete(t.connMap, id)
+	t.lock.Unlock()
+}
+
+// acceptLoop accepts connections on the provided listener and forwards each of them to a connection created by dial
+func (t *Tunnel) acceptLoop(listener net.Listener, fwd Forward, dial func() (net.Conn, error)) {
+	for {
+		// accept a connection on the listening side
+		localConn, err := listener.Accept()
+		if err != nil {
+			if isClosedErr(err) {
+				t.log.Debugf("SSH tunnel listener for forward (%s) closed. Not accepting any new connections.", fwd.String())
+				return
+			}
+			t.log.Errorf("Failed to accept connection via the SSH tunnel: %s", err)
+			continue
+		}
+
+		// open a connection to the target of the forward
+		remoteConn, err := dial()
+		if err != nil {
+			t.log.Errorf("Failed to establish connection to '%s' over SSH tunnel (%s): %s", fwd.TargetAddr, t.config.Address(), err)
+			localConn.Close()
+			continue
+		}
+
+		go t.forward(localConn, remoteConn)
+	}
+}
+
+// startForward starts listening for a specific forward, and returns the address that is actually used for listening
+func (t *Tunnel) startForward(fwd Forward) (string, error) {
+	switch {
+	case fwd.Type == LocalForward:
+		listener, err := net.Listen("tcp", fwd.ListenAddr)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to listen on '%s'", fwd.ListenAddr)
+		}
+		t.closers = append(t.closers, listener)
+		go t.acceptLoop(listener, fwd, func() (net.Conn, error) { return t.client().Dial("tcp", fwd.TargetAddr) })
+		return listener.Addr().String(), nil
+	case fwd.Type == RemoteForward:
+		// remote listeners live on the SSH connection, so they are recreated after every reconnect
+		listener, err := t.client().Listen("tcp", fwd.ListenAddr)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to listen on remote address '%s'", fwd.ListenAddr)
+		}
+		t.lock.Lock()
+		t.remoteClosers = append(t.remoteClosers, listener)
+		t.lock.Unlock()
+		go t.acceptLoop(listener, fwd, func() (net.Conn, error) { return net.Dial("tcp", fwd.TargetAddr) })
+		return listener.Addr().String(), nil
+	default:
+		return "", errors.Errorf("Unsupported forward (%s)", fwd.String())
+	}
+}
+
+func (t *Tunnel) dial() (*ssh.Client, error) {
+	return Dial(t.config)
+}
+
+// keepAlive periodically sends keepalive requests over the SSH connection and closes it if the remote stops responding
+func (t *Tunnel) keepAlive(conn *ssh.Client, done chan struct{}) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+			select {
+			case err := <-reply:
+				if err != nil {
+					t.log.Debugf("SSH keepalive to '%s' failed: %s", t.config.Address(), err.Error())
+					conn.Close()
 					return
 				}
-				t.log.Errorf("Failed to accept connection via the SSH tunnel: %s", err)
-				continue
+			case <-time.After(keepAliveTimeout):
+				t.log.Warnf("SSH keepalive to '%s' timed out", t.config.Address())
+				conn.Close()
+				return
+			case <-done:
+				return
 			}
+		}
+	}
+}
 
-			// open a connection via the SSH connection, to the Protos backend
-			remoteConn, err := t.sshConn.Dial("tcp", t.target)
-			if err != nil {
-				t.log.Errorf("Failed to establish remote connection (%s) over SSH tunnel (%s): %s", t.target, t.sshHost, err)
-				return
+// monitor waits for the SSH connection to terminate, and starts the reconnection if the tunnel was not closed by the user
+func (t *Tunnel) monitor(conn *ssh.Client) {
+	done := make(chan struct{})
+	go t.keepAlive(conn, done)
+	conn.Wait()
+	close(done)
+
+	if t.isClosed() {
+		return
+	}
+	t.log.Warnf("SSH connection to '%s' lost. Reconnecting", t.config.Address())
+	t.setState(TunnelReconnecting)
+	t.reconnect()
+}
+
+// reconnect establishes a new SSH connection, using an exponential backoff between attempts
+func (t *Tunnel) reconnect() {
+	t.lock.Lock()
+	t.remoteClosers = []io.Closer{}
+	t.lock.Unlock()
+
+	backoff := time.Second
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-time.After(backoff):
+		}
+
+		conn, err := t.dial()
+		if _, ok := err.(*HostKeyMismatchError); ok {
+			// a different host key won't go away by retrying, so the tunnel gives up
+			t.log.Error(err.Error())
+			t.lock.Lock()
+			t.err = err
+			t.lock.Unlock()
+			t.Close()
+			return
+		}
+		if err != nil {
+			t.log.Debugf("Failed to reconnect to '%s': %s", t.config.Address(), err.Error())
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		t.lock.Lock()
+		if t.isClosed() {
+			t.lock.Unlock()
+			conn.Close()
+			return
+		}
+		t.sshConn = conn
+		t.lock.Unlock()
+
+		for _, fwd := range t.forwards {
+			if fwd.Type == RemoteForward {
+				_, err = t.startForward(fwd)
+				if err != nil {
+					t.log.Errorf("Failed to restore forward (%s): %s", fwd.String(), err.Error())
+				}
 			}
+		}
+
+		t.log.Infof("SSH connection to '%s' restored", t.config.Address())
+		t.setState(TunnelConnected)
+		go t.monitor(conn)
+		return
+	}
+}
+
+// Start initiates the ssh tunnel and returns the local port of the first local forward
+func (t *Tunnel) Start() (int, error) {
+	// setup the SSH connection
+	var err error
+	t.sshConn, err = t.dial()
+	if err != nil {
+		return 0, err
+	}
 
-			close := make(chan bool, 1)
-			forwarder := newForwarder(localConn, remoteConn, close, t.log)
-			go forwarder.proxy()
-			t.connMap = append(t.connMap, close)
+	// start listening for all the forwards
+	localPort := 0
+	for i, fwd := range t.forwards {
+		addr, err := t.startForward(fwd)
+		if err != nil {
+			t.Close()
+			return 0, err
 		}
-	}()
+		t.forwards[i].ListenAddr = addr
+		t.log.Debugf("Started forward (%s)", t.forwards[i].String())
+
+		if localPort == 0 && fwd.Type == LocalForward {
+			_, port, _ := net.SplitHostPort(addr)
+			localPort, _ = strconv.Atoi(port)
+		}
+	}
 
-	return t.localPort, nil
+	t.setState(TunnelConnected)
+	go t.monitor(t.sshConn)
+
+	return localPort, nil
+}
+
+// Forwards returns the forwards of the tunnel. Once the tunnel is started, the listen addresses reflect the ports actually in use
+func (t *Tunnel) Forwards() []Forward {
+	return append([]Forward{}, t.forwards...)
 }
 
 // Close terminates the SSH tunnel
 func (t *Tunnel) Close() error {
-	// close the listener and the rest of the connections
-	err := t.listener.Close()
-	if err != nil {
-		return errors.Wrap(err, "Error while closing local tunnel listener")
+	t.lock.Lock()
+	if t.isClosed() {
+		t.lock.Unlock()
+		return nil
+	}
+	close(t.closed)
+	t.lock.Unlock()
+
+	// close the listeners and the rest of the connections
+	for _, closer := range t.closers {
+		err := closer.Close()
+		if err != nil && !isClosedErr(err) {
+			return errors.Wrap(err, "Error while closing tunnel listener")
+		}
 	}
+	t.closers = []io.Closer{}
+
+	t.lock.Lock()
 	for _, close := range t.connMap {
 		close <- true
 	}
-	err = t.sshConn.Close()
-	if err != nil {
+	sshConn := t.sshConn
+	t.lock.Unlock()
+	t.setState(TunnelClosed)
+
+	err := sshConn.Close()
+	if err != nil && !isClosedErr(err) {
 		return errors.Wrap(err, "Error while closing ssh tunnel connection")
 	}
 
 	return nil
 }
 
-// NewTunnel creates and returns an SSHTunnel
-func NewTunnel(sshHost string, sshUser string, sshAuth ssh.AuthMethod, tunnelTarget string, logger *logrus.Logger) *Tunnel {
-	return &Tunnel{sshHost: sshHost, sshUser: sshUser, sshAuth: sshAuth, target: tunnelTarget, log: logger}
+// NewTunnel creates and returns an SSHTunnel which forwards a random local port to the tunnel target
+func NewTunnel(config ConnectionConfig, tunnelTarget string, logger *logrus.Logger) *Tunnel {
+	forwards := []Forward{{Type: LocalForward, ListenAddr: "localhost:0", TargetAddr: tunnelTarget}}
+	return NewForwardTunnel(config, forwards, logger)
+}
+
+// NewForwardTunnel creates and returns an SSHTunnel which carries the provided forwards. The connection config,
+// including the host key callback, is used for the initial connection and for every reconnect
+func NewForwardTunnel(config ConnectionConfig, forwards []Forward, logger *logrus.Logger) *Tunnel {
+	if config.Timeout == 0 {
+		config.Timeout = dialTimeout
+	}
+	return &Tunnel{
+		config:       config,
+		forwards:     append([]Forward{}, forwards...),
+		log:          logger,
+		state:        TunnelConnecting,
+		stateChanges: make(chan TunnelState, 10),
+		closed:       make(chan struct{}),
+		connMap:      map[int]chan bool{},
+	}
 }
@@ -0,0 +1,128 @@
+package state
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/user"
+)
+
+// Ways of resolving the records of an archive which differ from the local ones
+const (
+	ConflictFail      = "fail"      // nothing is imported
+	ConflictSkip      = "skip"      // the local records are kept
+	ConflictOverwrite = "overwrite" // the local records are replaced
+)
+
+// ErrNotFound is returned by Local when a record doesn't exist locally
+var ErrNotFound = errors.New("Record not found")
+
+// Local gives access to the local records an archive is merged with. Lookups of records which don't exist return
+// ErrNotFound, and any other error aborts the merge
+type Local interface {
+	User() (user.Info, error)
+	Cloud(name string) (cloud.ProviderInfo, error)
+	Instance(name string) (cloud.InstanceInfo, error)
+	PrimaryInstance() (string, error)
+}
+
+// Plan holds the records which have to be written to import an archive
+type Plan struct {
+	User      *user.Info
+	Clouds    []cloud.ProviderInfo
+	Instances []cloud.InstanceInfo
+	Primary   string   // empty if the primary instance doesn't change
+	Conflicts []string // records which differ from the local ones
+	Warnings  []string // records which can't be imported
+}
+
+// sameUser compares the user details that are stored in the archive
+func sameUser(a user.Info, b user.Info) bool {
+	return a.Username == b.Username && a.Name == b.Name && a.Domain == b.Domain && a.Password == b.Password && reflect.DeepEqual(a.Device, b.Device) && reflect.DeepEqual(a.Devices, b.Devices)
+}
+
+// Merge compares the archive with the local records and works out what has to be written to import it, without
+// writing anything. Records which differ from the local ones are resolved according to onConflict, and with
+// ConflictFail an error listing them is returned. The secrets left out of redacted archives are taken from the local
+// records
+func (a Archive) Merge(local Local, onConflict string) (Plan, error) {
+	plan := Plan{}
+	resolve := func(record string) bool {
+		plan.Conflicts = append(plan.Conflicts, record)
+		return onConflict == ConflictOverwrite
+	}
+
+	if a.User != nil {
+		localUser, err := local.User()
+		if err == ErrNotFound {
+			plan.User = a.User
+		} else if err != nil {
+			return Plan{}, err
+		} else if !sameUser(localUser, *a.User) && resolve(fmt.Sprintf("user '%s'", localUser.Username)) {
+			plan.User = a.User
+		}
+	}
+
+	for _, cloudInfo := range a.Clouds {
+		localCloud, err := local.Cloud(cloudInfo.Name)
+		if err == ErrNotFound {
+			if a.Redacted {
+				plan.Warnings = append(plan.Warnings, fmt.Sprintf("Cloud '%s' is not available locally and its credentials are not included in the archive. Add it using 'cloud add %s'", cloudInfo.Name, cloudInfo.Name))
+			} else {
+				plan.Clouds = append(plan.Clouds, cloudInfo)
+			}
+			continue
+		} else if err != nil {
+			return Plan{}, errors.Wrapf(err, "Failed to retrieve local cloud '%s'", cloudInfo.Name)
+		}
+		if a.Redacted {
+			cloudInfo.Auth = localCloud.Auth
+		}
+		if (localCloud.Type != cloudInfo.Type || !reflect.DeepEqual(localCloud.Auth, cloudInfo.Auth)) && resolve(fmt.Sprintf("cloud '%s'", cloudInfo.Name)) {
+			// credentials of overwritten clouds are kept in the local secret backend
+			cloudInfo.SecretBackend = localCloud.SecretBackend
+			plan.Clouds = append(plan.Clouds, cloudInfo)
+		}
+	}
+
+	instances := map[string]bool{}
+	for _, instanceInfo := range a.Instances {
+		instances[instanceInfo.Name] = true
+		localInstance, err := local.Instance(instanceInfo.Name)
+		if err == ErrNotFound {
+			plan.Instances = append(plan.Instances, instanceInfo)
+			continue
+		} else if err != nil {
+			return Plan{}, errors.Wrapf(err, "Failed to retrieve local instance '%s'", instanceInfo.Name)
+		}
+		if a.Redacted {
+			instanceInfo.KeySeed = localInstance.KeySeed
+		}
+		if !reflect.DeepEqual(localInstance, instanceInfo) && resolve(fmt.Sprintf("instance '%s'", instanceInfo.Name)) {
+			plan.Instances = append(plan.Instances, instanceInfo)
+		}
+	}
+
+	// the primary instance is only imported if the instance itself is in the archive
+	if a.Primary != "" {
+		localPrimary, err := local.PrimaryInstance()
+		if err != nil {
+			return Plan{}, err
+		}
+		if !instances[a.Primary] {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("Primary instance '%s' is not included in the archive, so it was not imported", a.Primary))
+		} else if localPrimary == "" {
+			plan.Primary = a.Primary
+		} else if localPrimary != a.Primary && resolve(fmt.Sprintf("primary instance '%s'", localPrimary)) {
+			plan.Primary = a.Primary
+		}
+	}
+
+	if len(plan.Conflicts) > 0 && onConflict == ConflictFail {
+		return Plan{}, errors.Errorf("The archive conflicts with the local %s. Nothing was imported. Use '--on-conflict skip' to keep the local records, or '--on-conflict overwrite' to replace them", strings.Join(plan.Conflicts, ", "))
+	}
+	return plan, nil
+}
@@ -0,0 +1,222 @@
+package state
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/user"
+)
+
+// fakeLocal holds the local records in memory. If err is set, every lookup fails with it
+type fakeLocal struct {
+	user      *user.Info
+	clouds    map[string]cloud.ProviderInfo
+	instances map[string]cloud.InstanceInfo
+	primary   string
+	err       error
+}
+
+func (l fakeLocal) User() (user.Info, error) {
+	if l.err != nil {
+		return user.Info{}, l.err
+	}
+	if l.user == nil {
+		return user.Info{}, ErrNotFound
+	}
+	return *l.user, nil
+}
+
+func (l fakeLocal) Cloud(name string) (cloud.ProviderInfo, error) {
+	if l.err != nil {
+		return cloud.ProviderInfo{}, l.err
+	}
+	c, found := l.clouds[name]
+	if !found {
+		return c, ErrNotFound
+	}
+	return c, nil
+}
+
+func (l fakeLocal) Instance(name string) (cloud.InstanceInfo, error) {
+	if l.err != nil {
+		return cloud.InstanceInfo{}, l.err
+	}
+	i, found := l.instances[name]
+	if !found {
+		return i, ErrNotFound
+	}
+	return i, nil
+}
+
+func (l fakeLocal) PrimaryInstance() (string, error) {
+	return l.primary, l.err
+}
+
+func testArchive() Archive {
+	return Archive{
+		User:      &user.Info{Username: "alice", Password: "secret"},
+		Clouds:    []cloud.ProviderInfo{{Name: "scw", Type: cloud.Scaleway, Auth: map[string]string{"TOKEN": "archived"}}},
+		Instances: []cloud.InstanceInfo{{Name: "one", KeySeed: []byte("archived")}},
+		Primary:   "one",
+	}
+}
+
+// changedLocal returns local records which all differ from the ones in testArchive
+func changedLocal() fakeLocal {
+	return fakeLocal{
+		user:      &user.Info{Username: "bob", Password: "secret"},
+		clouds:    map[string]cloud.ProviderInfo{"scw": {Name: "scw", Type: cloud.Scaleway, Auth: map[string]string{"TOKEN": "local"}, SecretBackend: "keyring"}},
+		instances: map[string]cloud.InstanceInfo{"one": {Name: "one", KeySeed: []byte("local"), PublicIP: "10.0.0.1"}},
+		primary:   "two",
+	}
+}
+
+func TestMergeNewRecords(t *testing.T) {
+	archive := testArchive()
+	plan, err := archive.Merge(fakeLocal{}, ConflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.User == nil || len(plan.Clouds) != 1 || len(plan.Instances) != 1 || plan.Primary != "one" {
+		t.Fatalf("Expected all the records to be imported, got %+v", plan)
+	}
+	if len(plan.Conflicts) != 0 || len(plan.Warnings) != 0 {
+		t.Fatalf("Unexpected conflicts %v or warnings %v", plan.Conflicts, plan.Warnings)
+	}
+}
+
+func TestMergeSameRecords(t *testing.T) {
+	archive := testArchive()
+	local := fakeLocal{
+		user:      archive.User,
+		clouds:    map[string]cloud.ProviderInfo{"scw": archive.Clouds[0]},
+		instances: map[string]cloud.InstanceInfo{"one": archive.Instances[0]},
+		primary:   "one",
+	}
+	plan, err := archive.Merge(local, ConflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.User != nil || len(plan.Clouds) != 0 || len(plan.Instances) != 0 || plan.Primary != "" {
+		t.Fatalf("Expected nothing to be imported, got %+v", plan)
+	}
+}
+
+func TestMergeConflicts(t *testing.T) {
+	archive := testArchive()
+	expectedConflicts := []string{"user 'bob'", "cloud 'scw'", "instance 'one'", "primary instance 'two'"}
+
+	_, err := archive.Merge(changedLocal(), ConflictFail)
+	if err == nil {
+		t.Fatal("Expected the conflicts to fail the merge")
+	}
+
+	plan, err := archive.Merge(changedLocal(), ConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan.Conflicts, expectedConflicts) {
+		t.Fatalf("Unexpected conflicts %v", plan.Conflicts)
+	}
+	if plan.User != nil || len(plan.Clouds) != 0 || len(plan.Instances) != 0 || plan.Primary != "" {
+		t.Fatalf("Expected the local records to be kept, got %+v", plan)
+	}
+
+	plan, err = archive.Merge(changedLocal(), ConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan.Conflicts, expectedConflicts) {
+		t.Fatalf("Unexpected conflicts %v", plan.Conflicts)
+	}
+	if plan.User == nil || plan.User.Username != "alice" || plan.Primary != "one" {
+		t.Fatalf("Expected the archived user and primary instance, got %+v", plan)
+	}
+	if len(plan.Clouds) != 1 || plan.Clouds[0].Auth["TOKEN"] != "archived" || plan.Clouds[0].SecretBackend != "keyring" {
+		t.Fatalf("Expected the archived cloud using the local secret backend, got %+v", plan.Clouds)
+	}
+	if len(plan.Instances) != 1 || string(plan.Instances[0].KeySeed) != "archived" {
+		t.Fatalf("Expected the archived instance, got %+v", plan.Instances)
+	}
+}
+
+func TestMergeRedacted(t *testing.T) {
+	archive := testArchive()
+	archive.Redact()
+
+	// the local secrets are kept, so records which only differ in their secrets don't conflict
+	local := changedLocal()
+	local.clouds["scw"] = cloud.ProviderInfo{Name: "scw", Type: cloud.Scaleway, Auth: map[string]string{"TOKEN": "local"}}
+	local.instances["one"] = cloud.InstanceInfo{Name: "one", KeySeed: []byte("local")}
+	local.primary = "one"
+	plan, err := archive.Merge(local, ConflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.User != nil || len(plan.Clouds) != 0 || len(plan.Instances) != 0 || len(plan.Conflicts) != 0 {
+		t.Fatalf("Expected nothing to be imported, got %+v", plan)
+	}
+
+	// the local secrets are kept when overwriting
+	local.instances["one"] = cloud.InstanceInfo{Name: "one", KeySeed: []byte("local"), PublicIP: "10.0.0.1"}
+	plan, err = archive.Merge(local, ConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Instances) != 1 || string(plan.Instances[0].KeySeed) != "local" || plan.Instances[0].PublicIP != "" {
+		t.Fatalf("Expected the archived instance with the local key, got %+v", plan.Instances)
+	}
+
+	// clouds without credentials can't be imported
+	plan, err = archive.Merge(fakeLocal{}, ConflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Clouds) != 0 || len(plan.Warnings) != 1 {
+		t.Fatalf("Expected the cloud to be left out with a warning, got %+v", plan)
+	}
+	if len(plan.Instances) != 1 || plan.Instances[0].KeySeed != nil {
+		t.Fatalf("Expected the instance without its key, got %+v", plan.Instances)
+	}
+}
+
+func TestMergePrimaryNotInArchive(t *testing.T) {
+	archive := testArchive()
+	archive.Primary = "missing"
+	plan, err := archive.Merge(fakeLocal{}, ConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Primary != "" || len(plan.Warnings) != 1 {
+		t.Fatalf("Expected the primary instance to be left out with a warning, got %+v", plan)
+	}
+}
+
+func TestMergeLocalErrors(t *testing.T) {
+	// errors other than ErrNotFound (e.g. a locked secret backend) must not be mistaken for missing records
+	lookupErr := errors.New("keyring is locked")
+	archive := testArchive()
+	for _, onConflict := range []string{ConflictFail, ConflictSkip, ConflictOverwrite} {
+		_, err := archive.Merge(fakeLocal{err: lookupErr}, onConflict)
+		if err == nil {
+			t.Fatalf("Expected the lookup error to fail the merge (%s)", onConflict)
+		}
+	}
+
+	_, err := archive.Merge(failingCloud{fakeLocal{}, lookupErr}, ConflictOverwrite)
+	if err == nil {
+		t.Fatal("Expected the cloud lookup error to fail the merge")
+	}
+}
+
+// failingCloud fails the cloud lookups only
+type failingCloud struct {
+	fakeLocal
+	err error
+}
+
+func (l failingCloud) Cloud(name string) (cloud.ProviderInfo, error) {
+	return cloud.ProviderInfo{}, l.err
+}
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/user"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// Version is the version of the archive format. Archives with a newer version are refused. Version 2 added the
+	// primary instance
+	Version = 2
+
+	magic = "protos-state\n"
+
+	// argon2id parameters
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+	saltSize   = 16
+	nonceSize  = 24
+)
+
+// Archive holds the entire local state of the Protos client
+type Archive struct {
+	Version   int
+	Created   time.Time
+	Redacted  bool       // secrets have been removed, so the archive can be shared
+	User      *user.Info `json:",omitempty"`
+	Clouds    []cloud.ProviderInfo
+	Instances []cloud.InstanceInfo
+	Primary   string `json:",omitempty"` // name of the primary instance, if one is set
+}
+
+// Redact removes all the secrets from the archive: the user (password and device key), the cloud credentials and the
+// instance SSH keys. Instances using ssh-agent keys remain usable, because only the public key is stored for them
+func (a *Archive) Redact() {
+	a.Redacted = true
+	a.User = nil
+	for i := range a.Clouds {
+		a.Clouds[i].Auth = nil
+	}
+	for i := range a.Instances {
+		a.Instances[i].KeySeed = nil
+	}
+}
+
+func deriveKey(passphrase string, salt []byte) *[32]byte {
+	key := &[32]byte{}
+	copy(key[:], argon2.IDKey([]byte(passphrase), salt, kdfTime, kdfMemory, kdfThreads, 32))
+	return key
+}
+
+// Encrypt serializes the archive to JSON and encrypts it using NaCl secretbox, with a key derived from the passphrase
+// using argon2id. The output starts with a magic header, followed by the salt, the nonce and the encrypted archive
+func Encrypt(archive Archive, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("Passphrase can't be empty")
+	}
+	archive.Version = Version
+	data, err := json.Marshal(archive)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encode state")
+	}
+
+	salt := make([]byte, saltSize)
+	_, err = io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate salt")
+	}
+	var nonce [nonceSize]byte
+	_, err = io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate nonce")
+	}
+
+	out := bytes.NewBufferString(magic)
+	out.Write(salt)
+	out.Write(nonce[:])
+	return secretbox.Seal(out.Bytes(), data, &nonce, deriveKey(passphrase, salt)), nil
+}
+
+// Decrypt decrypts and decodes an archive produced by Encrypt
+func Decrypt(data []byte, passphrase string) (Archive, error) {
+	archive := Archive{}
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return archive, errors.New("File is not a Protos state archive")
+	}
+	data = data[len(magic):]
+	if len(data) < saltSize+nonceSize {
+		return archive, errors.New("State archive is truncated")
+	}
+	salt := data[:saltSize]
+	var nonce [nonceSize]byte
+	copy(nonce[:], data[saltSize:saltSize+nonceSize])
+
+	plain, ok := secretbox.Open(nil, data[saltSize+nonceSize:], &nonce, deriveKey(passphrase, salt))
+	if !ok {
+		return archive, errors.New("Failed to decrypt state archive: wrong passphrase or corrupted file")
+	}
+	err := json.Unmarshal(plain, &archive)
+	if err != nil {
+		return archive, errors.Wrap(err, "Failed to decode state archive")
+	}
+	if archive.Version > Version {
+		return archive, errors.Errorf("State archive version %d is newer than the version supported by this client (%d). Please upgrade protos-cli", archive.Version, Version)
+	}
+	return archive, nil
+}
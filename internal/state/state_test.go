@@ -0,0 +1,27 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/user"
+)
+
+func TestArchive(t *testing.T) {
+	a := Archive{User: &user.Info{Username: "u", Password: "p"}, Clouds: []cloud.ProviderInfo{{Name: "c", Auth: map[string]string{"A": "b"}}}, Instances: []cloud.InstanceInfo{{Name: "i", KeySeed: []byte("k")}}, Primary: "i"}
+	data, err := Encrypt(a, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(data, "bad"); err == nil {
+		t.Fatal("expected error")
+	}
+	b, err := Decrypt(data, "pw")
+	if err != nil || b.User.Password != "p" || b.Clouds[0].Auth["A"] != "b" || string(b.Instances[0].KeySeed) != "k" || b.Primary != "i" || b.Version != Version {
+		t.Fatal(b, err)
+	}
+	b.Redact()
+	if b.User != nil || b.Clouds[0].Auth != nil || b.Instances[0].KeySeed != nil {
+		t.Fatal(b)
+	}
+}
@@ -8,7 +8,7 @@ import (
 
 	"cuelang.org/go/cue"
 	"cuelang.org/go/encoding/gocode/gocodec"
-	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/allocator"
 	"github.com/protosio/cli/internal/env"
 	"github.com/protosio/cli/internal/ssh"
 )
@@ -27,16 +27,15 @@ UserInfo :: {
     Name: string & strings.MinRunes(1) & strings.MaxRunes(128)
 	Domain: string & strings.MinRunes(3) & strings.MaxRunes(128)
 	Password: string & strings.MinRunes(10) & strings.MaxRunes(128)
+	SecretBackend: string
 	Device: dev
+	Devices: null | [...dev]
 }
 UserInfo
 `
 
-const (
-	// Address space for allocating networks
-	netSpace    = "10.100.0.0/16"
-	userNetwork = "10.100.0.1/24"
-)
+// ErrNoUser is returned when the local user has not been initialized
+var ErrNoUser = errors.New("There is no user info")
 
 var r cue.Runtime
 var codec = gocodec.New(&r, nil)
@@ -55,28 +54,187 @@ type Info struct {
 	Name     string
 	Domain   string
 	Password string
-	Device   Device
+	// Device is the device running the CLI, which connects to the instances using the VPN
+	Device Device
+	// Devices are the additional devices of the user, like phones or other laptops
+	Devices []Device
+	// spec of the backend storing the password. The password is empty in the DB if set
+	SecretBackend string
 }
 
-// Save saves the user to db
-func (ui Info) save() {
-	err := ui.env.DB.Save(&ui)
+// Seal returns a copy of the user with the password and device key encrypted using the provided function
+func (ui Info) Seal(seal func([]byte) ([]byte, error)) (interface{}, error) {
+	sealed := ui
+	password, err := seal([]byte(ui.Password))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encrypt user password: %w", err)
+	}
+	sealed.Password = string(password)
+	sealed.Device.KeySeed, err = seal(ui.Device.KeySeed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encrypt device key: %w", err)
+	}
+	sealed.Devices = make([]Device, len(ui.Devices))
+	for i, dev := range ui.Devices {
+		sealed.Devices[i] = dev
+		sealed.Devices[i].KeySeed, err = seal(dev.KeySeed)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encrypt key of device '%s': %w", dev.Name, err)
+		}
+	}
+	return &sealed, nil
+}
+
+// Unseal decrypts the password and device key of the user using the provided function
+func (ui *Info) Unseal(open func([]byte) ([]byte, error)) error {
+	password, err := open([]byte(ui.Password))
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt user password: %w", err)
+	}
+	ui.Password = string(password)
+	ui.Device.KeySeed, err = open(ui.Device.KeySeed)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("Failed to decrypt device key: %w", err)
+	}
+	for i := range ui.Devices {
+		ui.Devices[i].KeySeed, err = open(ui.Devices[i].KeySeed)
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt key of device '%s': %w", ui.Devices[i].Name, err)
+		}
 	}
+	return nil
+}
+
+// save writes the user to db. If the user has a secret backend, the password is stored in the backend instead
+func (ui Info) save() error {
+	backend, err := env.NewSecretBackend(ui.SecretBackend)
+	if err != nil {
+		return err
+	}
+	if backend != nil {
+		err = backend.Set(env.UserPasswordKey(ui.Username), ui.Password)
+		if err != nil {
+			return fmt.Errorf("Failed to store user password in secret backend '%s': %w", ui.SecretBackend, err)
+		}
+		ui.Password = ""
+	}
+	err = ui.env.DB.Save(&ui)
+	if err != nil {
+		return fmt.Errorf("Failed to save user: %w", err)
+	}
+	return nil
 }
 
 // SetName enables the changing of the name of the user
 func (ui Info) SetName(name string) error {
 	ui.Name = name
-	ui.save()
-	return nil
+	return ui.save()
 }
 
 // SetDomain enables the changing of the domain of the user
 func (ui Info) SetDomain(domain string) error {
 	ui.Domain = domain
-	ui.save()
+	return ui.save()
+}
+
+// SetSecretBackend moves the password of the user to a different secret backend
+func (ui Info) SetSecretBackend(spec string) error {
+	oldSpec := ui.SecretBackend
+	oldBackend, err := env.NewSecretBackend(oldSpec)
+	if err != nil {
+		return err
+	}
+	backend, err := env.NewSecretBackend(spec)
+	if err != nil {
+		return err
+	}
+	if backend != nil {
+		err = backend.Set(env.UserPasswordKey(ui.Username), ui.Password)
+		if err != nil {
+			return fmt.Errorf("Failed to store user password in secret backend '%s': %w", spec, err)
+		}
+		ui.SecretBackend = spec
+	} else {
+		ui.SecretBackend = ""
+	}
+	err = ui.save()
+	if err != nil {
+		return err
+	}
+	if oldBackend != nil && oldSpec != ui.SecretBackend {
+		err = oldBackend.Delete(env.UserPasswordKey(ui.Username))
+		if err != nil {
+			ui.env.Log.Warnf("Failed to delete user password from the previous secret backend: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// AllDevices returns the device running the CLI, followed by the additional devices of the user
+func (ui Info) AllDevices() []Device {
+	return append([]Device{ui.Device}, ui.Devices...)
+}
+
+// GetDevice returns a device of the user
+func (ui Info) GetDevice(name string) (Device, error) {
+	for _, dev := range ui.AllDevices() {
+		if dev.Name == name {
+			return dev, nil
+		}
+	}
+	return Device{}, fmt.Errorf("Device '%s' does not exist", name)
+}
+
+// AddDevice adds a device to the user, which uses the first address of the provided network. If keySeed is nil, a new
+// key is generated for the device
+func (ui Info) AddDevice(name string, keySeed []byte, network net.IPNet) (Device, error) {
+	if _, err := ui.GetDevice(name); err == nil {
+		return Device{}, fmt.Errorf("Device '%s' already exists", name)
+	}
+	var key ssh.Key
+	var err error
+	if keySeed == nil {
+		key, err = ssh.GenerateKey()
+	} else {
+		key, err = ssh.NewKeyFromSeed(keySeed)
+	}
+	if err != nil {
+		return Device{}, fmt.Errorf("Failed to add device '%s'. Invalid key: %w", name, err)
+	}
+	address := allocator.FirstAddress(network)
+	dev := Device{Name: name, KeySeed: key.Seed(), Network: address.String()}
+
+	ui.Devices = append(ui.Devices, dev)
+	err = ui.Validate()
+	if err != nil {
+		return Device{}, fmt.Errorf("Failed to add device '%s'. Validation error: %v", name, err)
+	}
+	err = ui.save()
+	if err != nil {
+		return Device{}, fmt.Errorf("Failed to add device '%s': %w", name, err)
+	}
+	return dev, nil
+}
+
+// RemoveDevice removes one of the additional devices of the user. The device running the CLI can't be removed
+func (ui Info) RemoveDevice(name string) error {
+	if name == ui.Device.Name {
+		return fmt.Errorf("Device '%s' is the device running protos-cli, and can't be removed", name)
+	}
+	devices := []Device{}
+	for _, dev := range ui.Devices {
+		if dev.Name != name {
+			devices = append(devices, dev)
+		}
+	}
+	if len(devices) == len(ui.Devices) {
+		return fmt.Errorf("Device '%s' does not exist", name)
+	}
+	ui.Devices = devices
+	err := ui.save()
+	if err != nil {
+		return fmt.Errorf("Failed to remove device '%s': %w", name, err)
+	}
 	return nil
 }
 
@@ -90,11 +248,14 @@ func (ui Info) Validate() error {
 // package methods
 //
 
-// New creates and returns a new user. Also validates the data
-func New(env *env.Env, username string, name string, domain string, password string) (Info, error) {
+// New creates and returns a new user, with the current device using the first address of the provided network. Also
+// validates the data
+func New(env *env.Env, username string, name string, domain string, password string, network net.IPNet) (Info, error) {
 	usrInfo, err := Get(env)
 	if err == nil {
 		return usrInfo, fmt.Errorf("User '%s' already initialized. Modify it using the 'user set' command", usrInfo.Username)
+	} else if err != ErrNoUser {
+		return usrInfo, err
 	}
 	host, err := os.Hostname()
 	if err != nil {
@@ -104,7 +265,8 @@ func New(env *env.Env, username string, name string, domain string, password str
 	if err != nil {
 		return usrInfo, fmt.Errorf("Failed to add user. Could not generate key: %w", err)
 	}
-	userDevice := Device{Name: host, KeySeed: key.Seed(), Network: userNetwork}
+	address := allocator.FirstAddress(network)
+	userDevice := Device{Name: host, KeySeed: key.Seed(), Network: address.String()}
 
 	user := Info{env: env, Username: username, Name: name, Domain: domain, Password: password, Device: userDevice}
 	err = user.Validate()
@@ -112,56 +274,58 @@ func New(env *env.Env, username string, name string, domain string, password str
 		return user, fmt.Errorf("Failed to add user. Validation error: %v", err)
 	}
 
-	user.save()
+	err = user.save()
+	if err != nil {
+		return user, fmt.Errorf("Failed to add user: %w", err)
+	}
 	return user, nil
 }
 
+// Import validates and saves a user restored from a state archive, replacing the existing user
+func Import(envi *env.Env, usr Info) (Info, error) {
+	usr.env = envi
+	err := usr.Validate()
+	if err != nil {
+		return usr, fmt.Errorf("Failed to import user. Validation error: %v", err)
+	}
+	existing, err := Get(envi)
+	if err == nil && existing.Username != usr.Username {
+		err = envi.DB.Delete(&existing)
+		if err != nil {
+			return usr, fmt.Errorf("Failed to replace user '%s': %w", existing.Username, err)
+		}
+	}
+	err = usr.save()
+	if err != nil {
+		return usr, fmt.Errorf("Failed to import user: %w", err)
+	}
+	return usr, nil
+}
+
 // Get returns information about the local user
-func Get(env *env.Env) (Info, error) {
+func Get(envi *env.Env) (Info, error) {
 	users := []Info{}
-	err := env.DB.All(&users)
+	err := envi.DB.All(&users)
 	if err != nil {
-		panic(err)
+		return Info{}, fmt.Errorf("Failed to read user info: %w", err)
 	}
 	if len(users) < 1 {
-		return Info{}, errors.New("There is no user info")
+		return Info{}, ErrNoUser
 	} else if len(users) > 1 {
-		panic("Found more than one user, please delete DB and re-run init")
+		return Info{}, fmt.Errorf("Found %d users in the database, but only one is supported. Please delete the DB and re-run init", len(users))
 	}
 
 	usr := users[0]
-	usr.env = env
-	return usr, nil
-}
-
-// AllocateNetwork allocates an unused network for an instance
-func AllocateNetwork(instances []cloud.InstanceInfo) (net.IPNet, error) {
-	_, userNet, err := net.ParseCIDR(userNetwork)
+	usr.env = envi
+	backend, err := env.NewSecretBackend(usr.SecretBackend)
 	if err != nil {
-		panic(err)
+		return usr, err
 	}
-	// create list of existing networks
-	usedNetworks := []net.IPNet{*userNet}
-	for _, inst := range instances {
-		_, inet, err := net.ParseCIDR(inst.Network)
+	if backend != nil {
+		usr.Password, err = backend.Get(env.UserPasswordKey(usr.Username))
 		if err != nil {
-			panic(err)
-		}
-		usedNetworks = append(usedNetworks, *inet)
-	}
-
-	// figure out which is the first network that is not currently used
-	_, netspace, _ := net.ParseCIDR(netSpace)
-	for i := 0; i <= 255; i++ {
-		newNet := *netspace
-		newNet.IP[2] = byte(i)
-		newNet.Mask[2] = byte(255)
-		for _, usedNet := range usedNetworks {
-			if !newNet.Contains(usedNet.IP) {
-				return newNet, nil
-			}
+			return usr, fmt.Errorf("Failed to retrieve user password from secret backend '%s': %w", usr.SecretBackend, err)
 		}
 	}
-
-	return net.IPNet{}, fmt.Errorf("Failed to allocate network")
+	return usr, nil
 }